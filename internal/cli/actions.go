@@ -0,0 +1,180 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// Plugin is a plugin as registered with the Velero plugin server.
+type Plugin struct {
+	Name string
+	New  func(logrus.FieldLogger) (interface{}, error)
+	// NewWithClient is used instead of New by the simulations, if set, for plugins
+	// that talk to the cluster. The client is a fake that records what they do.
+	NewWithClient func(logrus.FieldLogger, kubernetes.Interface) (interface{}, error)
+}
+
+func (p Plugin) instantiate(log logrus.FieldLogger, client kubernetes.Interface) (interface{}, error) {
+	log = log.WithField("plugin", p.Name)
+	if p.NewWithClient != nil {
+		return p.NewWithClient(log, client)
+	}
+	return p.New(log)
+}
+
+// Plugins lists the plugins served by the binary, in the order they are
+// registered, so that subcommands can run them the way Velero would.
+type Plugins struct {
+	BackupItemActions  []Plugin
+	RestoreItemActions []Plugin
+}
+
+// selectorMatcher decides which items an action's ResourceSelector applies to.
+// Velero resolves the resources of a selector through API discovery; offline, a
+// resource matches when it's named either with its group ("deployments.apps") or
+// without it ("deployments"). Short names like "deploy" aren't understood.
+type selectorMatcher struct {
+	includedResources []string
+	excludedResources []string
+	namespaces        *collections.IncludesExcludes
+	labels            labels.Selector
+}
+
+func newSelectorMatcher(selector velero.ResourceSelector) (*selectorMatcher, error) {
+	labelSelector := labels.Everything()
+	if selector.LabelSelector != "" {
+		var err error
+		if labelSelector, err = labels.Parse(selector.LabelSelector); err != nil {
+			return nil, errors.Wrapf(err, "error parsing label selector %q", selector.LabelSelector)
+		}
+	}
+
+	return &selectorMatcher{
+		includedResources: selector.IncludedResources,
+		excludedResources: selector.ExcludedResources,
+		namespaces:        collections.NewIncludesExcludes().Includes(selector.IncludedNamespaces...).Excludes(selector.ExcludedNamespaces...),
+		labels:            labelSelector,
+	}, nil
+}
+
+func (m *selectorMatcher) Matches(item *backupItem, obj *unstructured.Unstructured) bool {
+	if len(m.includedResources) > 0 && !resourceListed(m.includedResources, item) {
+		return false
+	}
+	if resourceListed(m.excludedResources, item) {
+		return false
+	}
+
+	// Like Velero, a namespace filter means the action never applies to cluster-scoped items.
+	if item.Namespace != "" && !m.namespaces.ShouldInclude(item.Namespace) {
+		return false
+	}
+	if item.Namespace == "" && !m.namespaces.IncludeEverything() {
+		return false
+	}
+
+	return m.labels.Matches(labels.Set(obj.GetLabels()))
+}
+
+func resourceListed(resources []string, item *backupItem) bool {
+	for _, resource := range resources {
+		if resource == "*" || resource == item.GroupResource || resource == item.Resource() {
+			return true
+		}
+	}
+	return false
+}
+
+// diffItems returns a unified diff of two versions of an item, rendered as YAML.
+// It's empty when they're the same.
+func diffItems(name string, before, after map[string]interface{}) (string, error) {
+	a, err := yaml.Marshal(before)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	b, err := yaml.Marshal(after)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: name + " (before)",
+		ToFile:   name + " (after)",
+		Context:  3,
+	})
+}
+
+// newFakeClient returns a client that keeps everything in memory. Like the API
+// server, it names objects created with only a generateName.
+func newFakeClient() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.CreateAction).GetObject()
+		if metadata, err := meta.Accessor(obj); err == nil && metadata.GetName() == "" && metadata.GetGenerateName() != "" {
+			metadata.SetName(metadata.GetGenerateName() + utilrand.String(5))
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+// describeClientActions describes the changes made through a fake client.
+func describeClientActions(actions []clienttesting.Action) []string {
+	var descriptions []string
+	for _, action := range actions {
+		if action.GetVerb() == "get" || action.GetVerb() == "list" || action.GetVerb() == "watch" {
+			continue
+		}
+		name := ""
+		switch a := action.(type) {
+		case clienttesting.CreateAction:
+			// Actions are recorded before the reactors run, so generated names are missing.
+			if metadata, err := meta.Accessor(a.GetObject()); err == nil {
+				name = metadata.GetName()
+				if name == "" {
+					name = metadata.GetGenerateName() + "<generated>"
+				}
+			}
+		case clienttesting.UpdateAction:
+			if metadata, err := meta.Accessor(a.GetObject()); err == nil {
+				name = metadata.GetName()
+			}
+		case clienttesting.DeleteAction:
+			name = a.GetName()
+		case clienttesting.PatchAction:
+			name = a.GetName()
+		}
+		descriptions = append(descriptions, action.GetVerb()+" "+action.GetResource().Resource+" "+qualifiedName(action.GetNamespace(), name))
+	}
+	return descriptions
+}
@@ -0,0 +1,170 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// storeOptions locates a backup storage location kept by the FileObjectStore.
+type storeOptions struct {
+	root   string
+	bucket string
+	prefix string
+}
+
+func (o *storeOptions) BindFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.root, "root", "", "directory holding the buckets (defaults to $ARK_FILE_OBJECT_STORE_ROOT or /tmp/backups)")
+	flags.StringVar(&o.bucket, "bucket", "", "bucket of the backup storage location")
+	flags.StringVar(&o.prefix, "prefix", "", "prefix of the backup storage location")
+}
+
+// backupsDir returns the directory holding one subdirectory per backup.
+func (o *storeOptions) backupsDir() string {
+	return filepath.Join(plugin.NewFileObjectStoreAt(nil, o.root).Root(), o.bucket, o.prefix, "backups")
+}
+
+// backupDir returns the directory holding the objects of a single backup.
+func (o *storeOptions) backupDir(name string) string {
+	return filepath.Join(o.backupsDir(), name)
+}
+
+// backupTarball returns the path of a backup's tarball.
+func (o *storeOptions) backupTarball(name string) string {
+	return filepath.Join(o.backupDir(name), name+".tar.gz")
+}
+
+// readBackup reads the Backup object Velero stores alongside a backup's tarball.
+func (o *storeOptions) readBackup(name string) (*velerov1api.Backup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(o.backupDir(name), "velero-backup.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	backup := new(velerov1api.Backup)
+	if err := json.Unmarshal(data, backup); err != nil {
+		return nil, errors.Wrapf(err, "error decoding velero-backup.json of %s", name)
+	}
+	return backup, nil
+}
+
+// listBackups returns the names of the backups in the storage location.
+func (o *storeOptions) listBackups() ([]string, error) {
+	entries, err := os.ReadDir(o.backupsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// backupItem is a single resource stored in a backup tarball.
+type backupItem struct {
+	// GroupResource is the resource as Velero names its directory, e.g. "deployments.apps".
+	GroupResource string
+	// Namespace is empty for cluster-scoped resources.
+	Namespace string
+	Name      string
+	// Path is where the item is kept in the tarball.
+	Path string
+	Data []byte
+}
+
+// Resource returns the resource without its group.
+func (i *backupItem) Resource() string {
+	return strings.SplitN(i.GroupResource, ".", 2)[0]
+}
+
+// walkBackupItems calls fn for every item of a gzipped backup tarball, in the order
+// they are stored.
+func walkBackupItems(r io.Reader, fn func(*backupItem) error) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "error opening backup tarball")
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading backup tarball")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		item := parseItemPath(header.Name)
+		if item == nil {
+			continue
+		}
+		if item.Data, err = ioutil.ReadAll(tr); err != nil {
+			return errors.Wrapf(err, "error reading %s", header.Name)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// parseItemPath understands resources/<resource>/namespaces/<namespace>/<name>.json
+// and resources/<resource>/cluster/<name>.json. Velero also stores every item under
+// a directory per API version, e.g. resources/<resource>/v1-preferredversion/...,
+// but always keeps the preferred version at the unversioned path for backward
+// compatibility, so the versioned copies are skipped and nil is returned for them.
+func parseItemPath(name string) *backupItem {
+	parts := strings.Split(strings.TrimPrefix(name, "./"), "/")
+	if len(parts) < 4 || parts[0] != velerov1api.ResourcesDir || !strings.HasSuffix(name, ".json") {
+		return nil
+	}
+
+	item := &backupItem{GroupResource: parts[1], Path: name}
+	switch {
+	case len(parts) == 5 && parts[2] == velerov1api.NamespaceScopedDir:
+		item.Namespace = parts[3]
+		item.Name = strings.TrimSuffix(parts[4], ".json")
+	case len(parts) == 4 && parts[2] == velerov1api.ClusterScopedDir:
+		item.Name = strings.TrimSuffix(parts[3], ".json")
+	default:
+		return nil
+	}
+	return item
+}
@@ -0,0 +1,43 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseItemPath(t *testing.T) {
+	for path, want := range map[string]*backupItem{
+		"resources/deployments.apps/namespaces/ns/app.json":         {GroupResource: "deployments.apps", Namespace: "ns", Name: "app"},
+		"./resources/pods/namespaces/ns/pod.json":                   {GroupResource: "pods", Namespace: "ns", Name: "pod"},
+		"resources/namespaces/cluster/ns.json":                      {GroupResource: "namespaces", Name: "ns"},
+		"resources/pods/v1-preferredversion/namespaces/ns/pod.json": nil,
+		"resources/pods/namespaces/ns/pod.yaml":                     nil,
+		"metadata/version":                                          nil,
+	} {
+		item := parseItemPath(path)
+		if want == nil {
+			assert.Nil(t, item, path)
+			continue
+		}
+		want.Path = path
+		assert.Equal(t, want, item, path)
+	}
+	assert.Equal(t, "deployments", (&backupItem{GroupResource: "deployments.apps"}).Resource())
+}
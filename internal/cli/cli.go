@@ -0,0 +1,58 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cli implements the subcommands of the plugin binary. They run outside
+// of Velero, e.g. from a shell in the plugin image, and work directly against the
+// data the plugins keep on disk.
+package cli
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// NewCommand returns the root command for the plugin binary's subcommands.
+func NewCommand(name string, plugins Plugins) *cobra.Command {
+	c := &cobra.Command{
+		Use:          name,
+		Short:        "Tools for the Velero example plugins",
+		SilenceUsage: true,
+	}
+
+	c.AddCommand(
+		NewScrubCommand(),
+		NewInspectCommand(),
+		NewSimulateRestoreCommand(plugins),
+		NewSimulateBackupCommand(plugins),
+		NewPruneCommand(),
+		NewVerifySnapshotCommand(),
+		NewStatsCommand(),
+		NewSnapshotRestoreFilesCommand(),
+		NewExportSnapshotCommand(),
+		NewImportSnapshotCommand(),
+		NewSnapshotsCommand(),
+	)
+
+	return c
+}
+
+func newLogger() logrus.FieldLogger {
+	log := logrus.New()
+	log.Out = os.Stderr
+	return log
+}
@@ -0,0 +1,121 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// newTestStore returns a file object store in a temporary directory, and the
+// options that point subcommands at its "velero" bucket.
+func newTestStore(t *testing.T) (*plugin.FileObjectStore, storeOptions) {
+	opts := storeOptions{root: t.TempDir(), bucket: "velero"}
+	log := logrus.New()
+	log.Out = io.Discard
+	return plugin.NewFileObjectStoreAt(log, opts.root), opts
+}
+
+// writeTestBackup stores a completed backup the way Velero does, with a tarball
+// holding items, keyed by their path in the tarball.
+func writeTestBackup(t *testing.T, store *plugin.FileObjectStore, opts storeOptions, name string, items map[string]interface{}) {
+	prefix := "backups/" + name + "/"
+	backup, err := json.Marshal(&velerov1api.Backup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: velerov1api.DefaultNamespace, Name: name},
+		Status:     velerov1api.BackupStatus{Phase: velerov1api.BackupPhaseCompleted},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.PutObject(opts.bucket, prefix+"velero-backup.json", bytes.NewReader(backup)))
+	require.NoError(t, store.PutObject(opts.bucket, prefix+name+".tar.gz", bytes.NewReader(newTestTarball(t, items))))
+	require.NoError(t, store.PutObject(opts.bucket, prefix+name+"-logs.gz", bytes.NewReader(gzipBytes(t, []byte("log line\n")))))
+}
+
+func newTestTarball(t *testing.T, items map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, item := range items {
+		data, err := json.Marshal(item)
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	_, err := gzw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+// testItem returns an item of a backup tarball.
+func testItem(apiVersion, kind, namespace, name string) map[string]interface{} {
+	metadata := map[string]interface{}{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	return map[string]interface{}{"apiVersion": apiVersion, "kind": kind, "metadata": metadata}
+}
+
+// newTestSnapshot takes a snapshot of a new volume with a volume snapshotter
+// configured with config, and returns its ID and the volume directory.
+func newTestSnapshot(t *testing.T, config map[string]string, tags map[string]string) (string, string) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "nested"), []byte("nested data"), 0644))
+
+	log := logrus.New()
+	log.Out = io.Discard
+	snapshotter := plugin.NewNoOpVolumeSnapshotter(log)
+	require.NoError(t, snapshotter.Init(config))
+	snapshotID, err := snapshotter.CreateSnapshot("hostPath:"+dir, "", tags)
+	require.NoError(t, err)
+	return snapshotID, dir
+}
+
+// runCommand runs a subcommand with args and returns what it wrote.
+func runCommand(t *testing.T, c *cobra.Command, args ...string) (string, error) {
+	var out bytes.Buffer
+	c.SetArgs(args)
+	c.SetOut(&out)
+	c.SetErr(io.Discard)
+	c.SilenceUsage = true
+	err := c.Execute()
+	return out.String(), err
+}
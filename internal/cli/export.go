@@ -0,0 +1,138 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// NewExportSnapshotCommand returns the command that writes a volume snapshot to
+// a portable tar file.
+func NewExportSnapshotCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		file        string
+		compression string
+	)
+
+	c := &cobra.Command{
+		Use:   "export-snapshot SNAPSHOT_ID",
+		Short: "Write a volume snapshot to a portable tar file",
+		Long: `Write a volume snapshot to a portable tar file.
+
+The file describes itself, and can be read without Velero: snapshot.json holds
+the ID, volume, tags and creation time of the snapshot, manifest.json lists its
+files with their SHA-256, and the directory tree of the volume follows under
+data/, with its metadata. With --compression, the whole file is compressed with
+gzip or zstd. import-snapshot registers it in the catalog of another state
+directory.`,
+		Example: `  velero-plugin-example export-snapshot hostPath:/data.snap.6129484611666145821 -f snapshot.tar.gz --compression gzip
+  velero-plugin-example export-snapshot hostPath:/data.snap.6129484611666145821 | tar tv`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+			var out io.WriteCloser = nopWriteCloser{c.OutOrStdout()}
+			if file != "-" {
+				if out, err = os.Create(file); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			if err := s.ExportSnapshot(args[0], out, compression); err != nil {
+				out.Close()
+				return err
+			}
+			return errors.WithStack(out.Close())
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringVarP(&file, "file", "f", "-", "file to write the snapshot to, - for standard output")
+	c.Flags().StringVar(&compression, "compression", "", "gzip or zstd to compress the file")
+
+	return c
+}
+
+// NewImportSnapshotCommand returns the command that registers a volume snapshot
+// written by export-snapshot in the catalog.
+func NewImportSnapshotCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		file        string
+	)
+
+	c := &cobra.Command{
+		Use:   "import-snapshot",
+		Short: "Register a volume snapshot written by export-snapshot",
+		Long: `Register a volume snapshot written by export-snapshot.
+
+The snapshot keeps its ID and tags, so that Velero restores of backups that
+reference it can create volumes from it. Its data is checked against the
+manifest of the file, then saved where new snapshots go with the --config given,
+in the state directory or an object store. Compression is detected. If the ID
+ends with the version of the key the snapshot was encrypted with, it's replaced
+by the version of the key it's encrypted with now, if any, and the resulting ID
+is printed.
+
+The catalog is locked while it's changed, so a running plugin sees the imported
+snapshot.`,
+		Example: `  velero-plugin-example import-snapshot -f snapshot.tar.gz --state-dir /var/lib/velero-plugin-example`,
+		Args:    cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+			in := c.InOrStdin()
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer f.Close()
+				in = f
+			}
+			snapshotID, err := s.ImportSnapshot(in)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(c.OutOrStdout(), snapshotID)
+			return nil
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringVarP(&file, "file", "f", "-", "file to read the snapshot from, - for standard input")
+
+	return c
+}
+
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestExportImportSnapshotCommands(t *testing.T) {
+	stateDir := t.TempDir()
+	snapshotID, _ := newTestSnapshot(t, map[string]string{"stateDir": stateDir}, map[string]string{"velero.io/backup": "b1"})
+
+	exported, err := runCommand(t, NewExportSnapshotCommand(), snapshotID, "--state-dir", stateDir, "--compression", "gzip")
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+	require.NoError(t, os.WriteFile(file, []byte(exported), 0644))
+
+	other := t.TempDir()
+	out, err := runCommand(t, NewImportSnapshotCommand(), "-f", file, "--state-dir", other)
+	require.NoError(t, err)
+	assert.Equal(t, snapshotID+"\n", out)
+	catalog, err := plugin.LoadSnapshotCatalog(other)
+	require.NoError(t, err)
+	assert.Equal(t, []string{snapshotID}, catalog.SnapshotsTagged(map[string]string{"velero.io/backup": "b1"}))
+}
@@ -0,0 +1,206 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// NewInspectCommand returns the command that browses the backups in a file object
+// store without going through Velero.
+func NewInspectCommand() *cobra.Command {
+	var (
+		store     storeOptions
+		namespace string
+	)
+
+	c := &cobra.Command{
+		Use:   "inspect [BACKUP [RESOURCE NAME]]",
+		Short: "Browse the backups in a file object store",
+		Long: `Browse the backups in a file object store without going through Velero.
+
+With no arguments, every backup is listed with its phase, size and number of
+items. Given a backup, the items in its tarball are counted by resource. Given a
+backup, a resource such as deployments.apps and a name, the manifest of that
+item is written to stdout.`,
+		Example: `  velero-plugin-example inspect --bucket velero
+  velero-plugin-example inspect --bucket velero nightly-20230321
+  velero-plugin-example inspect --bucket velero nightly-20230321 deployments.apps nginx-deployment -n nginx-example`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) == 2 || len(args) > 3 {
+				return errors.New("expected no arguments, a backup, or a backup, resource and name")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			switch len(args) {
+			case 0:
+				return listBackups(c.OutOrStdout(), &store)
+			case 1:
+				return listResources(c.OutOrStdout(), &store, args[0])
+			default:
+				return printItem(c.OutOrStdout(), &store, args[0], args[1], namespace, args[2])
+			}
+		},
+	}
+
+	store.BindFlags(c.Flags())
+	c.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace of the item to print, empty for cluster-scoped items")
+	c.MarkFlagRequired("bucket")
+
+	return c
+}
+
+func listBackups(out io.Writer, store *storeOptions) error {
+	names, err := store.listBackups()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPHASE\tCREATED\tSIZE\tITEMS")
+	for _, name := range names {
+		phase, created := "<unknown>", "<unknown>"
+		if backup, err := store.readBackup(name); err == nil {
+			phase = string(backup.Status.Phase)
+			if !backup.CreationTimestamp.IsZero() {
+				created = backup.CreationTimestamp.UTC().Format("2006-01-02 15:04:05")
+			}
+		}
+
+		size, err := dirSize(store.backupDir(name))
+		if err != nil {
+			return err
+		}
+
+		items := "<unknown>"
+		if counts, err := countItems(store.backupTarball(name)); err == nil {
+			total := 0
+			for _, n := range counts {
+				total += n
+			}
+			items = fmt.Sprint(total)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, phase, created, resource.NewQuantity(size, resource.BinarySI), items)
+	}
+	return w.Flush()
+}
+
+func listResources(out io.Writer, store *storeOptions, backup string) error {
+	counts, err := countItems(store.backupTarball(backup))
+	if err != nil {
+		return err
+	}
+
+	resources := make([]string, 0, len(counts))
+	for resource := range counts {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tITEMS")
+	for _, resource := range resources {
+		fmt.Fprintf(w, "%s\t%d\n", resource, counts[resource])
+	}
+	return w.Flush()
+}
+
+func printItem(out io.Writer, store *storeOptions, backup, resource, namespace, name string) error {
+	file, err := os.Open(store.backupTarball(backup))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	errFound := errors.New("found")
+	var found *backupItem
+	err = walkBackupItems(file, func(item *backupItem) error {
+		if (item.GroupResource == resource || item.Resource() == resource) && item.Namespace == namespace && item.Name == name {
+			found = item
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return err
+	}
+	if found == nil {
+		return errors.Errorf("%s %s not found in backup %s", resource, qualifiedName(namespace, name), backup)
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, found.Data, "", "  "); err != nil {
+		return errors.Wrapf(err, "error formatting %s", found.Path)
+	}
+	buf.WriteString("\n")
+	_, err = buf.WriteTo(out)
+	return err
+}
+
+// countItems counts the items of a backup tarball by resource.
+func countItems(tarball string) (map[string]int, error) {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	counts := make(map[string]int)
+	err = walkBackupItems(file, func(item *backupItem) error {
+		counts[item.GroupResource]++
+		return nil
+	})
+	return counts, err
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, errors.WithStack(err)
+}
+
+func qualifiedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
@@ -0,0 +1,87 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectCommand(t *testing.T) {
+	store, opts := newTestStore(t)
+	writeTestBackup(t, store, opts, "b1", map[string]interface{}{
+		"resources/pods/namespaces/ns/pod-a.json":                     testItem("v1", "Pod", "ns", "pod-a"),
+		"resources/pods/namespaces/ns/pod-b.json":                     testItem("v1", "Pod", "ns", "pod-b"),
+		"resources/pods/v1-preferredversion/namespaces/ns/pod-a.json": testItem("v1", "Pod", "ns", "pod-a"),
+		"resources/namespaces/cluster/ns.json":                        testItem("v1", "Namespace", "", "ns"),
+	})
+	flags := []string{"--root", opts.root, "--bucket", opts.bucket}
+
+	for name, test := range map[string]struct {
+		args     []string
+		contains []string
+		err      string
+	}{
+		"list backups": {
+			contains: []string{"NAME", "b1", "Completed", "3\n"},
+		},
+		"count resources": {
+			args:     []string{"b1"},
+			contains: []string{"namespaces  1", "pods        2"},
+		},
+		"print namespaced item": {
+			args:     []string{"b1", "pods", "pod-b", "-n", "ns"},
+			contains: []string{`"name": "pod-b"`, `"namespace": "ns"`},
+		},
+		"print cluster-scoped item": {
+			args:     []string{"b1", "namespaces", "ns"},
+			contains: []string{`"kind": "Namespace"`},
+		},
+		"missing item": {
+			args: []string{"b1", "pods", "pod-c", "-n", "ns"},
+			err:  "pods ns/pod-c not found in backup b1",
+		},
+		"missing backup": {
+			args: []string{"b2"},
+			err:  "no such file",
+		},
+		"wrong number of arguments": {
+			args: []string{"b1", "pods"},
+			err:  "expected no arguments",
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			out, err := runCommand(t, NewInspectCommand(), append(test.args, flags...)...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			for _, s := range test.contains {
+				assert.Contains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestInspectCommandRequiresBucket(t *testing.T) {
+	_, err := runCommand(t, NewInspectCommand(), "--root", t.TempDir())
+	assert.ErrorContains(t, err, `"bucket" not set`)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewPruneCommand returns the command that deletes volume snapshots by retention
+// rules on their tags.
+func NewPruneCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		rules       []string
+		dryRun      bool
+		output      string
+	)
+
+	c := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete volume snapshots by retention rules on their tags",
+		Long: `Delete volume snapshots by retention rules on their tags.
+
+A rule is a comma-separated list of key=value pairs. keepLast=<n> keeps the n
+most recent snapshots of every PVC, or of every value of the tag given with
+groupBy=<tag>. olderThan=<age> selects snapshots older than the age, as a Go
+duration or a number of days like 30d. Any other pair is a tag snapshots must
+have to be selected, such as velero.io/schedule-name=daily. With both keepLast
+and olderThan, snapshots must be beyond the last n and old enough.
+
+Snapshots selected by any rule are deleted. Without --rule, the rules of the
+retention key of --config are applied. Velero still lists the deleted snapshots
+in its backups; restoring them fails.
+
+The catalog is locked while it's changed, but copies a running plugin is reading
+from aren't: prune while no backup, restore or deletion is in progress, or
+configure the retention policy of the volume snapshot location instead.`,
+		Example: `  velero-plugin-example prune --rule keepLast=3 --dry-run
+  velero-plugin-example prune --rule velero.io/schedule-name=daily,olderThan=30d
+  velero-plugin-example prune --config objectStore=example.io/object-store-plugin,objectStoreBucket=snapshots --rule keepLast=1,groupBy=velero.io/pv`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return errors.Errorf("invalid output %q, use table or json", output)
+			}
+			var parsed []plugin.RetentionRule
+			for _, rule := range rules {
+				r, err := plugin.ParseRetentionRule(rule)
+				if err != nil {
+					return err
+				}
+				parsed = append(parsed, r)
+			}
+			if len(rules) == 0 {
+				var err error
+				if parsed, err = plugin.ParseRetentionRules(snapshotter.config["retention"]); err != nil {
+					return err
+				}
+			}
+			if len(parsed) == 0 {
+				return errors.New("no retention rules, use --rule or the retention key of --config")
+			}
+
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+			candidates, pruneErr := s.Prune(parsed, dryRun)
+			if err := printPruneCandidates(c.OutOrStdout(), candidates, output); err != nil {
+				return err
+			}
+			return pruneErr
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringArrayVar(&rules, "rule", nil, "retention rule, may be repeated")
+	c.Flags().BoolVar(&dryRun, "dry-run", false, "list the snapshots that would be deleted without deleting them")
+	c.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	return c
+}
+
+func printPruneCandidates(out io.Writer, candidates []plugin.PruneCandidate, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(candidates))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tVOLUME\tCREATED\tTAGS\tRULE")
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", candidate.SnapshotID, candidate.VolumeID,
+			candidate.CreationTimestamp.UTC().Format("2006-01-02 15:04:05"), formatTags(candidate.Tags), candidate.Rule)
+	}
+	return w.Flush()
+}
+
+// formatTags writes tags as sorted key=value pairs.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,118 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewSnapshotRestoreFilesCommand returns the command that lists the files of a
+// volume snapshot and extracts some of them.
+func NewSnapshotRestoreFilesCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		target      string
+		output      string
+	)
+
+	c := &cobra.Command{
+		Use:   "snapshot-restore-files SNAPSHOT_ID [PATH...]",
+		Short: "List the files of a volume snapshot, or extract some of them",
+		Long: `List the files of a volume snapshot, or extract some of them.
+
+Without paths, the directories, files and symlinks of the snapshot are listed.
+With paths, the entries they match are extracted into the --target directory
+with their mode, ownership, modification time and extended attributes, without
+creating a volume. Paths are relative to the root of the volume and may be globs
+such as 'logs/*.log'; directories are extracted with everything below them, and
+the directories leading to what's extracted are recreated too, unless the target
+directory already has them, so that files can be recovered into the volume they
+were taken from. Entries that already exist in the target directory aren't
+overwritten: the command fails instead.`,
+		Example: `  velero-plugin-example snapshot-restore-files hostPath:/data.snap.6129484611666145821
+  velero-plugin-example snapshot-restore-files hostPath:/data.snap.6129484611666145821 'db/*.conf' logs --target /tmp/restored`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return errors.Errorf("invalid output %q, use table or json", output)
+			}
+			snapshotID, paths := args[0], args[1:]
+			if len(paths) > 0 && target == "" {
+				return errors.New("--target is required to extract files")
+			}
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+
+			if len(paths) == 0 {
+				entries, err := s.SnapshotFiles(snapshotID)
+				if err != nil {
+					return err
+				}
+				return printSnapshotFiles(c.OutOrStdout(), entries, output)
+			}
+			restored, err := s.RestoreSnapshotFiles(snapshotID, paths, target)
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				enc := json.NewEncoder(c.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return errors.WithStack(enc.Encode(restored))
+			}
+			for _, path := range restored {
+				fmt.Fprintln(c.OutOrStdout(), path)
+			}
+			return nil
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringVar(&target, "target", "", "directory to extract the files to, created if needed")
+	c.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	return c
+}
+
+func printSnapshotFiles(out io.Writer, entries []plugin.ManifestEntry, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(entries))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tMODE\tSIZE\tPATH")
+	for _, entry := range entries {
+		name := entry.Path
+		if entry.Target != "" {
+			name += " -> " + entry.Target
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Type, entry.Mode, resource.NewQuantity(entry.Size, resource.BinarySI), name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,63 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestSnapshotRestoreFilesCommand(t *testing.T) {
+	stateDir := t.TempDir()
+	snapshotID, volume := newTestSnapshot(t, map[string]string{"stateDir": stateDir}, nil)
+
+	out, err := runCommand(t, NewSnapshotRestoreFilesCommand(), snapshotID, "--state-dir", stateDir, "-o", "json")
+	require.NoError(t, err)
+	var entries []plugin.ManifestEntry
+	require.NoError(t, json.Unmarshal([]byte(out), &entries))
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.ElementsMatch(t, []string{".", "file", "sub", "sub/nested"}, paths)
+
+	// A deleted file is recovered into the volume, next to the files that
+	// are still there.
+	require.NoError(t, os.Remove(filepath.Join(volume, "sub", "nested")))
+	out, err = runCommand(t, NewSnapshotRestoreFilesCommand(), snapshotID, "sub/nested", "--target", volume, "--state-dir", stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, "sub\nsub/nested\n", out)
+	data, err := os.ReadFile(filepath.Join(volume, "sub", "nested"))
+	require.NoError(t, err)
+	assert.Equal(t, "nested data", string(data))
+
+	// Existing files aren't overwritten.
+	_, err = runCommand(t, NewSnapshotRestoreFilesCommand(), snapshotID, "file", "--target", volume, "--state-dir", stateDir)
+	assert.Error(t, err)
+}
+
+func TestSnapshotRestoreFilesCommandRequiresTarget(t *testing.T) {
+	_, err := runCommand(t, NewSnapshotRestoreFilesCommand(), "hostPath:/data.snap.1", "file", "--state-dir", t.TempDir())
+	assert.ErrorContains(t, err, "--target is required to extract files")
+}
@@ -0,0 +1,94 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewScrubCommand returns the command that verifies the backups in a file object store.
+func NewScrubCommand() *cobra.Command {
+	var (
+		store          storeOptions
+		interval       time.Duration
+		metricsAddress string
+	)
+
+	c := &cobra.Command{
+		Use:   "scrub",
+		Short: "Verify the integrity of the backups in a file object store",
+		Long: `Verify the integrity of the backups in a file object store.
+
+Every backup is checked for its metadata, tarball and logs, each object is
+compared with the checksum recorded when it was written, and gzipped objects
+are decompressed in full. A report is written to ` + plugin.ScrubReportKey + `
+under the prefix. With --interval the scrub repeats until the process is stopped.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			log := newLogger()
+			objectStore := plugin.NewFileObjectStoreAt(log, store.root)
+			scrubber := plugin.NewScrubber(log, objectStore, store.bucket, store.prefix)
+
+			if metricsAddress != "" {
+				registry := prometheus.NewRegistry()
+				registry.MustRegister(plugin.ScrubCollectors()...)
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+				go func() {
+					if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+						log.WithError(err).Error("Metrics server stopped")
+					}
+				}()
+			}
+
+			if interval > 0 {
+				scrubber.Run(c.Context(), interval)
+				return nil
+			}
+
+			report, err := scrubber.Scrub()
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(c.OutOrStdout())
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return errors.WithStack(err)
+			}
+			if len(report.Findings) > 0 {
+				return errors.Errorf("found %d problems", len(report.Findings))
+			}
+			return nil
+		},
+	}
+
+	store.BindFlags(c.Flags())
+	c.Flags().DurationVar(&interval, "interval", 0, "scrub repeatedly at this interval instead of once")
+	c.Flags().StringVar(&metricsAddress, "metrics-address", "", "serve Prometheus metrics on this address, e.g. :8085")
+	c.MarkFlagRequired("bucket")
+
+	return c
+}
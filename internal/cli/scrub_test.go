@@ -0,0 +1,105 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestScrubCommand(t *testing.T) {
+	items := map[string]interface{}{
+		"resources/pods/namespaces/ns/pod.json": testItem("v1", "Pod", "ns", "pod"),
+	}
+
+	for name, test := range map[string]struct {
+		damage   func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions)
+		problems []string
+	}{
+		"healthy": {
+			damage: func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions) {},
+		},
+		"missing logs": {
+			damage: func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions) {
+				require.NoError(t, store.DeleteObject(opts.bucket, "backups/b1/b1-logs.gz"))
+			},
+			problems: []string{plugin.ScrubMissingObject},
+		},
+		"corrupt metadata": {
+			damage: func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions) {
+				path := filepath.Join(opts.root, opts.bucket, "backups", "b1", "velero-backup.json")
+				require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+			},
+			problems: []string{plugin.ScrubChecksumMismatch},
+		},
+		"tarball isn't gzipped": {
+			damage: func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions) {
+				require.NoError(t, store.PutObject(opts.bucket, "backups/b1/b1.tar.gz", bytes.NewReader([]byte("plain"))))
+			},
+			problems: []string{plugin.ScrubUnreadable},
+		},
+		"object without checksum": {
+			damage: func(t *testing.T, store *plugin.FileObjectStore, opts storeOptions) {
+				path := filepath.Join(opts.root, opts.bucket, "backups", "b1", "extra.json")
+				require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+			},
+			problems: []string{plugin.ScrubMissingChecksum},
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store, opts := newTestStore(t)
+			writeTestBackup(t, store, opts, "b1", items)
+			test.damage(t, store, opts)
+
+			out, err := runCommand(t, NewScrubCommand(), "--root", opts.root, "--bucket", opts.bucket)
+			if len(test.problems) == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+
+			var report plugin.ScrubReport
+			require.NoError(t, json.Unmarshal([]byte(out), &report))
+			assert.Equal(t, 1, report.BackupsScanned)
+			var problems []string
+			for _, finding := range report.Findings {
+				assert.Equal(t, "b1", finding.Backup)
+				problems = append(problems, finding.Problem)
+			}
+			assert.Equal(t, test.problems, problems)
+
+			// The report is also kept in the bucket.
+			exists, err := store.ObjectExists(opts.bucket, plugin.ScrubReportKey)
+			require.NoError(t, err)
+			assert.True(t, exists)
+		})
+	}
+}
+
+func TestScrubCommandRequiresBucket(t *testing.T) {
+	_, err := runCommand(t, NewScrubCommand(), "--root", t.TempDir())
+	assert.ErrorContains(t, err, `"bucket" not set`)
+}
@@ -0,0 +1,291 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// backupItemActionV1 and backupItemActionV2 are what the simulation needs from
+// the two versions of backup item actions.
+type backupItemActionV1 interface {
+	AppliesTo() (velero.ResourceSelector, error)
+	Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error)
+}
+
+type backupItemActionV2 interface {
+	AppliesTo() (velero.ResourceSelector, error)
+	Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, string, []velero.ResourceIdentifier, error)
+}
+
+// backupItemActionResult is the outcome of either version of Execute.
+type backupItemActionResult struct {
+	item            runtime.Unstructured
+	additionalItems []velero.ResourceIdentifier
+	operationID     string
+	itemsToUpdate   []velero.ResourceIdentifier
+}
+
+type namedBackupItemAction struct {
+	name     string
+	execute  func(item runtime.Unstructured, backup *velerov1api.Backup) (*backupItemActionResult, error)
+	selector *selectorMatcher
+	client   *fake.Clientset
+}
+
+// NewSimulateBackupCommand returns the command that runs the backup item actions
+// over manifests on disk.
+func NewSimulateBackupCommand(plugins Plugins) *cobra.Command {
+	var (
+		backupName        string
+		backupAnnotations map[string]string
+		showUnchanged     bool
+	)
+
+	c := &cobra.Command{
+		Use:   "simulate-backup DIRECTORY",
+		Short: "Show what the backup item actions would do to a directory of manifests",
+		Long: `Show what the backup item actions would do to a directory of manifests.
+
+Every YAML or JSON manifest under the directory is passed through the backup
+item actions served by this binary, in the order they are registered, honouring
+the resources, namespaces and label selector each action applies to. A diff of
+every changed item is printed along with the additional items and operations the
+actions return. Calls the actions make to Kubernetes go to a fake client and are
+listed instead of reaching a cluster.`,
+		Example: `  velero-plugin-example simulate-backup ./manifests --backup-annotations velero.io/example-bia-operation-duration=1m`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			log := newLogger()
+			actions, err := loadBackupItemActions(log, plugins.BackupItemActions)
+			if err != nil {
+				return err
+			}
+
+			items, err := readManifests(args[0])
+			if err != nil {
+				return err
+			}
+
+			backup := &velerov1api.Backup{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   velerov1api.DefaultNamespace,
+					Name:        backupName,
+					Annotations: backupAnnotations,
+				},
+				Status: velerov1api.BackupStatus{
+					Phase:          velerov1api.BackupPhaseInProgress,
+					StartTimestamp: &metav1.Time{Time: metav1.Now().Time},
+				},
+			}
+			return simulateBackup(c.OutOrStdout(), backup, items, actions, showUnchanged)
+		},
+	}
+
+	c.Flags().StringVar(&backupName, "backup-name", "simulated", "name of the backup passed to the actions")
+	c.Flags().StringToStringVar(&backupAnnotations, "backup-annotations", nil, "annotations of the backup passed to the actions")
+	c.Flags().BoolVar(&showUnchanged, "show-unchanged", false, "also list items no action changed")
+
+	return c
+}
+
+func loadBackupItemActions(log logrus.FieldLogger, plugins []Plugin) ([]namedBackupItemAction, error) {
+	var actions []namedBackupItemAction
+	for _, p := range plugins {
+		client := newFakeClient()
+		instance, err := p.instantiate(log, client)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error instantiating %s", p.Name)
+		}
+
+		a := namedBackupItemAction{name: p.Name, client: client}
+		var selector velero.ResourceSelector
+		switch action := instance.(type) {
+		case backupItemActionV2:
+			selector, err = action.AppliesTo()
+			a.execute = func(item runtime.Unstructured, backup *velerov1api.Backup) (*backupItemActionResult, error) {
+				updated, additional, operationID, toUpdate, err := action.Execute(item, backup)
+				return &backupItemActionResult{updated, additional, operationID, toUpdate}, err
+			}
+		case backupItemActionV1:
+			selector, err = action.AppliesTo()
+			a.execute = func(item runtime.Unstructured, backup *velerov1api.Backup) (*backupItemActionResult, error) {
+				updated, additional, err := action.Execute(item, backup)
+				return &backupItemActionResult{item: updated, additionalItems: additional}, err
+			}
+		default:
+			return nil, errors.Errorf("%s is not a backup item action", p.Name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting the resources %s applies to", p.Name)
+		}
+		if a.selector, err = newSelectorMatcher(selector); err != nil {
+			return nil, errors.Wrap(err, p.Name)
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// manifest is an item read from a file, with the resource it was guessed to be.
+type manifest struct {
+	item *backupItem
+	obj  *unstructured.Unstructured
+}
+
+// readManifests reads every object from the YAML and JSON files under dir. Lists
+// are expanded into their items.
+func readManifests(dir string) ([]manifest, error) {
+	var manifests []manifest
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		decoder := yaml.NewYAMLOrJSONDecoder(file, 4096)
+		for {
+			obj := new(unstructured.Unstructured)
+			if err := decoder.Decode(&obj.Object); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errors.Wrapf(err, "error decoding %s", path)
+			}
+			if len(obj.Object) == 0 {
+				continue
+			}
+
+			objs := []*unstructured.Unstructured{obj}
+			if obj.IsList() {
+				list, err := obj.ToList()
+				if err != nil {
+					return errors.Wrapf(err, "error decoding %s", path)
+				}
+				objs = objs[:0]
+				for i := range list.Items {
+					objs = append(objs, &list.Items[i])
+				}
+			}
+			for _, obj := range objs {
+				manifests = append(manifests, manifest{item: manifestItem(path, obj), obj: obj})
+			}
+		}
+	})
+	return manifests, errors.WithStack(err)
+}
+
+// manifestItem guesses the resource of an object from its kind, the way kubectl
+// does when it can't ask the API server.
+func manifestItem(path string, obj *unstructured.Unstructured) *backupItem {
+	gvr, _ := meta.UnsafeGuessKindToResource(obj.GroupVersionKind())
+	return &backupItem{
+		GroupResource: gvr.GroupResource().String(),
+		Namespace:     obj.GetNamespace(),
+		Name:          obj.GetName(),
+		Path:          path,
+	}
+}
+
+func simulateBackup(out io.Writer, backup *velerov1api.Backup, manifests []manifest, actions []namedBackupItemAction, showUnchanged bool) error {
+	var changed int
+	for _, m := range manifests {
+		name := m.item.GroupResource + " " + qualifiedName(m.item.Namespace, m.item.Name)
+		var obj runtime.Unstructured = m.obj.DeepCopy()
+
+		var notes []string
+		for _, a := range actions {
+			if !a.selector.Matches(m.item, m.obj) {
+				continue
+			}
+			a.client.ClearActions()
+			result, err := a.execute(obj, backup)
+			if err != nil {
+				notes = append(notes, fmt.Sprintf("%s failed: %v", a.name, err))
+				break
+			}
+			notes = append(notes, "applied "+a.name)
+			for _, call := range describeClientActions(a.client.Actions()) {
+				notes = append(notes, fmt.Sprintf("%s would %s", a.name, call))
+			}
+			for _, additional := range result.additionalItems {
+				notes = append(notes, fmt.Sprintf("%s added %s %s", a.name, additional.GroupResource, qualifiedName(additional.Namespace, additional.Name)))
+			}
+			if result.operationID != "" {
+				notes = append(notes, fmt.Sprintf("%s started operation %s", a.name, result.operationID))
+			}
+			for _, update := range result.itemsToUpdate {
+				notes = append(notes, fmt.Sprintf("%s will update %s %s after the operation", a.name, update.GroupResource, qualifiedName(update.Namespace, update.Name)))
+			}
+			if result.item != nil {
+				obj = result.item
+			}
+		}
+
+		diff, err := diffItems(name, m.obj.Object, obj.UnstructuredContent())
+		if err != nil {
+			return err
+		}
+		if diff == "" && len(notes) == 0 && !showUnchanged {
+			continue
+		}
+		if diff != "" {
+			changed++
+		}
+
+		fmt.Fprintf(out, "=== %s (%s)\n", name, m.item.Path)
+		for _, note := range notes {
+			fmt.Fprintf(out, "# %s\n", note)
+		}
+		if diff == "" {
+			diff = "(unchanged)\n"
+		}
+		fmt.Fprintln(out, strings.TrimRight(diff, "\n"))
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintf(out, "%d items, %d changed\n", len(manifests), changed)
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+var testBackupPlugins = Plugins{BackupItemActions: []Plugin{
+	{Name: "example.io/backup-plugin", New: func(log logrus.FieldLogger) (interface{}, error) {
+		return plugin.NewBackupPlugin(log), nil
+	}},
+	{
+		Name: "example.io/backup-pluginv2",
+		New: func(log logrus.FieldLogger) (interface{}, error) {
+			return plugin.NewBackupPluginV2(log), nil
+		},
+		NewWithClient: func(log logrus.FieldLogger, client kubernetes.Interface) (interface{}, error) {
+			return plugin.NewBackupPluginV2WithClient(log, client), nil
+		},
+	},
+}}
+
+const testManifests = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: pod
+    namespace: ns
+    annotations:
+      velero.io/example-bia-additional-update: "true"
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: secret
+    namespace: ns
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deploy
+  namespace: ns
+`
+
+func TestSimulateBackupCommand(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte(testManifests), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cluster"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cluster", "ns.json"), []byte(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"ns"}}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not a manifest"), 0644))
+
+	for name, test := range map[string]struct {
+		args     []string
+		contains []string
+		excludes []string
+	}{
+		"without operations": {
+			contains: []string{
+				"=== pods ns/pod (" + filepath.Join(dir, "app.yaml") + ")\n# applied example.io/backup-plugin\n# applied example.io/backup-pluginv2\n",
+				"+    velero.io/my-backup-pluginv2: \"1\"",
+				// The v2 action doesn't apply to secrets.
+				"=== secrets ns/secret (" + filepath.Join(dir, "app.yaml") + ")\n# applied example.io/backup-plugin\n---",
+				"=== deployments.apps ns/deploy",
+				"=== namespaces ns (" + filepath.Join(dir, "cluster", "ns.json") + ")",
+				"4 items, 4 changed",
+			},
+			excludes: []string{"would create", "started operation"},
+		},
+		"with operations": {
+			args: []string{"--backup-name", "b1", "--backup-annotations", "velero.io/example-bia-operation-duration=1m"},
+			contains: []string{
+				// Calls to the cluster go to the fake client.
+				"# example.io/backup-pluginv2 would create secrets ns/pod-<generated>\n",
+				"# example.io/backup-pluginv2 started operation /1m/ns/pod-",
+				"# example.io/backup-pluginv2 will update secrets ns/pod-",
+				"+    velero.io/example-bia-secret: pod-",
+				"# example.io/backup-pluginv2 started operation /1m\n",
+			},
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			out, err := runCommand(t, NewSimulateBackupCommand(testBackupPlugins), append([]string{dir}, test.args...)...)
+			require.NoError(t, err)
+			for _, s := range test.contains {
+				assert.Contains(t, out, s)
+			}
+			for _, s := range test.excludes {
+				assert.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestSimulateBackupCommandErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("kind: [\n"), 0644))
+	_, err := runCommand(t, NewSimulateBackupCommand(testBackupPlugins), dir)
+	assert.ErrorContains(t, err, "error decoding")
+
+	notAnAction := Plugins{BackupItemActions: []Plugin{{Name: "example.io/restore-plugin", New: func(log logrus.FieldLogger) (interface{}, error) {
+		return plugin.NewRestorePlugin(log), nil
+	}}}}
+	_, err = runCommand(t, NewSimulateBackupCommand(notAnAction), t.TempDir())
+	assert.ErrorContains(t, err, "is not a backup item action")
+}
@@ -0,0 +1,201 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// restoreItemAction is what the simulation needs from both v1 and v2 restore item actions.
+type restoreItemAction interface {
+	AppliesTo() (velero.ResourceSelector, error)
+	Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error)
+}
+
+type namedRestoreItemAction struct {
+	name     string
+	action   restoreItemAction
+	selector *selectorMatcher
+}
+
+// NewSimulateRestoreCommand returns the command that runs the restore item actions
+// over the items of a backup without contacting a cluster.
+func NewSimulateRestoreCommand(plugins Plugins) *cobra.Command {
+	var (
+		store         storeOptions
+		showUnchanged bool
+	)
+
+	c := &cobra.Command{
+		Use:   "simulate-restore BACKUP",
+		Short: "Show what the restore item actions would do to the items of a backup",
+		Long: `Show what the restore item actions would do to the items of a backup.
+
+The backup tarball is read from the file object store and every item is passed
+through the restore item actions served by this binary, in the order they are
+registered, honouring the resources, namespaces and label selector each action
+applies to. A diff of every changed item is printed. No cluster is contacted.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			log := newLogger()
+			actions, err := loadRestoreItemActions(log, plugins.RestoreItemActions)
+			if err != nil {
+				return err
+			}
+
+			backup, err := store.readBackup(args[0])
+			if err != nil {
+				return err
+			}
+
+			file, err := os.Open(store.backupTarball(args[0]))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer file.Close()
+
+			return simulateRestore(c.OutOrStdout(), backup, file, actions, showUnchanged)
+		},
+	}
+
+	store.BindFlags(c.Flags())
+	c.Flags().BoolVar(&showUnchanged, "show-unchanged", false, "also list items no action changed")
+	c.MarkFlagRequired("bucket")
+
+	return c
+}
+
+func loadRestoreItemActions(log logrus.FieldLogger, plugins []Plugin) ([]namedRestoreItemAction, error) {
+	var actions []namedRestoreItemAction
+	for _, p := range plugins {
+		instance, err := p.instantiate(log, newFakeClient())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error instantiating %s", p.Name)
+		}
+		action, ok := instance.(restoreItemAction)
+		if !ok {
+			return nil, errors.Errorf("%s is not a restore item action", p.Name)
+		}
+		selector, err := action.AppliesTo()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting the resources %s applies to", p.Name)
+		}
+		matcher, err := newSelectorMatcher(selector)
+		if err != nil {
+			return nil, errors.Wrap(err, p.Name)
+		}
+		actions = append(actions, namedRestoreItemAction{name: p.Name, action: action, selector: matcher})
+	}
+	return actions, nil
+}
+
+func simulateRestore(out io.Writer, backup *velerov1api.Backup, tarball io.Reader, actions []namedRestoreItemAction, showUnchanged bool) error {
+	restore := &velerov1api.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: backup.Namespace,
+			Name:      backup.Name + "-simulated",
+		},
+		Spec: velerov1api.RestoreSpec{BackupName: backup.Name},
+		Status: velerov1api.RestoreStatus{
+			Phase:          velerov1api.RestorePhaseInProgress,
+			StartTimestamp: &metav1.Time{Time: metav1.Now().Time},
+		},
+	}
+
+	var items, changed, skipped int
+	err := walkBackupItems(tarball, func(item *backupItem) error {
+		items++
+		name := item.GroupResource + " " + qualifiedName(item.Namespace, item.Name)
+
+		fromBackup := new(unstructured.Unstructured)
+		if err := json.Unmarshal(item.Data, &fromBackup.Object); err != nil {
+			return errors.Wrapf(err, "error decoding %s", item.Path)
+		}
+		obj := fromBackup.DeepCopy()
+
+		var notes []string
+		for _, a := range actions {
+			if !a.selector.Matches(item, obj) {
+				continue
+			}
+			output, err := a.action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           obj,
+				ItemFromBackup: fromBackup.DeepCopy(),
+				Restore:        restore,
+			})
+			if err != nil {
+				notes = append(notes, fmt.Sprintf("%s failed: %v", a.name, err))
+				break
+			}
+			notes = append(notes, "applied "+a.name)
+			if output.OperationID != "" {
+				notes = append(notes, fmt.Sprintf("%s started operation %s", a.name, output.OperationID))
+			}
+			if output.SkipRestore {
+				notes = append(notes, a.name+" skipped the item")
+				skipped++
+				break
+			}
+			for _, additional := range output.AdditionalItems {
+				notes = append(notes, fmt.Sprintf("%s added %s %s", a.name, additional.GroupResource, qualifiedName(additional.Namespace, additional.Name)))
+			}
+			if output.UpdatedItem != nil {
+				obj = &unstructured.Unstructured{Object: output.UpdatedItem.UnstructuredContent()}
+			}
+		}
+
+		diff, err := diffItems(name, fromBackup.Object, obj.Object)
+		if err != nil {
+			return err
+		}
+		if diff == "" && !showUnchanged {
+			return nil
+		}
+		if diff != "" {
+			changed++
+		}
+
+		fmt.Fprintf(out, "=== %s\n", name)
+		for _, note := range notes {
+			fmt.Fprintf(out, "# %s\n", note)
+		}
+		if diff == "" {
+			diff = "(unchanged)\n"
+		}
+		fmt.Fprintln(out, strings.TrimRight(diff, "\n"))
+		fmt.Fprintln(out)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%d items, %d changed, %d skipped\n", items, changed, skipped)
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// testRestoreAction labels the items its selector applies to, and skips those
+// named "skip".
+type testRestoreAction struct {
+	selector velero.ResourceSelector
+}
+
+func (a *testRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	return a.selector, nil
+}
+
+func (a *testRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	item := input.Item.(*unstructured.Unstructured)
+	if item.GetName() == "skip" {
+		return velero.NewRestoreItemActionExecuteOutput(item).WithoutRestore(), nil
+	}
+	item.SetLabels(map[string]string{"restored": "true"})
+	return velero.NewRestoreItemActionExecuteOutput(item), nil
+}
+
+func testRestorePlugins(selector velero.ResourceSelector) Plugins {
+	return Plugins{RestoreItemActions: []Plugin{
+		{Name: "example.io/restore-plugin", New: func(log logrus.FieldLogger) (interface{}, error) {
+			return plugin.NewRestorePlugin(log), nil
+		}},
+		{Name: "example.io/test-action", New: func(log logrus.FieldLogger) (interface{}, error) {
+			return &testRestoreAction{selector: selector}, nil
+		}},
+	}}
+}
+
+func TestSimulateRestoreCommand(t *testing.T) {
+	store, opts := newTestStore(t)
+	writeTestBackup(t, store, opts, "b1", map[string]interface{}{
+		"resources/pods/namespaces/ns/pod.json":                testItem("v1", "Pod", "ns", "pod"),
+		"resources/pods/namespaces/ns/skip.json":               testItem("v1", "Pod", "ns", "skip"),
+		"resources/configmaps/namespaces/other/cm.json":        testItem("v1", "ConfigMap", "other", "cm"),
+		"resources/persistentvolumes/cluster/pv.json":          testItem("v1", "PersistentVolume", "", "pv"),
+		"resources/deployments.apps/namespaces/ns/deploy.json": testItem("apps/v1", "Deployment", "ns", "deploy"),
+	})
+
+	for name, test := range map[string]struct {
+		selector velero.ResourceSelector
+		args     []string
+		contains []string
+		excludes []string
+	}{
+		"every item": {
+			contains: []string{
+				"=== pods ns/pod\n# applied example.io/restore-plugin\n# applied example.io/test-action\n",
+				"+    velero.io/my-restore-plugin: \"1\"",
+				"+    restored: \"true\"",
+				"# example.io/test-action skipped the item",
+				"=== persistentvolumes pv\n",
+				"5 items, 5 changed, 1 skipped",
+			},
+		},
+		"resources": {
+			selector: velero.ResourceSelector{IncludedResources: []string{"deployments", "pods"}, ExcludedResources: []string{"pods"}},
+			contains: []string{"=== deployments.apps ns/deploy\n# applied example.io/restore-plugin\n# applied example.io/test-action\n", "5 items, 5 changed, 0 skipped"},
+			excludes: []string{"=== pods ns/pod\n# applied example.io/restore-plugin\n# applied example.io/test-action\n"},
+		},
+		"namespaces": {
+			// Cluster-scoped items are left out by a namespace filter.
+			selector: velero.ResourceSelector{IncludedNamespaces: []string{"other"}},
+			contains: []string{"=== configmaps other/cm\n# applied example.io/restore-plugin\n# applied example.io/test-action\n"},
+			excludes: []string{"=== persistentvolumes pv\n# applied example.io/restore-plugin\n# applied example.io/test-action\n"},
+		},
+		"label selector": {
+			selector: velero.ResourceSelector{LabelSelector: "app=missing"},
+			contains: []string{"5 items, 5 changed, 0 skipped"},
+			excludes: []string{"example.io/test-action"},
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			out, err := runCommand(t, NewSimulateRestoreCommand(testRestorePlugins(test.selector)), "b1", "--root", opts.root, "--bucket", opts.bucket)
+			require.NoError(t, err)
+			for _, s := range test.contains {
+				assert.Contains(t, out, s)
+			}
+			for _, s := range test.excludes {
+				assert.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestSimulateRestoreCommandErrors(t *testing.T) {
+	store, opts := newTestStore(t)
+	writeTestBackup(t, store, opts, "b1", nil)
+
+	_, err := runCommand(t, NewSimulateRestoreCommand(testRestorePlugins(velero.ResourceSelector{})), "b1", "--root", opts.root)
+	assert.ErrorContains(t, err, `"bucket" not set`)
+
+	_, err = runCommand(t, NewSimulateRestoreCommand(testRestorePlugins(velero.ResourceSelector{})), "missing", "--root", opts.root, "--bucket", opts.bucket)
+	assert.Error(t, err)
+
+	notAnAction := Plugins{RestoreItemActions: []Plugin{{Name: "example.io/backup-plugin", New: func(log logrus.FieldLogger) (interface{}, error) {
+		return plugin.NewBackupPlugin(log), nil
+	}}}}
+	_, err = runCommand(t, NewSimulateRestoreCommand(notAnAction), "b1", "--root", opts.root, "--bucket", opts.bucket)
+	assert.ErrorContains(t, err, "is not a restore item action")
+
+	invalid := testRestorePlugins(velero.ResourceSelector{LabelSelector: "a in ("})
+	_, err = runCommand(t, NewSimulateRestoreCommand(invalid), "b1", "--root", opts.root, "--bucket", opts.bucket)
+	assert.ErrorContains(t, err, "error parsing label selector")
+}
@@ -0,0 +1,119 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewSnapshotsCommand returns the command that lists the volumes and snapshots
+// in the catalog of the volume snapshotter.
+func NewSnapshotsCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		tags        map[string]string
+		output      string
+	)
+
+	c := &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the volumes and snapshots in the catalog of the volume snapshotter",
+		Long: `List the volumes and snapshots in the catalog of the volume snapshotter.
+
+The catalog is read from the state directory as the plugin last saved it, and
+isn't changed. Snapshots are listed oldest first with their source
+PersistentVolume, as tagged by Velero, their size and the size they take up,
+their parent if they're incremental, and their tags. Snapshots that aren't
+ready have a phase.
+
+With --tag, only the snapshots with all the given tags are listed, and only the
+volumes they were taken of.`,
+		Example: `  velero-plugin-example snapshots
+  velero-plugin-example snapshots --tag velero.io/backup=nightly-20230321
+  velero-plugin-example snapshots --state-dir /var/lib/velero-plugin-example -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return errors.Errorf("invalid output %q, use table or json", output)
+			}
+			stateDir := snapshotter.stateDir
+			if stateDir == "" {
+				stateDir = plugin.StateDir(snapshotter.config)
+			}
+			catalog, err := plugin.LoadSnapshotCatalog(stateDir)
+			if err != nil {
+				return err
+			}
+			return printCatalogListing(c.OutOrStdout(), catalog.List(tags), output)
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringToStringVar(&tags, "tag", nil, "only list snapshots with this tag, as key=value, may be repeated")
+	c.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	return c
+}
+
+func printCatalogListing(out io.Writer, listing plugin.CatalogListing, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(listing))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tTYPE\tAZ\tIOPS\tSNAPSHOTS\tPHASE")
+	for _, volume := range listing.Volumes {
+		iops := "-"
+		if volume.IOPS != nil {
+			iops = fmt.Sprint(*volume.IOPS)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", volume.VolumeID, volume.Type, orDash(volume.AZ), iops,
+			volume.Snapshots, orDash(volume.Phase))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+
+	w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tSOURCE PV\tVOLUME\tCREATED\tSIZE\tSTORED\tPARENT\tPHASE\tTAGS")
+	for _, snapshot := range listing.Snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", snapshot.SnapshotID, orDash(snapshot.SourcePV), snapshot.VolumeID,
+			snapshot.CreationTimestamp.UTC().Format("2006-01-02 15:04:05"),
+			resource.NewQuantity(snapshot.Size, resource.BinarySI), resource.NewQuantity(snapshot.StoredSize, resource.BinarySI),
+			orDash(snapshot.Parent), orDash(snapshot.Phase), orDash(formatTags(snapshot.Tags)))
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
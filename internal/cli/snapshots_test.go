@@ -0,0 +1,79 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestSnapshotsCommand(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir()}
+	nightly, _ := newTestSnapshot(t, config, map[string]string{"velero.io/backup": "nightly", "velero.io/pv": "pv-1"})
+	weekly, _ := newTestSnapshot(t, config, map[string]string{"velero.io/backup": "weekly"})
+
+	for name, test := range map[string]struct {
+		args      []string
+		snapshots []string
+	}{
+		"all snapshots": {
+			snapshots: []string{nightly, weekly},
+		},
+		"snapshots with a tag": {
+			args:      []string{"--tag", "velero.io/backup=nightly"},
+			snapshots: []string{nightly},
+		},
+		"no matching snapshots": {
+			args: []string{"--tag", "velero.io/backup=monthly"},
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			out, err := runCommand(t, NewSnapshotsCommand(), append(test.args, "--state-dir", config["stateDir"], "-o", "json")...)
+			require.NoError(t, err)
+			var listing plugin.CatalogListing
+			require.NoError(t, json.Unmarshal([]byte(out), &listing))
+			var snapshots []string
+			for _, snapshot := range listing.Snapshots {
+				snapshots = append(snapshots, snapshot.SnapshotID)
+			}
+			assert.ElementsMatch(t, test.snapshots, snapshots)
+			assert.Len(t, listing.Volumes, len(test.snapshots))
+		})
+	}
+
+	out, err := runCommand(t, NewSnapshotsCommand(), "--state-dir", config["stateDir"], "--tag", "velero.io/backup=nightly")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 5)
+	assert.Regexp(t, `^VOLUME\s+TYPE\s+AZ\s+IOPS\s+SNAPSHOTS\s+PHASE$`, lines[0])
+	assert.Regexp(t, `^SNAPSHOT\s+SOURCE PV\s+VOLUME`, lines[3])
+	assert.Regexp(t, `^`+regexp.QuoteMeta(nightly)+`\s+pv-1\s+`, lines[4])
+	assert.Contains(t, lines[4], "velero.io/backup=nightly,velero.io/pv=pv-1")
+}
+
+func TestSnapshotsCommandRejectsInvalidOutput(t *testing.T) {
+	_, err := runCommand(t, NewSnapshotsCommand(), "--state-dir", t.TempDir(), "-o", "yaml")
+	assert.ErrorContains(t, err, `invalid output "yaml"`)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// snapshotterOptions configures the volume snapshotter the way a volume snapshot
+// location does, so that subcommands work on the same state directory and
+// object store as the plugin.
+type snapshotterOptions struct {
+	stateDir string
+	config   map[string]string
+}
+
+func (o *snapshotterOptions) BindFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.stateDir, "state-dir", "", "state directory of the volume snapshotter (defaults to the stateDir of --config, or /tmp/volume-snapshots)")
+	flags.StringToStringVar(&o.config, "config", nil, "config of the volume snapshot location, e.g. objectStore=example.io/object-store-plugin,objectStoreBucket=snapshots")
+}
+
+// newSnapshotter returns an initialized volume snapshotter. Background work the
+// config asks for, async jobs and the retention policy, is left to the plugin.
+func (o *snapshotterOptions) newSnapshotter(log logrus.FieldLogger) (*plugin.NoOpVolumeSnapshotter, error) {
+	config := make(map[string]string)
+	for key, value := range o.config {
+		config[key] = value
+	}
+	if o.stateDir != "" {
+		config["stateDir"] = o.stateDir
+	}
+	delete(config, "async")
+	delete(config, "retention")
+
+	snapshotter := plugin.NewNoOpVolumeSnapshotter(log)
+	if err := snapshotter.Init(config); err != nil {
+		return nil, err
+	}
+	return snapshotter, nil
+}
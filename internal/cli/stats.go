@@ -0,0 +1,95 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewStatsCommand returns the command that reports the size of the dedup
+// repository.
+func NewStatsCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		output      string
+	)
+
+	c := &cobra.Command{
+		Use:   "stats",
+		Short: "Report the logical and physical size of the dedup repository",
+		Long: `Report the logical and physical size of the dedup repository.
+
+The files of the snapshots taken with the dedup key of the volume snapshot
+location config are split into content-defined chunks, which are stored once in
+the state directory however many snapshots contain them. The logical size is the
+size of the files of every snapshot as if nothing was shared, and the physical
+size the size of the chunks stored. Chunks no snapshot references are left behind by snapshots interrupted
+by a restart of the plugin, and are reported separately.`,
+		Example: `  velero-plugin-example stats
+  velero-plugin-example stats --state-dir /var/lib/velero-plugin-example -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return errors.Errorf("invalid output %q, use table or json", output)
+			}
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+			stats, err := s.RepositoryStats()
+			if err != nil {
+				return err
+			}
+			return printRepositoryStats(c.OutOrStdout(), stats, output)
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	return c
+}
+
+func printRepositoryStats(out io.Writer, stats *plugin.RepositoryStats, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(stats))
+	}
+
+	ratio := "-"
+	if stats.PhysicalBytes > 0 {
+		ratio = fmt.Sprintf("%.2f", float64(stats.LogicalBytes)/float64(stats.PhysicalBytes))
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Snapshots:\t%d\n", stats.Snapshots)
+	fmt.Fprintf(w, "Chunks:\t%d\n", stats.Chunks)
+	fmt.Fprintf(w, "Logical size:\t%s\n", resource.NewQuantity(stats.LogicalBytes, resource.BinarySI))
+	fmt.Fprintf(w, "Physical size:\t%s\n", resource.NewQuantity(stats.PhysicalBytes, resource.BinarySI))
+	fmt.Fprintf(w, "Dedup ratio:\t%s\n", ratio)
+	fmt.Fprintf(w, "Unreferenced:\t%d chunks, %s\n", stats.UnreferencedChunks, resource.NewQuantity(stats.UnreferencedBytes, resource.BinarySI))
+	return w.Flush()
+}
@@ -0,0 +1,56 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestStatsCommand(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir(), "dedup": "true"}
+	// Both volumes hold the same files, whose chunks are stored once.
+	newTestSnapshot(t, config, nil)
+	newTestSnapshot(t, config, nil)
+	args := []string{"--config", "dedup=true", "--state-dir", config["stateDir"]}
+
+	out, err := runCommand(t, NewStatsCommand(), append(args, "-o", "json")...)
+	require.NoError(t, err)
+	var stats plugin.RepositoryStats
+	require.NoError(t, json.Unmarshal([]byte(out), &stats))
+	assert.Equal(t, plugin.RepositoryStats{
+		Snapshots:     2,
+		Chunks:        2,
+		LogicalBytes:  2 * int64(len("data")+len("nested data")),
+		PhysicalBytes: int64(len("data") + len("nested data")),
+	}, stats)
+
+	out, err = runCommand(t, NewStatsCommand(), args...)
+	require.NoError(t, err)
+	assert.Contains(t, out, "Snapshots:      2\n")
+	assert.Contains(t, out, "Dedup ratio:    2.00\n")
+}
+
+func TestStatsCommandRejectsInvalidOutput(t *testing.T) {
+	_, err := runCommand(t, NewStatsCommand(), "--state-dir", t.TempDir(), "-o", "yaml")
+	assert.ErrorContains(t, err, `invalid output "yaml"`)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+// NewVerifySnapshotCommand returns the command that checks volume snapshots
+// against their manifest.
+func NewVerifySnapshotCommand() *cobra.Command {
+	var (
+		snapshotter snapshotterOptions
+		all         bool
+		output      string
+	)
+
+	c := &cobra.Command{
+		Use:   "verify-snapshot [SNAPSHOT_ID...]",
+		Short: "Check volume snapshots against their manifest",
+		Long: `Check volume snapshots against their manifest.
+
+Every snapshot is saved with a manifest listing its directories, files and
+symlinks with their size, mode and SHA-256. The data of each snapshot is read
+back, from the state directory or the object store holding it, and compared with
+the manifest. Missing entries, entries that aren't in the manifest and entries
+that differ from it are reported, and the command fails if there are any.
+
+--all checks the snapshots that are ready and have data. Snapshots that are
+being taken, failed or were taken in dry run mode are left out.`,
+		Example: `  velero-plugin-example verify-snapshot --all
+  velero-plugin-example verify-snapshot hostPath:/data.snap.6129484611666145821 -o json`,
+		Args: func(c *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return errors.New("expected snapshot IDs or --all")
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return errors.Errorf("invalid output %q, use table or json", output)
+			}
+			s, err := snapshotter.newSnapshotter(newLogger())
+			if err != nil {
+				return err
+			}
+			if all {
+				args = s.VerifiableSnapshotIDs()
+			}
+
+			var reports []*plugin.VerifyReport
+			problems := 0
+			for _, snapshotID := range args {
+				report, err := s.VerifySnapshot(snapshotID)
+				if err != nil {
+					report = &plugin.VerifyReport{
+						SnapshotID: snapshotID,
+						Findings:   []plugin.VerifyFinding{{Problem: plugin.VerifyUnreadable, Detail: err.Error()}},
+					}
+				}
+				reports = append(reports, report)
+				if len(report.Findings) > 0 {
+					problems++
+				}
+			}
+			if err := printVerifyReports(c.OutOrStdout(), reports, output); err != nil {
+				return err
+			}
+			if problems > 0 {
+				return errors.Errorf("%d of %d snapshots failed verification", problems, len(reports))
+			}
+			return nil
+		},
+	}
+
+	snapshotter.BindFlags(c.Flags())
+	c.Flags().BoolVar(&all, "all", false, "verify every snapshot in the catalog that is ready and has data")
+	c.Flags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+
+	return c
+}
+
+func printVerifyReports(out io.Writer, reports []*plugin.VerifyReport, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(reports))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tPATH\tPROBLEM\tDETAIL")
+	for _, report := range reports {
+		if len(report.Findings) == 0 {
+			fmt.Fprintf(w, "%s\t\tOK\t%d entries match the manifest\n", report.SnapshotID, report.Entries)
+		}
+		for _, finding := range report.Findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", report.SnapshotID, finding.Path, finding.Problem, finding.Detail)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,103 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
+)
+
+func TestVerifySnapshotCommand(t *testing.T) {
+	stateDir := t.TempDir()
+	healthy, _ := newTestSnapshot(t, map[string]string{"stateDir": stateDir}, nil)
+	damaged, _ := newTestSnapshot(t, map[string]string{"stateDir": stateDir}, nil)
+	dryRun, _ := newTestSnapshot(t, map[string]string{"stateDir": stateDir, "dryRun": "true"}, nil)
+	failed, _ := newTestSnapshot(t, map[string]string{"stateDir": stateDir}, nil)
+	_, err := plugin.UpdateSnapshotCatalog(stateDir, func(catalog *plugin.SnapshotCatalog) bool {
+		snapshot := catalog.Snapshots[failed]
+		snapshot.Phase = plugin.PhaseFailed
+		catalog.Snapshots[failed] = snapshot
+		return true
+	})
+	require.NoError(t, err)
+
+	// Damage the copy of the second snapshot in the state directory.
+	path := filepath.Join(stateDir, "snapshots", url.PathEscape(damaged), "sub", "nested")
+	require.NoError(t, os.WriteFile(path, []byte("changed"), 0644))
+
+	for name, test := range map[string]struct {
+		args      []string
+		snapshots []string
+		problems  map[string][]string
+	}{
+		"healthy snapshot": {
+			args:      []string{healthy},
+			snapshots: []string{healthy},
+		},
+		"all leaves out failed and dry run snapshots": {
+			args:      []string{"--all"},
+			snapshots: []string{healthy, damaged},
+			problems:  map[string][]string{damaged: {plugin.VerifyDrift}},
+		},
+		"failed snapshot given by ID": {
+			args:      []string{failed},
+			snapshots: []string{failed},
+			problems:  map[string][]string{failed: {plugin.VerifyUnreadable}},
+		},
+		"dry run snapshot given by ID": {
+			args:      []string{dryRun},
+			snapshots: []string{dryRun},
+			problems:  map[string][]string{dryRun: {plugin.VerifyUnreadable}},
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			out, err := runCommand(t, NewVerifySnapshotCommand(), append(test.args, "--state-dir", stateDir, "-o", "json")...)
+			if len(test.problems) == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+
+			var reports []plugin.VerifyReport
+			require.NoError(t, json.Unmarshal([]byte(out), &reports))
+			var snapshots []string
+			for _, report := range reports {
+				snapshots = append(snapshots, report.SnapshotID)
+				var problems []string
+				for _, finding := range report.Findings {
+					problems = append(problems, finding.Problem)
+				}
+				assert.Equal(t, test.problems[report.SnapshotID], problems, report.SnapshotID)
+			}
+			assert.ElementsMatch(t, test.snapshots, snapshots)
+		})
+	}
+}
+
+func TestVerifySnapshotCommandNeedsSnapshots(t *testing.T) {
+	_, err := runCommand(t, NewVerifySnapshotCommand(), "--state-dir", t.TempDir())
+	assert.ErrorContains(t, err, "expected snapshot IDs or --all")
+}
@@ -0,0 +1,432 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package objectstoretest implements a conformance suite for Velero ObjectStore
+// plugins. It pins down the semantics Velero relies on, so that any implementation
+// can be checked against them:
+//
+//	func TestConformance(t *testing.T) {
+//		objectstoretest.Run(t, objectstoretest.Options{
+//			New: func(t *testing.T) (velero.ObjectStore, map[string]string) {
+//				return NewMyObjectStore(...), map[string]string{"bucket": "my-bucket"}
+//			},
+//		})
+//	}
+package objectstoretest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// Options describes the object store under test.
+type Options struct {
+	// New returns an object store that hasn't been initialized yet, along with
+	// the config to initialize it with. The bucket named in the config, with the
+	// optional prefix, must be empty. New is called once per test.
+	New func(t *testing.T) (velero.ObjectStore, map[string]string)
+
+	// LargeObjectSize is the size of the object used to check that large objects
+	// are streamed intact. It defaults to 64MiB; the check is skipped in short mode.
+	LargeObjectSize int64
+
+	// Concurrency is how many goroutines write at the same time in the
+	// concurrency tests. It defaults to 16.
+	Concurrency int
+}
+
+// Run runs the conformance suite as subtests of t.
+func Run(t *testing.T, opts Options) {
+	if opts.LargeObjectSize == 0 {
+		opts.LargeObjectSize = 64 << 20
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 16
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s *suite)
+	}{
+		{"InitIsIdempotent", testInitIsIdempotent},
+		{"PutGetRoundTrip", testPutGetRoundTrip},
+		{"GetMissingObject", testGetMissingObject},
+		{"Overwrite", testOverwrite},
+		{"ObjectExists", testObjectExists},
+		{"ListObjects", testListObjects},
+		{"ListObjectsMissingPrefix", testListObjectsMissingPrefix},
+		{"ListCommonPrefixes", testListCommonPrefixes},
+		{"ListCommonPrefixesEdgeCases", testListCommonPrefixesEdgeCases},
+		{"Delete", testDelete},
+		{"DeleteCleansUp", testDeleteCleansUp},
+		{"SignedURL", testSignedURL},
+		{"ConcurrentPuts", testConcurrentPuts},
+		{"ConcurrentPutsToSameKey", testConcurrentPutsToSameKey},
+		{"LargeObject", testLargeObject},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store, config := opts.New(t)
+			require.NoError(t, store.Init(config), "Init")
+			tc.test(t, &suite{
+				opts:   opts,
+				store:  store,
+				config: config,
+				bucket: config["bucket"],
+				prefix: config["prefix"],
+			})
+		})
+	}
+}
+
+type suite struct {
+	opts   Options
+	store  velero.ObjectStore
+	config map[string]string
+	bucket string
+	prefix string
+}
+
+// key returns a key under the configured prefix, the way Velero builds them.
+func (s *suite) key(elems ...string) string {
+	if s.prefix == "" {
+		return path.Join(elems...)
+	}
+	return path.Join(append([]string{s.prefix}, elems...)...)
+}
+
+// keyPrefix is like key, but keeps a trailing slash.
+func (s *suite) keyPrefix(elems ...string) string {
+	return s.key(elems...) + "/"
+}
+
+func (s *suite) put(t *testing.T, key, body string) {
+	t.Helper()
+	require.NoError(t, s.store.PutObject(s.bucket, key, bytes.NewBufferString(body)), "PutObject %s", key)
+}
+
+func (s *suite) get(t *testing.T, key string) string {
+	t.Helper()
+	rc, err := s.store.GetObject(s.bucket, key)
+	require.NoError(t, err, "GetObject %s", key)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err, "reading %s", key)
+	return string(data)
+}
+
+func (s *suite) exists(t *testing.T, key string) bool {
+	t.Helper()
+	exists, err := s.store.ObjectExists(s.bucket, key)
+	require.NoError(t, err, "ObjectExists %s", key)
+	return exists
+}
+
+func (s *suite) listObjects(t *testing.T, prefix string) []string {
+	t.Helper()
+	keys, err := s.store.ListObjects(s.bucket, prefix)
+	require.NoError(t, err, "ListObjects %s", prefix)
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *suite) listCommonPrefixes(t *testing.T, prefix, delimiter string) []string {
+	t.Helper()
+	prefixes, err := s.store.ListCommonPrefixes(s.bucket, prefix, delimiter)
+	require.NoError(t, err, "ListCommonPrefixes %s %s", prefix, delimiter)
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+func testInitIsIdempotent(t *testing.T, s *suite) {
+	s.put(t, s.key("backups", "a", "velero-backup.json"), "a")
+
+	require.NoError(t, s.store.Init(s.config), "second Init")
+	require.NoError(t, s.store.Init(s.config), "third Init")
+
+	assert.Equal(t, "a", s.get(t, s.key("backups", "a", "velero-backup.json")), "objects must survive Init")
+}
+
+func testPutGetRoundTrip(t *testing.T, s *suite) {
+	bodies := map[string]string{
+		s.key("top-level"):                                        "top",
+		s.key("backups", "b", "b.tar.gz"):                         "tarball",
+		s.key("backups", "b", "deeply", "nested", "object.json"):  "nested",
+		s.key("backups", "b", "empty"):                            "",
+		s.key("backups", "b", "name with spaces and-dashes.json"): "spaces",
+	}
+	for key, body := range bodies {
+		s.put(t, key, body)
+	}
+	for key, body := range bodies {
+		assert.Equal(t, body, s.get(t, key), key)
+	}
+}
+
+func testGetMissingObject(t *testing.T, s *suite) {
+	_, err := s.store.GetObject(s.bucket, s.key("backups", "missing", "velero-backup.json"))
+	assert.Error(t, err, "missing object")
+
+	// A prefix of existing keys isn't an object.
+	s.put(t, s.key("backups", "c", "velero-backup.json"), "c")
+	_, err = s.store.GetObject(s.bucket, s.key("backups", "c"))
+	assert.Error(t, err, "prefix of an object")
+}
+
+func testOverwrite(t *testing.T, s *suite) {
+	key := s.key("backups", "d", "velero-backup.json")
+	s.put(t, key, "a much longer first version")
+	s.put(t, key, "second")
+	assert.Equal(t, "second", s.get(t, key), "an overwrite must replace the whole object")
+	assert.Equal(t, []string{key}, s.listObjects(t, s.keyPrefix("backups", "d")))
+}
+
+func testObjectExists(t *testing.T, s *suite) {
+	key := s.key("backups", "e", "velero-backup.json")
+	assert.False(t, s.exists(t, key), "before PutObject")
+
+	s.put(t, key, "e")
+	assert.True(t, s.exists(t, key), "after PutObject")
+	assert.False(t, s.exists(t, s.key("backups", "e")), "a prefix of an object isn't an object")
+	assert.False(t, s.exists(t, s.key("backups", "e", "velero-backup")), "a partial key isn't an object")
+
+	require.NoError(t, s.store.DeleteObject(s.bucket, key))
+	assert.False(t, s.exists(t, key), "after DeleteObject")
+}
+
+func testListObjects(t *testing.T, s *suite) {
+	keys := []string{
+		s.key("backups", "f-1", "f-1.tar.gz"),
+		s.key("backups", "f-1", "nested", "object"),
+		s.key("backups", "f-1", "velero-backup.json"),
+		s.key("backups", "f-2", "velero-backup.json"),
+		s.key("restores", "f-1", "restore-f-1-logs.gz"),
+	}
+	for _, key := range keys {
+		s.put(t, key, key)
+	}
+
+	assert.Equal(t, keys[:3], s.listObjects(t, s.keyPrefix("backups", "f-1")), "objects are listed recursively, with full keys")
+	assert.Equal(t, keys[:4], s.listObjects(t, s.keyPrefix("backups")))
+	assert.Equal(t, keys[:4], s.listObjects(t, s.key("backups", "f-")), "prefixes are matched as strings, not directories")
+	assert.Equal(t, keys[3:4], s.listObjects(t, s.key("backups", "f-2", "velero")))
+	assert.Equal(t, keys[4:], s.listObjects(t, s.key("restores")))
+
+	all := s.listObjects(t, s.prefix)
+	assert.Equal(t, keys, all, "listing the whole prefix")
+}
+
+func testListObjectsMissingPrefix(t *testing.T, s *suite) {
+	assert.Empty(t, s.listObjects(t, s.keyPrefix("backups", "missing")))
+	assert.Empty(t, s.listObjects(t, s.keyPrefix("never-written")))
+}
+
+func testListCommonPrefixes(t *testing.T, s *suite) {
+	// The example from the ObjectStore documentation.
+	for _, key := range []string{
+		s.key("a-prefix", "foo-1", "bar"),
+		s.key("a-prefix", "foo-1", "baz"),
+		s.key("a-prefix", "foo-2", "baz"),
+		s.key("some-other-prefix", "foo-3", "bar"),
+	} {
+		s.put(t, key, key)
+	}
+
+	assert.Equal(t,
+		[]string{s.keyPrefix("a-prefix", "foo-1"), s.keyPrefix("a-prefix", "foo-2")},
+		s.listCommonPrefixes(t, s.keyPrefix("a-prefix"), "/"),
+		"full prefixes, each once, ending with the delimiter")
+}
+
+func testListCommonPrefixesEdgeCases(t *testing.T, s *suite) {
+	for _, key := range []string{
+		s.key("backups", "g-1", "velero-backup.json"),
+		s.key("backups", "g-1", "nested", "object"),
+		s.key("backups", "g-2", "velero-backup.json"),
+		s.key("backups", "h-1", "velero-backup.json"),
+		s.key("backups", "object-directly-under-prefix"),
+	} {
+		s.put(t, key, key)
+	}
+
+	assert.Equal(t,
+		[]string{s.keyPrefix("backups", "g-1"), s.keyPrefix("backups", "g-2"), s.keyPrefix("backups", "h-1")},
+		s.listCommonPrefixes(t, s.keyPrefix("backups"), "/"),
+		"objects directly under the prefix aren't prefixes")
+	assert.Equal(t,
+		[]string{s.keyPrefix("backups", "g-1"), s.keyPrefix("backups", "g-2")},
+		s.listCommonPrefixes(t, s.key("backups", "g-"), "/"),
+		"prefixes are matched as strings, not directories")
+	assert.Equal(t,
+		[]string{s.keyPrefix("backups")},
+		s.listCommonPrefixes(t, s.prefixWithSlash(), "/"),
+		"the top level of the prefix")
+	assert.Equal(t,
+		[]string{s.key("backups", "g-"), s.key("backups", "h-"), s.key("backups", "object-")},
+		s.listCommonPrefixes(t, s.keyPrefix("backups"), "-"),
+		"delimiters other than a slash")
+	assert.Empty(t, s.listCommonPrefixes(t, s.keyPrefix("backups", "missing"), "/"), "missing prefix")
+	assert.Empty(t, s.listCommonPrefixes(t, s.keyPrefix("backups", "g-2"), "/"), "prefix with only objects")
+}
+
+// prefixWithSlash returns the configured prefix as Velero passes it to list the
+// top level of a backup storage location: empty, or ending with a slash.
+func (s *suite) prefixWithSlash() string {
+	if s.prefix == "" {
+		return ""
+	}
+	return s.prefix + "/"
+}
+
+func testDelete(t *testing.T, s *suite) {
+	keep := s.key("backups", "i", "velero-backup.json")
+	remove := s.key("backups", "i", "i.tar.gz")
+	s.put(t, keep, "keep")
+	s.put(t, remove, "remove")
+
+	require.NoError(t, s.store.DeleteObject(s.bucket, remove))
+
+	_, err := s.store.GetObject(s.bucket, remove)
+	assert.Error(t, err, "GetObject after DeleteObject")
+	assert.Equal(t, []string{keep}, s.listObjects(t, s.keyPrefix("backups", "i")))
+	assert.Equal(t, "keep", s.get(t, keep), "other objects are untouched")
+}
+
+func testDeleteCleansUp(t *testing.T, s *suite) {
+	keys := []string{
+		s.key("backups", "j", "velero-backup.json"),
+		s.key("backups", "j", "nested", "deeper", "object"),
+	}
+	for _, key := range keys {
+		s.put(t, key, key)
+	}
+	s.put(t, s.key("backups", "k", "velero-backup.json"), "k")
+
+	for _, key := range keys {
+		require.NoError(t, s.store.DeleteObject(s.bucket, key))
+	}
+
+	assert.Empty(t, s.listObjects(t, s.keyPrefix("backups", "j")))
+	assert.Equal(t, []string{s.keyPrefix("backups", "k")}, s.listCommonPrefixes(t, s.keyPrefix("backups"), "/"),
+		"a prefix without objects must not be listed once they're deleted")
+
+	// The store must still be usable, e.g. after the last backup was deleted.
+	s.put(t, keys[0], "again")
+	assert.Equal(t, "again", s.get(t, keys[0]))
+}
+
+func testSignedURL(t *testing.T, s *suite) {
+	key := s.key("backups", "l", "l-logs.gz")
+	s.put(t, key, "logs")
+
+	signed, err := s.store.CreateSignedURL(s.bucket, key, time.Minute)
+	if err != nil {
+		assert.Empty(t, signed, "no URL may be returned with an error")
+		t.Logf("signed URLs aren't supported: %v", err)
+		return
+	}
+	require.NotEmpty(t, signed, "a URL must be returned without an error")
+	_, err = url.Parse(signed)
+	assert.NoError(t, err, "the signed URL must be a URL")
+}
+
+func testConcurrentPuts(t *testing.T, s *suite) {
+	var wg sync.WaitGroup
+	errs := make(chan error, s.opts.Concurrency)
+	for i := 0; i < s.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := s.key("backups", fmt.Sprintf("m-%02d", i), "velero-backup.json")
+			errs <- s.store.PutObject(s.bucket, key, bytes.NewBufferString(key))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	keys := s.listObjects(t, s.keyPrefix("backups"))
+	require.Len(t, keys, s.opts.Concurrency)
+	for _, key := range keys {
+		assert.Equal(t, key, s.get(t, key))
+	}
+}
+
+func testConcurrentPutsToSameKey(t *testing.T, s *suite) {
+	key := s.key("backups", "n", "n.tar.gz")
+	bodies := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, s.opts.Concurrency)
+	for i := 0; i < s.opts.Concurrency; i++ {
+		// Bodies of different lengths make torn writes show.
+		body := bytes.Repeat([]byte{byte('a' + i%26)}, 64<<10*(i+1))
+		bodies[string(body)] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.store.PutObject(s.bucket, key, bytes.NewReader(body))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	assert.True(t, bodies[s.get(t, key)], "the object must be exactly one of the bodies written")
+	assert.Equal(t, []string{key}, s.listObjects(t, s.keyPrefix("backups", "n")), "no partial objects may be left behind")
+}
+
+func testLargeObject(t *testing.T, s *suite) {
+	if testing.Short() {
+		t.Skip("skipping large object in short mode")
+	}
+
+	key := s.key("backups", "o", "o.tar.gz")
+	want := sha256.New()
+	body := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), s.opts.LargeObjectSize), want)
+	require.NoError(t, s.store.PutObject(s.bucket, key, body))
+
+	rc, err := s.store.GetObject(s.bucket, key)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got := sha256.New()
+	n, err := io.Copy(got, rc)
+	require.NoError(t, err)
+	assert.Equal(t, s.opts.LargeObjectSize, n, "size")
+	assert.Equal(t, want.Sum(nil), got.Sum(nil), "content")
+}
@@ -57,12 +57,29 @@ const (
 
 // BackupPluginV2 is a v2 backup item action plugin for Velero.
 type BackupPluginV2 struct {
-	log logrus.FieldLogger
+	log       logrus.FieldLogger
+	getClient func() (kubernetes.Interface, error)
 }
 
 // NewBackupPluginV2 instantiates a v2 BackupPlugin.
 func NewBackupPluginV2(log logrus.FieldLogger) *BackupPluginV2 {
-	return &BackupPluginV2{log: log}
+	return &BackupPluginV2{
+		log: log,
+		getClient: func() (kubernetes.Interface, error) {
+			return GetClient()
+		},
+	}
+}
+
+// NewBackupPluginV2WithClient instantiates a v2 BackupPlugin that talks to the
+// cluster through the given client instead of one loaded from the kubeconfig.
+func NewBackupPluginV2WithClient(log logrus.FieldLogger, client kubernetes.Interface) *BackupPluginV2 {
+	return &BackupPluginV2{
+		log: log,
+		getClient: func() (kubernetes.Interface, error) {
+			return client, nil
+		},
+	}
 }
 
 // Name is required to implement the interface, but the Velero pod does not delegate this
@@ -162,7 +179,7 @@ func (p *BackupPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (
 				"TestObject": []byte(metadata.GetName()),
 			},
 		}
-		secretClient, err := GetClient()
+		secretClient, err := p.getClient()
 		if err != nil {
 			return item, nil, "", nil, errors.Wrap(err, "error getting secret client")
 		}
@@ -195,7 +212,7 @@ func (p *BackupPluginV2) Progress(operationID string, backup *v1.Backup) (velero
 	}
 	splitOp := strings.Split(operationID, "/")
 	if len(splitOp) == 4 {
-		secretClient, err := GetClient()
+		secretClient, err := p.getClient()
 		if err != nil {
 			return progress, errors.Wrap(err, "error getting secret client")
 		}
@@ -0,0 +1,168 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// copyMetadata applies the ownership, extended attributes, mode and times of src
+// to dst, without following symlinks. Ownership and attributes that we aren't
+// allowed to set, e.g. when not running as root, are skipped with a debug message.
+func copyMetadata(log logrus.FieldLogger, src, dst string, info fs.FileInfo) error {
+	log = log.WithField("path", dst)
+
+	// Ownership goes first, as changing it clears the setuid and setgid bits.
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			if !os.IsPermission(err) {
+				return err
+			}
+			log.WithError(err).Debug("Unable to preserve ownership")
+		}
+	}
+
+	if err := copyXattrs(src, dst); err != nil {
+		log.WithError(err).Debug("Unable to preserve extended attributes")
+	}
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		if err := os.Chmod(dst, info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		times := []unix.Timespec{
+			unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+			unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "utimes", Path: dst, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func copyXattrs(src, dst string) error {
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return err
+	}
+	return setXattrs(dst, xattrs)
+}
+
+// readXattrs returns the extended attributes of a file, without following symlinks.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func setXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTarMetadata applies the ownership, extended attributes, mode and times
+// recorded in a tar header to dst, like copyMetadata does for a source file.
+func applyTarMetadata(log logrus.FieldLogger, dst string, hdr *tar.Header) error {
+	log = log.WithField("path", dst)
+
+	if err := os.Lchown(dst, hdr.Uid, hdr.Gid); err != nil {
+		if !os.IsPermission(err) {
+			return err
+		}
+		log.WithError(err).Debug("Unable to preserve ownership")
+	}
+
+	xattrs := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPAXPrefix) {
+			xattrs[strings.TrimPrefix(key, xattrPAXPrefix)] = []byte(value)
+		}
+	}
+	if err := setXattrs(dst, xattrs); err != nil {
+		log.WithError(err).Debug("Unable to preserve extended attributes")
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(dst, hdr.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: dst, Err: err}
+	}
+
+	return nil
+}
+
+// sameFileMetadata reports whether two regular files look the same without
+// reading them: same size, modification time, mode and ownership.
+func sameFileMetadata(a, b fs.FileInfo) bool {
+	if a.Size() != b.Size() || a.Mode() != b.Mode() || !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	statA, okA := a.Sys().(*syscall.Stat_t)
+	statB, okB := b.Sys().(*syscall.Stat_t)
+	return okA && okB && statA.Uid == statB.Uid && statA.Gid == statB.Gid
+}
@@ -0,0 +1,95 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// TestVolumeSnapshotterPreservesMetadata checks that the mode, times, extended
+// attributes and, when running as root, ownership of files survive a snapshot
+// and a restore, whichever store the snapshot is kept in.
+func TestVolumeSnapshotterPreservesMetadata(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+
+	for name, config := range map[string]map[string]string{
+		"local":        {},
+		"incremental":  {"incremental": "true"},
+		"dedup":        {"dedup": "true"},
+		"object store": {"objectStore": testObjectStore, "objectStoreBucket": "snapshots"},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config["stateDir"] = t.TempDir()
+			dir := t.TempDir()
+			file := filepath.Join(dir, "data", "file")
+			require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+			require.NoError(t, os.WriteFile(file, []byte("data"), 0644))
+			require.NoError(t, os.Chmod(file, 0640|os.ModeSetgid))
+			require.NoError(t, os.Chmod(filepath.Dir(file), 0710))
+			xattrs := unix.Lsetxattr(file, "user.example", []byte("value"), 0) == nil
+			owned := os.Geteuid() == 0
+			if owned {
+				require.NoError(t, os.Lchown(file, 1234, 5678))
+			}
+			modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			require.NoError(t, os.Chtimes(file, modTime, modTime))
+
+			p := newTestSnapshotter(t, config)
+			snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+			require.NoError(t, err)
+			volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+			require.NoError(t, err)
+			restored := filepath.Join(testVolumeDir(t, p, volumeID), "data", "file")
+
+			info, err := os.Lstat(restored)
+			require.NoError(t, err)
+			assert.Equal(t, 0640|os.ModeSetgid, info.Mode())
+			assert.True(t, modTime.Equal(info.ModTime()), "modification time %v", info.ModTime())
+			dirInfo, err := os.Lstat(filepath.Dir(restored))
+			require.NoError(t, err)
+			assert.Equal(t, 0710|os.ModeDir, dirInfo.Mode())
+
+			if xattrs {
+				value, err := readXattrs(restored)
+				require.NoError(t, err)
+				assert.Equal(t, []byte("value"), value["user.example"])
+			} else {
+				t.Log("The filesystem doesn't support extended attributes")
+			}
+			if owned {
+				stat := info.Sys().(*syscall.Stat_t)
+				assert.EqualValues(t, 1234, stat.Uid)
+				assert.EqualValues(t, 5678, stat.Gid)
+			} else {
+				t.Log("Ownership is only preserved when running as root")
+			}
+		})
+	}
+}
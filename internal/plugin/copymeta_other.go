@@ -0,0 +1,62 @@
+//go:build !linux
+
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// copyMetadata applies the mode and modification time of src to dst. Ownership and
+// extended attributes are only preserved on Linux, where the plugin is deployed.
+func copyMetadata(log logrus.FieldLogger, src, dst string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// readXattrs returns no extended attributes, they're only preserved on Linux.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// applyTarMetadata applies the mode and modification time recorded in a tar
+// header to dst.
+func applyTarMetadata(log logrus.FieldLogger, dst string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(dst, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+}
+
+// sameFileMetadata reports whether two regular files look the same without
+// reading them: same size, modification time and mode.
+func sameFileMetadata(a, b fs.FileInfo) bool {
+	return a.Size() == b.Size() && a.Mode() == b.Mode() && a.ModTime().Equal(b.ModTime())
+}
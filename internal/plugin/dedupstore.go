@@ -0,0 +1,568 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// defaultDedupChunkSize is the average size of the chunks of the dedup
+// repository.
+const defaultDedupChunkSize = 1 << 20
+
+// gearTable drives the rolling hash that finds chunk boundaries. It's derived
+// from fixed inputs, as changing it would move every boundary and stop new
+// snapshots from sharing chunks with older ones.
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("velero-plugin-example gear %d", i)))
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks: boundaries are placed
+// where the rolling hash of the last bytes matches a mask, so that they follow
+// the content rather than offsets, and identical content is split into the
+// same chunks wherever it appears in a stream. The hash shifts left with every
+// byte, so bit i only depends on the last i+1 bytes: as with FastCDC, the mask
+// covers the high bits, which depend on the last 64.
+type chunker struct {
+	r        *bufio.Reader
+	min, max int
+	mask     uint64
+	buf      []byte
+}
+
+// newChunker returns a chunker whose chunks average about size bytes, and are
+// between a quarter of that and four times as large.
+func newChunker(r io.Reader, size int) *chunker {
+	bits := 0
+	for 1<<(bits+1) <= size {
+		bits++
+	}
+	return &chunker{
+		r:    bufio.NewReaderSize(r, 1<<16),
+		min:  size / 4,
+		max:  size * 4,
+		mask: (1<<bits - 1) << (64 - bits),
+		buf:  make([]byte, 0, size*4),
+	}
+}
+
+// reset makes the chunker split r, so that its buffers are reused.
+func (c *chunker) reset(r io.Reader) {
+	c.r.Reset(r)
+}
+
+// Next returns the next chunk, which is only valid until the next call, or
+// io.EOF at the end of the stream.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.max || (len(c.buf) >= c.min && hash&c.mask == 0) {
+			return c.buf, nil
+		}
+	}
+}
+
+// dedupChunk is a chunk of the content of a file.
+type dedupChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// dedupEntry is an entry of the tree of a snapshot: its tar header, with its
+// name and metadata, and the chunks of its content if it's a regular file.
+type dedupEntry struct {
+	Header *tar.Header  `json:"header"`
+	Chunks []dedupChunk `json:"chunks,omitempty"`
+}
+
+// dedupIndex lists the entries of the tree of a snapshot, in the order of its
+// tar stream. Writing it is what makes a snapshot part of the repository.
+type dedupIndex struct {
+	Entries  []dedupEntry      `json:"entries"`
+	Manifest *SnapshotManifest `json:"manifest"`
+}
+
+// chunks returns the chunks the index references, in order.
+func (index *dedupIndex) chunks() []dedupChunk {
+	var chunks []dedupChunk
+	for _, entry := range index.Entries {
+		chunks = append(chunks, entry.Chunks...)
+	}
+	return chunks
+}
+
+// dedupLockFile is the lock of a dedup repository.
+const dedupLockFile = "repository.lock"
+
+// dedupSnapshotStore keeps snapshots in a repository in the state directory.
+// The content of each file is split into content-defined chunks stored by their
+// SHA-256, and the tree of the volume with its metadata is kept in the index of
+// the snapshot, so that names, times and owners don't keep files from sharing
+// chunks. Chunks are shared by all the snapshots that contain them, whatever
+// their volume, and only removed once no snapshot references them.
+//
+// Several plugin processes may share the repository, so references aren't
+// counted in memory. Snapshots are saved under a shared lock of the repository,
+// and chunks are only removed under the exclusive lock, once the indexes on disk
+// show that no snapshot references them anymore.
+type dedupSnapshotStore struct {
+	log logrus.FieldLogger
+	dir string
+
+	mu        sync.Mutex
+	chunkSize int
+}
+
+// newDedupSnapshotStore opens the repository in dir.
+func newDedupSnapshotStore(log logrus.FieldLogger, dir string) *dedupSnapshotStore {
+	return &dedupSnapshotStore{log: log, dir: dir, chunkSize: defaultDedupChunkSize}
+}
+
+// setChunkSize sets the average size of the chunks of new snapshots.
+func (s *dedupSnapshotStore) setChunkSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunkSize = size
+}
+
+func (s *dedupSnapshotStore) indexPath(snapshotID string) string {
+	return filepath.Join(s.dir, "snapshots", escapeName(snapshotID)+".json")
+}
+
+func (s *dedupSnapshotStore) chunkPath(hash string) string {
+	return filepath.Join(s.dir, "chunks", hash[:2], hash)
+}
+
+// lock takes the lock of the repository, which is shared by the snapshots being
+// saved and exclusive to remove chunks. It's released by closing the file.
+func (s *dedupSnapshotStore) lock(exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lock, err := lockFile(filepath.Join(s.dir, dedupLockFile), exclusive)
+	return lock, errors.Wrapf(err, "error locking the repository %s", s.dir)
+}
+
+// countRefs counts the references to chunks from the indexes of the snapshots of
+// the repository, by hash, and calls each, if set, with every index.
+func (s *dedupSnapshotStore) countRefs(each func(*dedupIndex)) (map[string]int, error) {
+	refs := make(map[string]int)
+	entries, err := os.ReadDir(filepath.Join(s.dir, "snapshots"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		index, err := readDedupIndex(filepath.Join(s.dir, "snapshots", entry.Name()))
+		if os.IsNotExist(errors.Cause(err)) {
+			// The snapshot was deleted since.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range index.chunks() {
+			refs[chunk.Hash]++
+		}
+		if each != nil {
+			each(index)
+		}
+	}
+	return refs, nil
+}
+
+// sweep removes those of chunks that no snapshot references anymore. The
+// references are counted from the indexes under the exclusive lock of the
+// repository, so that chunks referenced by the snapshots other processes save
+// or keep aren't removed. Nothing is removed if they can't be counted.
+func (s *dedupSnapshotStore) sweep(chunks []dedupChunk) error {
+	lock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	refs, err := s.countRefs(nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to count the references to chunks, none were removed")
+	}
+	var errs []string
+	for _, chunk := range chunks {
+		if refs[chunk.Hash] > 0 {
+			continue
+		}
+		if err := os.Remove(s.chunkPath(chunk.Hash)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("error removing chunks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// storeChunk writes a chunk if the repository doesn't have it yet. It returns
+// the number of bytes written. Callers hold the lock of the repository, so that
+// the chunk isn't removed before the index referencing it is written.
+func (s *dedupSnapshotStore) storeChunk(hash string, data []byte, job *copyJob) (int64, error) {
+	path := s.chunkPath(hash)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return 0, nil
+	}
+	job.writing(len(data))
+	if err := writeFileAtomic(path, data); err != nil {
+		return 0, errors.Wrapf(err, "error writing chunk %s", hash)
+	}
+	return int64(len(data)), nil
+}
+
+// storeContent splits the content of a file into chunks with c, and stores
+// them. It returns the chunks and the number of bytes written, including those
+// stored before an error.
+func (s *dedupSnapshotStore) storeContent(c *chunker, r io.Reader, job *copyJob) ([]dedupChunk, int64, error) {
+	c.reset(r)
+	var chunks []dedupChunk
+	var stored int64
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			return chunks, stored, nil
+		}
+		if err != nil {
+			return chunks, stored, err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		written, err := s.storeChunk(hash, data, job)
+		if err != nil {
+			return chunks, stored, err
+		}
+		chunks = append(chunks, dedupChunk{Hash: hash, Size: int64(len(data))})
+		stored += written
+	}
+}
+
+// Save archives the volume, keeping the headers of its entries in the index and
+// splitting the content of every file into chunks. Chunks the repository
+// already has are only referenced, so StoredSize is the size of the new chunks.
+func (s *dedupSnapshotStore) Save(snapshotID, src string, snapshot *Snapshot, job *copyJob) (copyStats, error) {
+	s.mu.Lock()
+	chunkSize := s.chunkSize
+	s.mu.Unlock()
+	lock, err := s.lock(false)
+	if err != nil {
+		return copyStats{}, err
+	}
+
+	pr, pw := io.Pipe()
+	manifest := &SnapshotManifest{}
+	type result struct {
+		stats copyStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := writeTarTree(s.log, src, pw, manifest, job)
+		pw.CloseWithError(err)
+		done <- result{stats, err}
+	}()
+
+	index := dedupIndex{Manifest: manifest}
+	var stored int64
+	c := newChunker(nil, chunkSize)
+	tr := tar.NewReader(pr)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err != nil {
+			break
+		}
+		entry := dedupEntry{Header: hdr}
+		if hdr.Typeflag == tar.TypeReg {
+			var written int64
+			entry.Chunks, written, err = s.storeContent(c, tr, job)
+			stored += written
+		}
+		index.Entries = append(index.Entries, entry)
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		// Drain the end of the archive, so that writing it doesn't fail.
+		_, err = io.Copy(io.Discard, pr)
+	}
+	pr.CloseWithError(err)
+	res := <-done
+	if err == nil {
+		err = res.err
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(index); err == nil {
+			err = writeFileAtomic(s.indexPath(snapshotID), data)
+		}
+	}
+	// The chunks of a failed snapshot are swept under the exclusive lock, which
+	// waits for this one.
+	lock.Close()
+	if err != nil {
+		if sweepErr := s.sweep(index.chunks()); sweepErr != nil {
+			s.log.WithError(sweepErr).Warn("Unable to clean up after failed snapshot")
+		}
+		return res.stats, errors.Wrapf(err, "error storing snapshot %s", snapshotID)
+	}
+
+	snapshot.Dedup = true
+	snapshot.CopyStrategy = strategyStream
+	snapshot.Size = res.stats.Bytes
+	snapshot.StoredSize = stored
+	return res.stats, nil
+}
+
+func readDedupIndex(path string) (*dedupIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	index := new(dedupIndex)
+	return index, errors.Wrapf(json.Unmarshal(data, index), "error decoding %s", path)
+}
+
+func (s *dedupSnapshotStore) Restore(snapshotID string, snapshot Snapshot, dst string) error {
+	index, err := readDedupIndex(s.indexPath(snapshotID))
+	if err != nil {
+		return err
+	}
+	return createTreeAtomic(dst, func(partial string) error {
+		r := s.newReader(index)
+		defer r.Close()
+		return errors.Wrapf(extractTarTree(s.log, r, partial, nil), "error restoring snapshot %s", snapshotID)
+	})
+}
+
+func (s *dedupSnapshotStore) Open(snapshotID string, snapshot Snapshot) (io.ReadCloser, error) {
+	index, err := readDedupIndex(s.indexPath(snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	return s.newReader(index), nil
+}
+
+func (s *dedupSnapshotStore) Manifest(snapshotID string, snapshot Snapshot) (*SnapshotManifest, error) {
+	index, err := readDedupIndex(s.indexPath(snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	if index.Manifest == nil {
+		return nil, errNoManifest
+	}
+	return index.Manifest, nil
+}
+
+func (s *dedupSnapshotStore) Scan(snapshotID string, snapshot Snapshot) ([]ManifestEntry, error) {
+	index, err := readDedupIndex(s.indexPath(snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	r := s.newReader(index)
+	defer r.Close()
+	return scanTar(r)
+}
+
+// Delete removes the index of the snapshot, then the chunks no other snapshot
+// references.
+func (s *dedupSnapshotStore) Delete(snapshotID string, snapshot Snapshot) error {
+	index, err := readDedupIndex(s.indexPath(snapshotID))
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.indexPath(snapshotID)); err != nil {
+		return errors.WithStack(err)
+	}
+	return s.sweep(index.chunks())
+}
+
+// newReader returns the tar stream of the tree of a snapshot, made of the
+// headers of its index followed by the chunks of each file. Every chunk is
+// checked against its hash as it's read. Closing the reader stops the stream.
+func (s *dedupSnapshotStore) newReader(index *dedupIndex) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		for _, entry := range index.Entries {
+			if err := tw.WriteHeader(entry.Header); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, s.newContentReader(entry.Chunks)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+// newContentReader returns the content of a file made of chunks.
+func (s *dedupSnapshotStore) newContentReader(chunks []dedupChunk) io.Reader {
+	readers := make([]io.Reader, len(chunks))
+	for i, chunk := range chunks {
+		readers[i] = &lazyChunkReader{store: s, chunk: chunk}
+	}
+	return io.MultiReader(readers...)
+}
+
+// lazyChunkReader reads a chunk, loading it on the first read.
+type lazyChunkReader struct {
+	store *dedupSnapshotStore
+	chunk dedupChunk
+	r     io.Reader
+}
+
+func (r *lazyChunkReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		data, err := os.ReadFile(r.store.chunkPath(r.chunk.Hash))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error reading chunk %s", r.chunk.Hash)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != r.chunk.Hash {
+			return 0, errors.Errorf("chunk %s is corrupt", r.chunk.Hash)
+		}
+		r.r = bytes.NewReader(data)
+	}
+	return r.r.Read(p)
+}
+
+// RepositoryStats describes the space taken up by the dedup repository.
+type RepositoryStats struct {
+	Snapshots int `json:"snapshots"`
+	Chunks    int `json:"chunks"`
+	// LogicalBytes is the size of the files of all snapshots, as if nothing was
+	// shared, and PhysicalBytes the size of the chunks they reference.
+	LogicalBytes  int64 `json:"logicalBytes"`
+	PhysicalBytes int64 `json:"physicalBytes"`
+	// UnreferencedChunks are left behind by snapshots interrupted by a crash.
+	UnreferencedChunks int   `json:"unreferencedChunks"`
+	UnreferencedBytes  int64 `json:"unreferencedBytes"`
+}
+
+// stats reads the size of the repository from its indexes and chunks. It takes
+// the exclusive lock of the repository, so that the chunks of the snapshots
+// being saved aren't mistaken for unreferenced ones, and waits for them.
+func (s *dedupSnapshotStore) stats() (*RepositoryStats, error) {
+	lock, err := s.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	stats := new(RepositoryStats)
+	refs, err := s.countRefs(func(index *dedupIndex) {
+		stats.Snapshots++
+		for _, chunk := range index.chunks() {
+			stats.LogicalBytes += chunk.Size
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(filepath.Join(s.dir, "chunks"), func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if refs[entry.Name()] > 0 {
+			stats.Chunks++
+			stats.PhysicalBytes += info.Size()
+		} else {
+			stats.UnreferencedChunks++
+			stats.UnreferencedBytes += info.Size()
+		}
+		return nil
+	})
+	return stats, errors.WithStack(err)
+}
+
+// parseDedupChunkSize reads the "dedupChunkSize" key of the config.
+func parseDedupChunkSize(config map[string]string) (int, error) {
+	value := config["dedupChunkSize"]
+	if value == "" {
+		return defaultDedupChunkSize, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid dedupChunkSize %q", value)
+	}
+	if size := quantity.Value(); size >= 1<<10 && size <= 64<<20 {
+		return int(size), nil
+	}
+	return 0, errors.Errorf("invalid dedupChunkSize %q, it must be between 1Ki and 64Mi", value)
+}
+
+// RepositoryStats reports the logical and physical size of the dedup repository.
+func (p *NoOpVolumeSnapshotter) RepositoryStats() (*RepositoryStats, error) {
+	p.mu.Lock()
+	dedup := p.dedup
+	p.mu.Unlock()
+	return dedup.stats()
+}
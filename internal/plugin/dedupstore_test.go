@@ -0,0 +1,213 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestChunks(t *testing.T, data []byte, size int) [][]byte {
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data), size)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerFollowsContent(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := readTestChunks(t, data, 4<<10)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), 1<<10)
+		assert.LessOrEqual(t, len(chunk), 16<<10)
+	}
+
+	// Inserting data only changes the chunks around it.
+	shifted := readTestChunks(t, append([]byte("inserted"), data...), 4<<10)
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		seen[string(chunk)] = true
+	}
+	shared := 0
+	for _, chunk := range shifted {
+		if seen[string(chunk)] {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(chunks)-2)
+}
+
+func TestDedupSharesChunksAcrossVolumes(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "4Ki"}
+	p := newTestSnapshotter(t, config)
+
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	first, second := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(first, "data"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(second, "copy"), data, 0644))
+
+	firstID, err := p.CreateSnapshot("hostPath:"+first, "", nil)
+	require.NoError(t, err)
+	secondID, err := p.CreateSnapshot("hostPath:"+second, "", nil)
+	require.NoError(t, err)
+	assert.True(t, p.catalog.Snapshots[firstID].Dedup)
+	assert.EqualValues(t, len(data), p.catalog.Snapshots[secondID].Size)
+	assert.Less(t, p.catalog.Snapshots[secondID].StoredSize, int64(len(data)/4))
+
+	stats, err := p.RepositoryStats()
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Snapshots)
+	assert.EqualValues(t, 2*len(data), stats.LogicalBytes)
+	assert.Less(t, stats.PhysicalBytes, stats.LogicalBytes*2/3)
+	assert.Zero(t, stats.UnreferencedChunks)
+
+	// References are counted again by a new plugin process, and deleting a
+	// snapshot keeps the chunks the other one needs.
+	p = newTestSnapshotter(t, config)
+	require.NoError(t, p.DeleteSnapshot(firstID))
+	volumeID, err := p.CreateVolumeFromSnapshot(secondID, "", "", nil)
+	require.NoError(t, err)
+	restored, err := os.ReadFile(filepath.Join(testVolumeDir(t, p, volumeID), "copy"))
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+
+	require.NoError(t, p.DeleteSnapshot(secondID))
+	stats, err = p.RepositoryStats()
+	require.NoError(t, err)
+	assert.Equal(t, RepositoryStats{}, *stats)
+}
+
+// TestDedupSharesSmallFiles snapshots small files under other names, with other
+// times and modes, which must share the chunks of their content.
+func TestDedupSharesSmallFiles(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "4Ki"})
+	first, second := t.TempDir(), t.TempDir()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 32; i++ {
+		data := make([]byte, 100+random.Intn(1000))
+		random.Read(data)
+		require.NoError(t, os.WriteFile(filepath.Join(first, fmt.Sprintf("file-%d", i)), data, 0644))
+		path := filepath.Join(second, fmt.Sprintf("copy-of-file-%d", i))
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		modTime := time.Now().Add(-time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	firstID, err := p.CreateSnapshot("hostPath:"+first, "", nil)
+	require.NoError(t, err)
+	secondID, err := p.CreateSnapshot("hostPath:"+second, "", nil)
+	require.NoError(t, err)
+	assert.Positive(t, p.catalog.Snapshots[firstID].StoredSize)
+	assert.Zero(t, p.catalog.Snapshots[secondID].StoredSize)
+
+	volumeID, err := p.CreateVolumeFromSnapshot(secondID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, second), readTestTree(t, testVolumeDir(t, p, volumeID)))
+}
+
+// TestDedupSharedAcrossProcesses deletes a snapshot while another plugin process
+// is saving one that references the same chunks, which must survive.
+func TestDedupSharedAcrossProcesses(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "1Ki"}
+	first, second := newTestSnapshotter(t, config), newTestSnapshotter(t, config)
+	dir := newTestVolume(t)
+	snapshotID, err := first.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	index, err := os.ReadFile(first.dedup.indexPath(snapshotID))
+	require.NoError(t, err)
+
+	// The second process is saving a snapshot of the same data: it has found
+	// the chunks in the repository, but not written its index yet.
+	lock, err := second.dedup.lock(false)
+	require.NoError(t, err)
+	deleted := make(chan error, 1)
+	go func() { deleted <- first.DeleteSnapshot(snapshotID) }()
+	select {
+	case err := <-deleted:
+		t.Fatalf("chunks were swept while a snapshot was being saved: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, os.WriteFile(second.dedup.indexPath("saved"), index, 0644))
+	require.NoError(t, lock.Close())
+	require.NoError(t, <-deleted)
+
+	restored := t.TempDir()
+	require.NoError(t, second.dedup.Restore("saved", Snapshot{}, filepath.Join(restored, "volume")))
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, filepath.Join(restored, "volume")))
+}
+
+// TestDedupKeepsChunksWhenIndexesAreUnreadable checks that no chunk is removed
+// when the references to them can't be counted.
+func TestDedupKeepsChunksWhenIndexesAreUnreadable(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "1Ki"})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	index, err := readDedupIndex(p.dedup.indexPath(snapshotID))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p.dedup.indexPath("garbled"), []byte("{"), 0644))
+
+	assert.Error(t, p.DeleteSnapshot(snapshotID))
+	for _, chunk := range index.chunks() {
+		assert.FileExists(t, p.dedup.chunkPath(chunk.Hash))
+	}
+}
+
+func TestDedupDetectsCorruptChunks(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "1Ki"})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+
+	index, err := readDedupIndex(p.dedup.indexPath(snapshotID))
+	require.NoError(t, err)
+	chunks := index.chunks()
+	chunk := p.dedup.chunkPath(chunks[len(chunks)/2].Hash)
+	data, err := os.ReadFile(chunk)
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(chunk, data, 0644))
+
+	report, err := p.VerifySnapshot(snapshotID)
+	require.NoError(t, err)
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, VerifyUnreadable, report.Findings[0].Problem)
+	assert.Contains(t, report.Findings[0].Detail, "is corrupt")
+}
+
+func TestDedupRejectsObjectStore(t *testing.T) {
+	p := NewNoOpVolumeSnapshotter(newTestLogger())
+	assert.Error(t, p.Init(map[string]string{"stateDir": t.TempDir(), "dedup": "true", "objectStore": testObjectStore, "objectStoreBucket": "snapshots"}))
+	assert.Error(t, p.Init(map[string]string{"stateDir": t.TempDir(), "dedup": "true", "dedupChunkSize": "10"}))
+}
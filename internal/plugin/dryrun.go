@@ -0,0 +1,113 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The tags recorded on snapshots taken in dry run mode, next to the ones Velero
+// passes.
+const (
+	DryRunTag         = "example.io/dry-run"
+	EstimatedBytesTag = "example.io/estimated-bytes"
+	EstimatedFilesTag = "example.io/estimated-files"
+)
+
+// errDryRun is returned when the data of a dry run snapshot is needed.
+var errDryRun = errors.New("the snapshot was taken in dry run mode, it has no data")
+
+// dryRunSnapshotStore sizes volumes instead of copying them, so that the
+// snapshots Velero would take can be seen before taking them. Its snapshots are
+// in the catalog, with the size of the volume, but have no data.
+type dryRunSnapshotStore struct{}
+
+// Save records how many files and bytes a snapshot of the volume would copy, in
+// snapshot and in its tags.
+func (dryRunSnapshotStore) Save(snapshotID, src string, snapshot *Snapshot, job *copyJob) (copyStats, error) {
+	stats, err := sizeTree(src)
+	if err != nil {
+		return stats, err
+	}
+	tags := map[string]string{
+		DryRunTag:         "true",
+		EstimatedBytesTag: strconv.FormatInt(stats.Bytes, 10),
+		EstimatedFilesTag: strconv.FormatInt(stats.Files, 10),
+	}
+	// The tags may be shared with the caller.
+	for key, value := range snapshot.Tags {
+		if _, ok := tags[key]; !ok {
+			tags[key] = value
+		}
+	}
+	snapshot.Tags = tags
+	snapshot.Size = stats.Bytes
+	snapshot.StoredSize = 0
+	return stats, nil
+}
+
+func (dryRunSnapshotStore) Manifest(snapshotID string, snapshot Snapshot) (*SnapshotManifest, error) {
+	return nil, errDryRun
+}
+
+func (dryRunSnapshotStore) Scan(snapshotID string, snapshot Snapshot) ([]ManifestEntry, error) {
+	return nil, errDryRun
+}
+
+func (dryRunSnapshotStore) Restore(snapshotID string, snapshot Snapshot, dst string) error {
+	return errDryRun
+}
+
+func (dryRunSnapshotStore) Open(snapshotID string, snapshot Snapshot) (io.ReadCloser, error) {
+	return nil, errDryRun
+}
+
+// Delete doesn't have anything to remove.
+func (dryRunSnapshotStore) Delete(snapshotID string, snapshot Snapshot) error {
+	return nil
+}
+
+// sizeTree counts what copyTree would copy of the directory tree at src, without
+// reading any file.
+func sizeTree(src string) (copyStats, error) {
+	var stats copyStats
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			stats.Dirs++
+		case mode.IsRegular():
+			stats.Files++
+			stats.Bytes += info.Size()
+		case mode&fs.ModeSymlink != 0:
+			stats.Symlinks++
+		}
+		return nil
+	})
+	return stats, errors.Wrapf(err, "error sizing %s", src)
+}
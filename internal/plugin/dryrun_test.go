@@ -0,0 +1,104 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunSnapshots(t *testing.T) {
+	stateDir := t.TempDir()
+	// Hooks aren't run, as nothing is copied.
+	config := map[string]string{"stateDir": stateDir, "dryRun": "true", "incremental": "true", "preSnapshotHook": "exec:false", "allowExecHooks": "true"}
+	p := newTestSnapshotter(t, config)
+	dir := newTestVolume(t)
+	volume := "hostPath:" + dir
+
+	tags := map[string]string{"velero.io/backup": "b1"}
+	snapshotID, err := p.CreateSnapshot(volume, "zone-a", tags)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"velero.io/backup": "b1"}, tags)
+
+	catalog, err := LoadSnapshotCatalog(stateDir)
+	require.NoError(t, err)
+	snapshot := catalog.Snapshots[snapshotID]
+	assert.True(t, snapshot.DryRun)
+	assert.Empty(t, snapshot.Phase)
+	assert.EqualValues(t, 5000, snapshot.Size)
+	assert.EqualValues(t, 0, snapshot.StoredSize)
+	assert.Equal(t, map[string]string{
+		"velero.io/backup": "b1",
+		DryRunTag:          "true",
+		EstimatedBytesTag:  "5000",
+		EstimatedFilesTag:  "2",
+	}, snapshot.Tags)
+	assert.Equal(t, []string{snapshotID}, catalog.SnapshotsTagged(map[string]string{DryRunTag: "true"}))
+	entries, err := os.ReadDir(filepath.Join(stateDir, "snapshots"))
+	if !os.IsNotExist(err) {
+		assert.Empty(t, entries)
+	}
+
+	_, err = p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	assert.ErrorContains(t, err, "dry run")
+	_, err = p.VerifySnapshot(snapshotID)
+	assert.Error(t, err)
+
+	// Real snapshots aren't based on dry runs.
+	delete(config, "dryRun")
+	delete(config, "preSnapshotHook")
+	p = newTestSnapshotter(t, config)
+	realID, err := p.CreateSnapshot(volume, "zone-a", nil)
+	require.NoError(t, err)
+	p.mu.Lock()
+	assert.Empty(t, p.catalog.Snapshots[realID].Parent)
+	assert.False(t, p.catalog.Snapshots[realID].DryRun)
+	p.mu.Unlock()
+
+	require.NoError(t, p.DeleteSnapshot(snapshotID))
+	assert.Equal(t, []string{realID}, p.SnapshotIDs(nil))
+}
+
+func TestDryRunSnapshotsAsync(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dryRun": "true", "async": "true"})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	// Restores are refused right away, even before the volume is sized.
+	_, err = p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	assert.ErrorContains(t, err, "dry run")
+
+	require.NoError(t, p.DeleteSnapshot(snapshotID))
+	assert.Empty(t, p.SnapshotIDs(nil))
+}
+
+func TestDryRunRefusesImports(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	var exported bytes.Buffer
+	require.NoError(t, p.ExportSnapshot(snapshotID, &exported, ""))
+
+	other := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dryRun": "true"})
+	_, err = other.ImportSnapshot(bytes.NewReader(exported.Bytes()))
+	assert.ErrorContains(t, err, "can't be imported in dry run mode")
+	assert.Empty(t, other.SnapshotIDs(nil))
+}
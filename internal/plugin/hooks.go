@@ -0,0 +1,331 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The annotations of a PersistentVolume that override the snapshot hooks of the
+// volume snapshot location config for that volume.
+const (
+	PreSnapshotHookAnnotation     = "example.io/pre-snapshot-hook"
+	PostSnapshotHookAnnotation    = "example.io/post-snapshot-hook"
+	SnapshotHookTimeoutAnnotation = "example.io/snapshot-hook-timeout"
+	SnapshotHookOnErrorAnnotation = "example.io/snapshot-hook-on-error"
+)
+
+const (
+	// defaultHookTimeout is how long a hook may take.
+	defaultHookTimeout = 30 * time.Second
+	// markerAckSuffix is added to the name of a marker file by the application
+	// once it's quiesced.
+	markerAckSuffix = ".ack"
+	// The failure policies of hooks: failing fails the snapshot, and continuing
+	// only logs a warning.
+	hookOnErrorFail     = "fail"
+	hookOnErrorContinue = "continue"
+)
+
+// snapshotHooks quiesce an application while its volume is copied. A hook is
+// one of:
+//
+//   - exec:<command> [args...], run in the volume directory with the VOLUME_ID,
+//     VOLUME_DIR, SNAPSHOT_ID and HOOK_PHASE environment variables, if the
+//     config allows them with "allowExecHooks", as anyone who can annotate a
+//     PersistentVolume could otherwise run commands in the plugin;
+//   - file:<path>, a marker file, relative to the volume directory and inside
+//     it, which the pre hook creates and the application acknowledges by
+//     creating <path>.ack once it's quiesced, and which the post hook removes;
+//   - an http:// or https:// URL, which is POSTed the phase, volume ID and
+//     snapshot ID as JSON and must answer with a 2xx status.
+type snapshotHooks struct {
+	pre, post       string
+	timeout         time.Duration
+	continueOnError bool
+}
+
+// parseSnapshotHooks reads the hooks from values, which are looked up by the
+// keys of the volume snapshot location config or by the annotations of a volume.
+// exec: hooks are rejected unless allowExec is set.
+func parseSnapshotHooks(pre, post, timeout, onError string, allowExec bool) (snapshotHooks, error) {
+	hooks := snapshotHooks{pre: pre, post: post, timeout: defaultHookTimeout}
+	for _, hook := range []string{pre, post} {
+		if err := validateHook(hook, allowExec); err != nil {
+			return hooks, err
+		}
+	}
+	if timeout != "" {
+		var err error
+		if hooks.timeout, err = time.ParseDuration(timeout); err != nil || hooks.timeout <= 0 {
+			return hooks, errors.Errorf("invalid snapshot hook timeout %q, it must be a positive duration", timeout)
+		}
+	}
+	switch onError {
+	case "", hookOnErrorFail:
+	case hookOnErrorContinue:
+		hooks.continueOnError = true
+	default:
+		return hooks, errors.Errorf("invalid snapshot hook failure policy %q, use %s or %s", onError, hookOnErrorFail, hookOnErrorContinue)
+	}
+	return hooks, nil
+}
+
+func validateHook(hook string, allowExec bool) error {
+	switch {
+	case hook == "":
+	case strings.HasPrefix(hook, "exec:"):
+		if !allowExec {
+			return errors.Errorf("snapshot hook %q runs a command, set allowExecHooks to true in the volume snapshot location config to allow it", hook)
+		}
+		if len(strings.Fields(strings.TrimPrefix(hook, "exec:"))) == 0 {
+			return errors.Errorf("invalid snapshot hook %q, it has no command", hook)
+		}
+	case strings.HasPrefix(hook, "file:"):
+		marker := strings.TrimPrefix(hook, "file:")
+		if marker == "" {
+			return errors.Errorf("invalid snapshot hook %q, it has no path", hook)
+		}
+		// The plugin creates and removes marker files, which anyone who can
+		// annotate a PersistentVolume could otherwise point anywhere.
+		if !filepath.IsLocal(marker) || filepath.Clean(marker) == "." {
+			return errors.Errorf("invalid snapshot hook %q, its path must be relative to the volume directory and inside it", hook)
+		}
+	case strings.HasPrefix(hook, "http://"), strings.HasPrefix(hook, "https://"):
+	default:
+		return errors.Errorf("invalid snapshot hook %q, use exec:<command>, file:<path> or an http(s) URL", hook)
+	}
+	return nil
+}
+
+// snapshotHooks returns the hooks of a volume: those of the config, overridden
+// by the annotations of the PersistentVolume GetVolumeID was called with.
+// Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) snapshotHooks(volumeID string) (snapshotHooks, error) {
+	value := func(key, annotation string) string {
+		if v, ok := p.annotations[volumeID][annotation]; ok {
+			return v
+		}
+		return p.config[key]
+	}
+	hooks, err := parseSnapshotHooks(
+		value("preSnapshotHook", PreSnapshotHookAnnotation),
+		value("postSnapshotHook", PostSnapshotHookAnnotation),
+		value("snapshotHookTimeout", SnapshotHookTimeoutAnnotation),
+		value("snapshotHookOnError", SnapshotHookOnErrorAnnotation),
+		p.config["allowExecHooks"] == "true",
+	)
+	return hooks, errors.Wrapf(err, "invalid snapshot hooks for volume %s", volumeID)
+}
+
+// hookRun describes the snapshot a hook runs for.
+type hookRun struct {
+	VolumeID   string `json:"volumeID"`
+	SnapshotID string `json:"snapshotID"`
+	Phase      string `json:"phase"`
+	dir        string
+}
+
+// markerFiles returns the marker files of the file: hooks, and their
+// acknowledgements, relative to the volume directory. They belong to the hooks
+// rather than the application, so they're left out of snapshots.
+func (h snapshotHooks) markerFiles() []string {
+	var files []string
+	for _, hook := range []string{h.pre, h.post} {
+		if strings.HasPrefix(hook, "file:") {
+			marker := filepath.Clean(strings.TrimPrefix(hook, "file:"))
+			files = append(files, marker, marker+markerAckSuffix)
+		}
+	}
+	return files
+}
+
+// quiesce runs copy between the pre and post hooks. The post hook also runs if
+// the pre hook or the copy fail, to undo whatever was done. Hook failures fail
+// the snapshot, unless the policy is to continue.
+func (h snapshotHooks) quiesce(log logrus.FieldLogger, volumeID, snapshotID, dir string, copy func() error) error {
+	run := hookRun{VolumeID: volumeID, SnapshotID: snapshotID, dir: dir}
+	hookErr := func(phase, hook string) error {
+		if hook == "" {
+			return nil
+		}
+		run.Phase = phase
+		start := time.Now()
+		err := h.run(hook, run)
+		log := log.WithFields(logrus.Fields{"phase": phase, "hook": hook, "duration": time.Since(start).Round(time.Millisecond)})
+		switch {
+		case err == nil:
+			log.Info("Ran snapshot hook")
+		case h.continueOnError:
+			log.WithError(err).Warn("Snapshot hook failed, snapshotting anyway")
+			return nil
+		default:
+			log.WithError(err).Error("Snapshot hook failed")
+		}
+		return errors.Wrapf(err, "%s-snapshot hook failed", phase)
+	}
+
+	if err := hookErr("pre", h.pre); err != nil {
+		hookErr("post", h.post)
+		return err
+	}
+	err := copy()
+	if postErr := hookErr("post", h.post); err == nil {
+		err = postErr
+	}
+	return err
+}
+
+// run runs a hook within the timeout.
+func (h snapshotHooks) run(hook string, run hookRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	switch {
+	case strings.HasPrefix(hook, "exec:"):
+		return runExecHook(ctx, strings.Fields(strings.TrimPrefix(hook, "exec:")), run)
+	case strings.HasPrefix(hook, "file:"):
+		return runMarkerHook(ctx, strings.TrimPrefix(hook, "file:"), run)
+	default:
+		return runHTTPHook(ctx, hook, run)
+	}
+}
+
+func runExecHook(ctx context.Context, args []string, run hookRun) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = run.dir
+	cmd.Env = append(os.Environ(),
+		"VOLUME_ID="+run.VolumeID,
+		"VOLUME_DIR="+run.dir,
+		"SNAPSHOT_ID="+run.SnapshotID,
+		"HOOK_PHASE="+run.Phase,
+	)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "%s didn't finish in time", args[0])
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", args[0], truncateOutput(output))
+	}
+	return nil
+}
+
+// truncateOutput keeps the end of the output of a hook for error messages.
+func truncateOutput(output []byte) string {
+	const max = 1024
+	output = bytes.TrimSpace(output)
+	if len(output) > max {
+		output = append([]byte("..."), output[len(output)-max:]...)
+	}
+	return string(output)
+}
+
+// runMarkerHook creates the marker file before the snapshot and waits for the
+// application to acknowledge it, and removes both after the snapshot.
+func runMarkerHook(ctx context.Context, marker string, run hookRun) error {
+	marker, err := markerPath(run.dir, marker)
+	if os.IsNotExist(errors.Cause(err)) && run.Phase == "post" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ack := marker + markerAckSuffix
+	if run.Phase == "post" {
+		for _, path := range []string{marker, ack} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+
+	// An acknowledgement left over from an earlier snapshot doesn't count.
+	if err := os.Remove(ack); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	// The application may read the marker as soon as it appears, so it never
+	// sees it partially written.
+	if err := writeFileAtomic(marker, []byte(run.SnapshotID+"\n")); err != nil {
+		return errors.WithStack(err)
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(ack); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("%s wasn't created in time", ack)
+		case <-ticker.C:
+		}
+	}
+}
+
+// markerPath returns the path of a marker file in the volume directory dir. The
+// directories leading to it may be symlinks, which must not lead out of the
+// volume.
+func markerPath(dir, marker string) (string, error) {
+	path := filepath.Join(dir, marker)
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || !filepath.IsLocal(rel) {
+		return "", errors.Errorf("marker file %s is outside of the volume", marker)
+	}
+	return path, nil
+}
+
+func runHTTPHook(ctx context.Context, url string, run hookRun) error {
+	body, err := json.Marshal(run)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(strings.TrimSpace(fmt.Sprintf("%s answered %s %s", url, resp.Status, message)))
+	}
+	return nil
+}
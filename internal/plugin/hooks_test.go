@@ -0,0 +1,244 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// newTestHookScript returns an exec hook that logs its phase, snapshot and
+// working directory to the returned file.
+func newTestHookScript(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	script, log := filepath.Join(dir, "hook.sh"), filepath.Join(dir, "hook.log")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$HOOK_PHASE $SNAPSHOT_ID $(pwd)\" >> \"$1\"\n"), 0755))
+	return "exec:" + script + " " + log, log
+}
+
+func readTestLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestExecSnapshotHooks(t *testing.T) {
+	hook, log := newTestHookScript(t)
+	config := map[string]string{"stateDir": t.TempDir(), "preSnapshotHook": hook, "postSnapshotHook": hook}
+	// Commands only run if the config allows them.
+	err := NewNoOpVolumeSnapshotter(newTestLogger()).Init(config)
+	assert.ErrorContains(t, err, "set allowExecHooks to true")
+
+	config["allowExecHooks"] = "true"
+	p := newTestSnapshotter(t, config)
+	volume := newTestVolume(t)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+volume, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pre " + snapshotID + " " + volume, "post " + snapshotID + " " + volume}, readTestLines(t, log))
+}
+
+func TestExecSnapshotHookFromAnnotationsNeedsOptIn(t *testing.T) {
+	hook, log := newTestHookScript(t)
+	config := map[string]string{"stateDir": t.TempDir()}
+	volume := newTestVolume(t)
+	pv := newTestPV(t, v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: volume}}).(*unstructured.Unstructured)
+	pv.SetAnnotations(map[string]string{PreSnapshotHookAnnotation: hook})
+
+	p := newTestSnapshotter(t, config)
+	volumeID, err := p.GetVolumeID(pv)
+	require.NoError(t, err)
+	_, err = p.CreateSnapshot(volumeID, "", nil)
+	assert.ErrorContains(t, err, "set allowExecHooks to true")
+	assert.Empty(t, readTestLines(t, log))
+
+	config["allowExecHooks"] = "true"
+	p = newTestSnapshotter(t, config)
+	volumeID, err = p.GetVolumeID(pv)
+	require.NoError(t, err)
+	_, err = p.CreateSnapshot(volumeID, "", nil)
+	require.NoError(t, err)
+	assert.Len(t, readTestLines(t, log), 1)
+}
+
+func TestSnapshotHookFailurePolicy(t *testing.T) {
+	post, log := newTestHookScript(t)
+	config := map[string]string{"stateDir": t.TempDir(), "preSnapshotHook": "exec:false", "postSnapshotHook": post, "allowExecHooks": "true"}
+	p := newTestSnapshotter(t, config)
+	_, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	assert.ErrorContains(t, err, "pre-snapshot hook failed")
+	assert.Empty(t, p.catalog.Snapshots)
+	// The post hook undoes whatever the pre hook did.
+	assert.Len(t, readTestLines(t, log), 1)
+
+	config["snapshotHookOnError"] = "continue"
+	p = newTestSnapshotter(t, config)
+	_, err = p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	assert.NoError(t, err)
+
+	config["preSnapshotHook"] = "exec:sleep 5"
+	config["snapshotHookTimeout"] = "100ms"
+	config["snapshotHookOnError"] = "fail"
+	p = newTestSnapshotter(t, config)
+	start := time.Now()
+	_, err = p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	assert.ErrorContains(t, err, "didn't finish in time")
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestMarkerFileHookFromAnnotations(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "preSnapshotHook": "exec:false", "allowExecHooks": "true"})
+	volume := newTestVolume(t)
+	tree := readTestTree(t, volume)
+	pv := newTestPV(t, v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: volume}}).(*unstructured.Unstructured)
+	pv.SetAnnotations(map[string]string{
+		PreSnapshotHookAnnotation:     "file:.quiesce",
+		PostSnapshotHookAnnotation:    "file:.quiesce",
+		SnapshotHookTimeoutAnnotation: "5s",
+	})
+	volumeID, err := p.GetVolumeID(pv)
+	require.NoError(t, err)
+
+	// The application acknowledges the marker once it's quiesced.
+	marker := filepath.Join(volume, ".quiesce")
+	var acked string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if data, err := os.ReadFile(marker); err == nil {
+				acked = strings.TrimSpace(string(data))
+				os.WriteFile(marker+markerAckSuffix, nil, 0644)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	snapshotID, err := p.CreateSnapshot(volumeID, "", nil)
+	require.NoError(t, err)
+	<-done
+	assert.Equal(t, snapshotID, acked)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(marker + markerAckSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// The marker and its acknowledgement aren't part of the snapshot.
+	restored, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, tree, readTestTree(t, testVolumeDir(t, p, restored)))
+}
+
+func TestMarkerFiles(t *testing.T) {
+	hooks := snapshotHooks{pre: "file:.quiesce", post: "file:sub/../.thaw"}
+	assert.Equal(t, []string{".quiesce", ".quiesce.ack", ".thaw", ".thaw.ack"}, hooks.markerFiles())
+	hooks = snapshotHooks{pre: "exec:true", post: "http://localhost/thaw"}
+	assert.Empty(t, hooks.markerFiles())
+}
+
+// TestMarkerHookStaysInVolume checks that marker files can't be created or
+// removed outside of the volume, by their path or through symlinks.
+func TestMarkerHookStaysInVolume(t *testing.T) {
+	for _, hook := range []string{"file:/etc/.quiesce", "file:../.quiesce", "file:sub/../../.quiesce", "file:."} {
+		_, err := parseSnapshotHooks(hook, "", "", "", false)
+		assert.ErrorContains(t, err, "must be relative to the volume directory and inside it", hook)
+		_, err = parseSnapshotHooks("", hook, "", "", false)
+		assert.Error(t, err, hook)
+	}
+
+	volume, outside := newTestVolume(t), t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(volume, "out")))
+	victim := filepath.Join(outside, ".quiesce")
+	require.NoError(t, os.WriteFile(victim, nil, 0644))
+	for _, phase := range []string{"pre", "post"} {
+		err := runMarkerHook(context.Background(), "out/.quiesce", hookRun{Phase: phase, dir: volume})
+		assert.ErrorContains(t, err, "is outside of the volume", phase)
+	}
+	assert.FileExists(t, victim)
+	assert.NoFileExists(t, victim+markerAckSuffix)
+
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	pv := newTestPV(t, v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: volume}}).(*unstructured.Unstructured)
+	pv.SetAnnotations(map[string]string{PostSnapshotHookAnnotation: "file:../.quiesce"})
+	volumeID, err := p.GetVolumeID(pv)
+	require.NoError(t, err)
+	_, err = p.CreateSnapshot(volumeID, "", nil)
+	assert.ErrorContains(t, err, "must be relative to the volume directory and inside it")
+}
+
+func TestHTTPSnapshotHooks(t *testing.T) {
+	var mu sync.Mutex
+	var phases []string
+	failPre := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var run hookRun
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&run))
+		mu.Lock()
+		defer mu.Unlock()
+		phases = append(phases, run.Phase)
+		if failPre && run.Phase == "pre" {
+			http.Error(w, "database is busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	config := map[string]string{"stateDir": t.TempDir(), "preSnapshotHook": server.URL + "/pre", "postSnapshotHook": server.URL + "/post"}
+	p := newTestSnapshotter(t, config)
+	_, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"pre", "post"}, phases)
+	failPre = true
+	mu.Unlock()
+	_, err = p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	assert.ErrorContains(t, err, "503 Service Unavailable database is busy")
+}
+
+func TestParseSnapshotHooks(t *testing.T) {
+	for _, values := range [][4]string{
+		{"ssh:host", "", "", ""},
+		{"exec:", "", "", ""},
+		{"file:", "", "", ""},
+		{"", "", "-1s", ""},
+		{"", "", "", "ignore"},
+	} {
+		_, err := parseSnapshotHooks(values[0], values[1], values[2], values[3], true)
+		assert.Error(t, err, "%v", values)
+	}
+	_, err := parseSnapshotHooks("exec:fsfreeze -f .", "", "", "", false)
+	assert.ErrorContains(t, err, "set allowExecHooks to true")
+	hooks, err := parseSnapshotHooks("exec:fsfreeze -f .", "http://localhost:8080/thaw", "1m", "continue", true)
+	require.NoError(t, err)
+	assert.Equal(t, snapshotHooks{pre: "exec:fsfreeze -f .", post: "http://localhost:8080/thaw", timeout: time.Minute, continueOnError: true}, hooks)
+
+	assert.Error(t, NewNoOpVolumeSnapshotter(newTestLogger()).Init(map[string]string{"stateDir": t.TempDir(), "preSnapshotHook": "bogus"}))
+}
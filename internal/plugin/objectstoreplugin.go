@@ -17,19 +17,26 @@ limitations under the License.
 package plugin
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type FileObjectStore struct {
-	log logrus.FieldLogger
+	log     logrus.FieldLogger
+	rootDir string
 }
 
 // NewFileObjectStore instantiates a FileObjectStore.
@@ -37,16 +44,30 @@ func NewFileObjectStore(log logrus.FieldLogger) *FileObjectStore {
 	return &FileObjectStore{log: log}
 }
 
+// NewFileObjectStoreAt instantiates a FileObjectStore rooted at the given directory
+// instead of the one named by ARK_FILE_OBJECT_STORE_ROOT.
+func NewFileObjectStoreAt(log logrus.FieldLogger, root string) *FileObjectStore {
+	return &FileObjectStore{log: log, rootDir: root}
+}
+
+// Root returns the directory under which buckets are stored.
+func (f *FileObjectStore) Root() string {
+	if f.rootDir != "" {
+		return f.rootDir
+	}
+	return getRoot()
+}
+
 // Init initializes the plugin. After v0.10.0, this can be called multiple times.
 func (f *FileObjectStore) Init(config map[string]string) error {
 	f.log.Infof("FileObjectStore.Init called")
 
-	path := filepath.Join(getRoot(), config["bucket"], config["prefix"])
+	path := filepath.Join(f.Root(), config["bucket"], config["prefix"])
 	return os.MkdirAll(path, 0755)
 }
 
 func (f *FileObjectStore) PutObject(bucket string, key string, body io.Reader) error {
-	path := filepath.Join(getRoot(), bucket, key)
+	path := filepath.Join(f.Root(), bucket, key)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -61,22 +82,43 @@ func (f *FileObjectStore) PutObject(bucket string, key string, body io.Reader) e
 		return err
 	}
 
+	// The object is written to a staging file and renamed into place, so readers
+	// and concurrent writers never see a partially written object.
 	log.Infof("Creating file")
-	file, err := os.Create(path)
+	file, err := f.createStagingFile()
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
 	log.Infof("Writing to file")
-	_, err = io.Copy(file, body)
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	unlock := lockObject(path)
+	defer unlock()
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	log.Infof("Writing checksum")
+	if err := f.writeChecksum(bucket, key, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return err
+	}
 
 	log.Infof("Done")
-	return err
+	return nil
 }
 
 func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	path := filepath.Join(getRoot(), bucket, key)
+	path := filepath.Join(f.Root(), bucket, key)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -85,9 +127,10 @@ func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
 	})
 	log.Infof("ObjectExists")
 
-	_, err := os.Stat(path)
+	info, err := os.Stat(path)
 	if err == nil {
-		return true, nil
+		// Directories only mimic the prefixes of keys, they aren't objects.
+		return info.Mode().IsRegular(), nil
 	}
 	if os.IsNotExist(err) {
 		return false, nil
@@ -97,7 +140,7 @@ func (f *FileObjectStore) ObjectExists(bucket, key string) (bool, error) {
 }
 
 func (f *FileObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	path := filepath.Join(getRoot(), bucket, key)
+	path := filepath.Join(f.Root(), bucket, key)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -106,11 +149,19 @@ func (f *FileObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
 	})
 	log.Infof("GetObject")
 
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
 	return os.Open(path)
 }
 
 func (f *FileObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix, delimiter)
+	path := filepath.Join(f.Root(), bucket, prefix)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket":    bucket,
@@ -120,23 +171,32 @@ func (f *FileObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) (
 	})
 	log.Infof("ListCommonPrefixes")
 
-	infos, err := ioutil.ReadDir(path)
+	keys, err := f.listKeys(bucket, prefix)
 	if err != nil {
 		return nil, err
 	}
 
-	var dirs []string
-	for _, info := range infos {
-		if info.IsDir() {
-			dirs = append(dirs, info.Name())
+	// Like other object stores, return the full prefix of every key that has the
+	// delimiter after the prefix, up to and including the delimiter.
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		i := strings.Index(key[len(prefix):], delimiter)
+		if i < 0 {
+			continue
+		}
+		commonPrefix := key[:len(prefix)+i+len(delimiter)]
+		if !seen[commonPrefix] {
+			seen[commonPrefix] = true
+			prefixes = append(prefixes, commonPrefix)
 		}
 	}
 
-	return dirs, nil
+	return prefixes, nil
 }
 
 func (f *FileObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix)
+	path := filepath.Join(f.Root(), bucket, prefix)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -145,21 +205,53 @@ func (f *FileObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 	})
 	log.Infof("ListObjects")
 
-	infos, err := ioutil.ReadDir(path)
+	return f.listKeys(bucket, prefix)
+}
+
+// listKeys returns the keys of all objects in the bucket that start with prefix,
+// in lexical order. Keys are matched as strings, so only the directory the prefix
+// ends in has to be walked: "backups/a" matches both "backups/a/b" and "backups/ab".
+func (f *FileObjectStore) listKeys(bucket, prefix string) ([]string, error) {
+	bucketPath := filepath.Join(f.Root(), bucket)
+	dir := filepath.Join(bucketPath, filepath.FromSlash(path.Dir(prefix+"x")))
+
+	var keys []string
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			// With an empty bucket, the root itself holds the buckets.
+			if filepath.Dir(p) == f.Root() && (entry.Name() == checksumDir || entry.Name() == stagingDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketPath, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var objects []string
-	for _, info := range infos {
-		objects = append(objects, filepath.Join(prefix, info.Name()))
-	}
-
-	return objects, nil
+	return keys, nil
 }
 
 func (f *FileObjectStore) DeleteObject(bucket, key string) error {
-	path := filepath.Join(getRoot(), bucket, key)
+	path := filepath.Join(f.Root(), bucket, key)
 
 	log := f.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -168,27 +260,26 @@ func (f *FileObjectStore) DeleteObject(bucket, key string) error {
 	})
 	log.Infof("DeleteObject")
 
+	unlock := lockObject(path)
 	err := os.Remove(path)
-
-	// This logic is specific to a file system; we need to clean up the backup directory
-	// if there's nothing left. "Normal" object stores only mimic directory structures and don't need this.
-	keyParts := strings.Split(key, "/")
-	var backupPath string
-	if len(keyParts) > 1 {
-		backupPath = filepath.Join(getRoot(), bucket, keyParts[0], keyParts[1])
+	if rmErr := os.Remove(f.checksumPath(bucket, key)); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.WithError(rmErr).Warn("Unable to remove checksum")
 	}
-	if backupPath != "" {
-		infos, err := ioutil.ReadDir(backupPath)
-		if err != nil {
-			return err
-		}
-		if len(infos) == 0 {
-			l := f.log.WithFields(logrus.Fields{
-				"backupPath": backupPath,
-			})
-			l.Infof("Deleted backup directory")
-			os.Remove(backupPath)
+	unlock()
+
+	// This logic is specific to a file system; we need to clean up the directories
+	// left empty, e.g. the backup directory once its last object is deleted. "Normal"
+	// object stores only mimic directory structures and don't need this.
+	bucketPath := filepath.Join(f.Root(), bucket)
+	for dir := filepath.Dir(path); dir != bucketPath && strings.HasPrefix(dir, bucketPath); dir = filepath.Dir(dir) {
+		// Removing a directory fails as long as anything is left in it.
+		if os.Remove(dir) != nil {
+			break
 		}
+		l := f.log.WithFields(logrus.Fields{
+			"dir": dir,
+		})
+		l.Infof("Deleted empty directory")
 	}
 
 	return err
@@ -203,7 +294,84 @@ func (f *FileObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration)
 	return "", errors.New("CreateSignedURL is not supported for this plugin")
 }
 
-const defaultRoot = "/tmp/backups"
+// Checksum returns the SHA-256 checksum recorded when the object was written. An
+// empty string is returned for objects written before checksums were recorded.
+func (f *FileObjectStore) Checksum(bucket, key string) (string, error) {
+	data, err := ioutil.ReadFile(f.checksumPath(bucket, key))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (f *FileObjectStore) writeChecksum(bucket, key, sum string) error {
+	path := f.checksumPath(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := f.createStagingFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.WriteString(sum + "\n"); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// createStagingFile creates a file to write an object to before it's renamed into
+// place. Staging files are kept next to the buckets, on the same file system.
+func (f *FileObjectStore) createStagingFile() (*os.File, error) {
+	dir := filepath.Join(f.Root(), stagingDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, "object-")
+	if err != nil {
+		return nil, err
+	}
+	// Objects are created world-readable, like os.Create would.
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// checksumPath returns where the checksum of an object is kept. Checksums live in
+// a tree next to the buckets so that they never show up in object listings.
+func (f *FileObjectStore) checksumPath(bucket, key string) string {
+	return filepath.Join(f.Root(), checksumDir, bucket, key+".sha256")
+}
+
+const (
+	defaultRoot = "/tmp/backups"
+	checksumDir = ".checksums"
+	stagingDir  = ".staging"
+)
+
+// objectLocks serializes renaming objects and their checksums into place, so that
+// concurrent writes to the same key leave a matching pair behind.
+var objectLocks [64]sync.Mutex
+
+func lockObject(path string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	l := &objectLocks[h.Sum32()%uint32(len(objectLocks))]
+	l.Lock()
+	return l.Unlock
+}
 
 func getRoot() string {
 	root := os.Getenv("ARK_FILE_OBJECT_STORE_ROOT")
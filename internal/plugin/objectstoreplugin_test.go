@@ -0,0 +1,49 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	"github.com/vmware-tanzu/velero-plugin-example/internal/objectstoretest"
+)
+
+func TestFileObjectStoreConformance(t *testing.T) {
+	for name, config := range map[string]map[string]string{
+		"bucket":            {"bucket": "velero"},
+		"bucket and prefix": {"bucket": "velero", "prefix": "cluster-a"},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			objectstoretest.Run(t, objectstoretest.Options{
+				New: func(t *testing.T) (velero.ObjectStore, map[string]string) {
+					return NewFileObjectStoreAt(newTestLogger(), t.TempDir()), config
+				},
+			})
+		})
+	}
+}
+
+func newTestLogger() logrus.FieldLogger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
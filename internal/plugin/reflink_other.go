@@ -0,0 +1,30 @@
+//go:build !linux
+
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// cloneFile fails, files are only cloned on Linux, where the plugin is deployed.
+func cloneFile(dst, src *os.File) error {
+	return errors.New("cloning files is only supported on Linux")
+}
@@ -0,0 +1,135 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCloneFile clones files by copying their data, without moving the offset of
+// src, as FICLONE does.
+func fakeCloneFile(calls *int) func(dst, src *os.File) error {
+	return func(dst, src *os.File) error {
+		*calls++
+		info, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, io.NewSectionReader(src, 0, info.Size()))
+		return err
+	}
+}
+
+func testCopyStrategy(t *testing.T, p *NoOpVolumeSnapshotter, snapshotID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot, ok := p.catalog.Snapshots[snapshotID]
+	require.True(t, ok)
+	return snapshot.CopyStrategy
+}
+
+func TestReflinkClonesFiles(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "incremental": "true"})
+	var calls int
+	p.local.cloneFile = fakeCloneFile(&calls)
+	dir := newTestVolume(t)
+
+	first, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyReflink, testCopyStrategy(t, p, first))
+	assert.Equal(t, 2, calls)
+	// The manifest holds the hashes of the cloned files.
+	report, err := p.VerifySnapshot(first)
+	require.NoError(t, err)
+	assert.Empty(t, report.Findings)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), []byte("changed"), 0600))
+	second, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyHardlink+"+"+strategyReflink, testCopyStrategy(t, p, second))
+	assert.Equal(t, 3, calls)
+
+	restored, err := p.CreateVolumeFromSnapshot(second, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, restored)))
+	assert.Equal(t, 5, calls)
+}
+
+func TestReflinkFallsBackToCopy(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "incremental": "true"})
+	var calls int
+	p.local.cloneFile = func(dst, src *os.File) error {
+		calls++
+		return errors.New("operation not supported")
+	}
+	dir := newTestVolume(t)
+
+	first, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyCopy, testCopyStrategy(t, p, first))
+	// The other files aren't tried once cloning failed.
+	assert.Equal(t, 1, calls)
+	report, err := p.VerifySnapshot(first)
+	require.NoError(t, err)
+	assert.Empty(t, report.Findings)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), []byte("changed"), 0600))
+	second, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyHardlink+"+"+strategyCopy, testCopyStrategy(t, p, second))
+
+	restored, err := p.CreateVolumeFromSnapshot(second, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, restored)))
+}
+
+// TestReflinkOnThisFilesystem clones files for real if the filesystem of the
+// test supports it, and falls back to copying them otherwise.
+func TestReflinkOnThisFilesystem(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	dir := newTestVolume(t)
+
+	snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Contains(t, []string{strategyReflink, strategyCopy}, testCopyStrategy(t, p, snapshotID))
+
+	restored, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, restored)))
+}
+
+func TestReflinkConfig(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "reflink": "never"})
+	assert.Nil(t, p.local.cloneFile)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyCopy, testCopyStrategy(t, p, snapshotID))
+
+	p = newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dedup": "true"})
+	snapshotID, err = p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, strategyStream, testCopyStrategy(t, p, snapshotID))
+
+	assert.Error(t, NewNoOpVolumeSnapshotter(newTestLogger()).Init(map[string]string{"stateDir": t.TempDir(), "reflink": "always"}))
+}
@@ -0,0 +1,290 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PVCTag is added to the tags of snapshots, next to the ones Velero passes, with
+// the namespace/name of the PersistentVolumeClaim bound to the volume.
+const PVCTag = "example.io/pvc"
+
+// defaultRetentionInterval is how often the retention policy is applied.
+const defaultRetentionInterval = time.Hour
+
+// RetentionRule selects snapshots to prune. A snapshot is pruned if it has all
+// the Tags of the rule, and is both beyond the KeepLast most recent snapshots of
+// its group and older than OlderThan, for the conditions that are set.
+type RetentionRule struct {
+	Tags map[string]string
+	// KeepLast is the number of snapshots kept per value of the GroupBy tag.
+	KeepLast int
+	// GroupBy is the tag KeepLast counts snapshots by, PVCTag by default.
+	// Snapshots without the tag are grouped by volume.
+	GroupBy   string
+	OlderThan time.Duration
+}
+
+// ParseRetentionRule parses a rule written as comma-separated key=value pairs:
+// keepLast=<n>, groupBy=<tag>, olderThan=<duration> and the tags snapshots must
+// have, e.g. "velero.io/schedule-name=daily,olderThan=30d". Durations are Go
+// durations or a number of days.
+func ParseRetentionRule(s string) (RetentionRule, error) {
+	var rule RetentionRule
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return rule, errors.Errorf("invalid retention rule %q, expected key=value pairs", s)
+		}
+		switch key {
+		case "keepLast":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return rule, errors.Errorf("invalid keepLast %q in retention rule %q", value, s)
+			}
+			rule.KeepLast = n
+		case "groupBy":
+			rule.GroupBy = value
+		case "olderThan":
+			d, err := parseAge(value)
+			if err != nil || d <= 0 {
+				return rule, errors.Errorf("invalid olderThan %q in retention rule %q", value, s)
+			}
+			rule.OlderThan = d
+		default:
+			if rule.Tags == nil {
+				rule.Tags = make(map[string]string)
+			}
+			rule.Tags[key] = value
+		}
+	}
+	if rule.KeepLast == 0 && rule.OlderThan == 0 {
+		return rule, errors.Errorf("retention rule %q needs keepLast or olderThan", s)
+	}
+	if rule.GroupBy != "" && rule.KeepLast == 0 {
+		return rule, errors.Errorf("retention rule %q has groupBy without keepLast", s)
+	}
+	return rule, nil
+}
+
+// ParseRetentionRules parses rules separated by semicolons, as in the
+// "retention" key of the volume snapshot location config.
+func ParseRetentionRules(s string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		rule, err := ParseRetentionRule(part)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
+
+func (r RetentionRule) String() string {
+	var parts []string
+	for key, value := range r.Tags {
+		parts = append(parts, key+"="+value)
+	}
+	sort.Strings(parts)
+	if r.KeepLast > 0 {
+		parts = append(parts, fmt.Sprintf("keepLast=%d", r.KeepLast))
+		if r.GroupBy != "" {
+			parts = append(parts, "groupBy="+r.GroupBy)
+		}
+	}
+	if r.OlderThan > 0 {
+		parts = append(parts, "olderThan="+r.OlderThan.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// PruneCandidate is a snapshot selected by a retention rule.
+type PruneCandidate struct {
+	SnapshotID        string            `json:"snapshotID"`
+	VolumeID          string            `json:"volumeID"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	// Rule is the first rule that selected the snapshot.
+	Rule string `json:"rule"`
+}
+
+// planPrune returns the snapshots of the catalog the rules select, oldest first.
+// Only snapshots that are ready are considered, and skip tells which of those
+// to leave alone.
+func planPrune(catalog *SnapshotCatalog, rules []RetentionRule, now time.Time, skip func(string) bool) []PruneCandidate {
+	selected := make(map[string]string)
+	for _, rule := range rules {
+		groups := make(map[string][]string)
+		for _, id := range catalog.SnapshotsTagged(rule.Tags) {
+			snapshot := catalog.Snapshots[id]
+			if snapshot.Phase != "" || skip(id) {
+				continue
+			}
+			groupBy := rule.GroupBy
+			if groupBy == "" {
+				groupBy = PVCTag
+			}
+			group, ok := snapshot.Tags[groupBy]
+			if !ok {
+				group = "volume:" + snapshot.VolumeID
+			}
+			groups[group] = append(groups[group], id)
+		}
+
+		for _, ids := range groups {
+			sortSnapshots(catalog, ids)
+			// The most recent snapshots come last.
+			for i, id := range ids {
+				if rule.KeepLast > 0 && i >= len(ids)-rule.KeepLast {
+					continue
+				}
+				if rule.OlderThan > 0 && now.Sub(catalog.Snapshots[id].CreationTimestamp) < rule.OlderThan {
+					continue
+				}
+				if _, ok := selected[id]; !ok {
+					selected[id] = rule.String()
+				}
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(selected))
+	for id := range selected {
+		ids = append(ids, id)
+	}
+	sortSnapshots(catalog, ids)
+	candidates := make([]PruneCandidate, 0, len(ids))
+	for _, id := range ids {
+		snapshot := catalog.Snapshots[id]
+		candidates = append(candidates, PruneCandidate{
+			SnapshotID:        id,
+			VolumeID:          snapshot.VolumeID,
+			CreationTimestamp: snapshot.CreationTimestamp,
+			Tags:              snapshot.Tags,
+			Rule:              selected[id],
+		})
+	}
+	return candidates
+}
+
+// sortSnapshots sorts snapshot IDs by creation time, oldest first.
+func sortSnapshots(catalog *SnapshotCatalog, ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := catalog.Snapshots[ids[i]].CreationTimestamp, catalog.Snapshots[ids[j]].CreationTimestamp
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+// Prune deletes the snapshots selected by the rules, or only lists them with
+// dryRun. Snapshots that fail to be deleted don't stop the others from being
+// deleted.
+func (p *NoOpVolumeSnapshotter) Prune(rules []RetentionRule, dryRun bool) ([]PruneCandidate, error) {
+	p.mu.Lock()
+	if err := p.reloadCatalog(); err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	candidates := planPrune(p.catalog, rules, time.Now(), func(id string) bool { return p.deleting[id] })
+	p.mu.Unlock()
+	if dryRun {
+		return candidates, nil
+	}
+
+	var failed []string
+	for _, candidate := range candidates {
+		log := p.WithField("snapshotID", candidate.SnapshotID).WithField("rule", candidate.Rule)
+		if err := p.DeleteSnapshot(candidate.SnapshotID); err != nil {
+			log.WithError(err).Error("Unable to prune snapshot")
+			failed = append(failed, candidate.SnapshotID)
+			continue
+		}
+		log.Info("Pruned snapshot")
+	}
+	if len(failed) > 0 {
+		return candidates, errors.Errorf("unable to prune %d of %d snapshots: %s", len(failed), len(candidates), strings.Join(failed, ", "))
+	}
+	return candidates, nil
+}
+
+// initRetention starts applying the "retention" rules of the config every
+// "retentionInterval", in the background, replacing the policy of an earlier
+// Init. With "retentionDryRun", the snapshots are only logged. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) initRetention(config map[string]string) error {
+	if p.stopRetention != nil {
+		p.stopRetention()
+		p.stopRetention = nil
+	}
+	rules, err := ParseRetentionRules(config["retention"])
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	interval := defaultRetentionInterval
+	if value := config["retentionInterval"]; value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return errors.Errorf("invalid retentionInterval %q, it must be a positive duration", value)
+		}
+	}
+	dryRun := config["retentionDryRun"] == "true"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopRetention = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			candidates, err := p.Prune(rules, dryRun)
+			if err != nil {
+				p.WithError(err).Error("Retention policy failed")
+			}
+			if dryRun {
+				for _, candidate := range candidates {
+					p.WithField("snapshotID", candidate.SnapshotID).WithField("rule", candidate.Rule).Info("Snapshot would be pruned")
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
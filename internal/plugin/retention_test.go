@@ -0,0 +1,180 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	rule, err := ParseRetentionRule("velero.io/schedule-name=daily, olderThan=30d")
+	require.NoError(t, err)
+	assert.Equal(t, RetentionRule{Tags: map[string]string{"velero.io/schedule-name": "daily"}, OlderThan: 30 * 24 * time.Hour}, rule)
+	assert.Equal(t, "velero.io/schedule-name=daily,olderThan=720h0m0s", rule.String())
+
+	rule, err = ParseRetentionRule("keepLast=2,groupBy=velero.io/pv,olderThan=1h30m")
+	require.NoError(t, err)
+	assert.Equal(t, RetentionRule{KeepLast: 2, GroupBy: "velero.io/pv", OlderThan: 90 * time.Minute}, rule)
+
+	for _, invalid := range []string{"", "keepLast", "keepLast=-1", "olderThan=soon", "velero.io/backup=b1", "groupBy=velero.io/pv,olderThan=1h"} {
+		_, err := ParseRetentionRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	rules, err := ParseRetentionRules("keepLast=1; olderThan=1h;")
+	require.NoError(t, err)
+	assert.Len(t, rules, 2)
+}
+
+func TestPlanPrune(t *testing.T) {
+	now := time.Date(2023, 3, 21, 0, 0, 0, 0, time.UTC)
+	catalog := NewSnapshotCatalog()
+	add := func(id string, age time.Duration, tags map[string]string) {
+		catalog.Snapshots[id] = Snapshot{VolumeID: "hostPath:/" + id[:1], CreationTimestamp: now.Add(-age), Tags: tags}
+	}
+	daily := func(pvc string) map[string]string {
+		return map[string]string{PVCTag: pvc, "velero.io/schedule-name": "daily"}
+	}
+	add("a1", 72*time.Hour, daily("ns/a"))
+	add("a2", 48*time.Hour, daily("ns/a"))
+	add("a3", 24*time.Hour, daily("ns/a"))
+	add("b1", 72*time.Hour, daily("ns/b"))
+	// Snapshots without a PVC are grouped by volume.
+	add("c1", 2*time.Hour, nil)
+	add("c2", time.Hour, nil)
+	catalog.indexTags()
+
+	ids := func(candidates []PruneCandidate) []string {
+		var ids []string
+		for _, candidate := range candidates {
+			ids = append(ids, candidate.SnapshotID)
+		}
+		return ids
+	}
+	none := func(string) bool { return false }
+	plan := func(rules ...string) []string {
+		var parsed []RetentionRule
+		for _, rule := range rules {
+			r, err := ParseRetentionRule(rule)
+			require.NoError(t, err)
+			parsed = append(parsed, r)
+		}
+		return ids(planPrune(catalog, parsed, now, none))
+	}
+
+	assert.Equal(t, []string{"a1", "a2", "c1"}, plan("keepLast=1"))
+	assert.Equal(t, []string{"a1"}, plan("keepLast=1,olderThan=60h"))
+	assert.Equal(t, []string{"a1", "b1", "a2"}, plan("velero.io/schedule-name=daily,olderThan=2d"))
+	assert.Equal(t, []string{"a1", "b1", "a2", "c1"}, plan("keepLast=1,groupBy=velero.io/schedule-name"))
+	assert.Equal(t, []string{"a1", "b1", "a2", "c1"}, plan("olderThan=3d", "keepLast=1,groupBy=example.io/none"))
+	assert.Empty(t, plan("velero.io/schedule-name=weekly,olderThan=1h"))
+
+	candidates := planPrune(catalog, []RetentionRule{{KeepLast: 1}}, now, func(id string) bool { return id == "a1" })
+	assert.Equal(t, []string{"a2", "c1"}, ids(candidates))
+	assert.Equal(t, "keepLast=1", candidates[0].Rule)
+
+	// Snapshots that aren't ready are left alone.
+	snapshot := catalog.Snapshots["c1"]
+	snapshot.Phase = PhaseFailed
+	catalog.Snapshots["c1"] = snapshot
+	assert.Equal(t, []string{"a1"}, plan("keepLast=2"))
+}
+
+func TestPruneSnapshotsByPVC(t *testing.T) {
+	stateDir := t.TempDir()
+	p := newTestSnapshotter(t, map[string]string{"stateDir": stateDir})
+	dir := newTestVolume(t)
+
+	pv := newTestPV(t, v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: dir}})
+	pv.UnstructuredContent()["spec"].(map[string]interface{})["claimRef"] = map[string]interface{}{"namespace": "ns", "name": "data"}
+	volumeID, err := p.GetVolumeID(pv)
+	require.NoError(t, err)
+
+	var snapshots []string
+	for _, backup := range []string{"b1", "b2", "b3"} {
+		snapshotID, err := p.CreateSnapshot(volumeID, "", map[string]string{"velero.io/backup": backup})
+		require.NoError(t, err)
+		snapshots = append(snapshots, snapshotID)
+		assert.Equal(t, "ns/data", p.catalog.Snapshots[snapshotID].Tags[PVCTag])
+	}
+
+	// The index is saved with the catalog.
+	catalog, err := LoadSnapshotCatalog(stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{snapshots[1]}, catalog.SnapshotsTagged(map[string]string{"velero.io/backup": "b2", PVCTag: "ns/data"}))
+	assert.ElementsMatch(t, snapshots, catalog.Tags[PVCTag]["ns/data"])
+
+	rule := RetentionRule{KeepLast: 1}
+	candidates, err := p.Prune([]RetentionRule{rule}, true)
+	require.NoError(t, err)
+	assert.Len(t, candidates, 2)
+	assert.Len(t, p.catalog.Snapshots, 3)
+
+	candidates, err = p.Prune([]RetentionRule{rule}, false)
+	require.NoError(t, err)
+	assert.Len(t, candidates, 2)
+	assert.Equal(t, []string{snapshots[2]}, p.catalog.SnapshotsTagged(nil))
+	for _, snapshotID := range snapshots[:2] {
+		_, err := os.Stat(p.local.dataDir(snapshotID))
+		assert.True(t, os.IsNotExist(err))
+	}
+	catalog, err = LoadSnapshotCatalog(stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"ns/data": {snapshots[2]}}, catalog.Tags[PVCTag])
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	stateDir := t.TempDir()
+	dir := newTestVolume(t)
+	p := newTestSnapshotter(t, map[string]string{"stateDir": stateDir})
+	var snapshots []string
+	for i := 0; i < 3; i++ {
+		snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+		require.NoError(t, err)
+		snapshots = append(snapshots, snapshotID)
+	}
+
+	config := map[string]string{"stateDir": stateDir, "retention": "keepLast=2", "retentionDryRun": "true"}
+	require.NoError(t, p.Init(config))
+	time.Sleep(50 * time.Millisecond)
+	p.mu.Lock()
+	assert.Len(t, p.catalog.Snapshots, 3)
+	p.mu.Unlock()
+
+	config["retentionDryRun"] = "false"
+	config["retentionInterval"] = "10ms"
+	require.NoError(t, p.Init(config))
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.catalog.Snapshots[snapshots[0]]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p.mu.Lock()
+	assert.Len(t, p.catalog.Snapshots, 2)
+	p.mu.Unlock()
+
+	assert.Error(t, p.Init(map[string]string{"stateDir": stateDir, "retention": "keepLast=x"}))
+	assert.Error(t, p.Init(map[string]string{"stateDir": stateDir, "retention": "keepLast=1", "retentionInterval": "0s"}))
+}
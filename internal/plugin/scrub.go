@@ -0,0 +1,293 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Problems reported by the Scrubber.
+const (
+	ScrubMissingObject    = "MissingObject"
+	ScrubMissingChecksum  = "MissingChecksum"
+	ScrubChecksumMismatch = "ChecksumMismatch"
+	ScrubUnreadable       = "Unreadable"
+)
+
+var scrubProblems = []string{ScrubMissingObject, ScrubMissingChecksum, ScrubChecksumMismatch, ScrubUnreadable}
+
+// ScrubReportKey is where the report of the last scrub is written, relative to
+// the backup storage location prefix. Velero reserves the plugins/ directory for
+// data owned by plugins, so the report doesn't trip its layout validation.
+const ScrubReportKey = "plugins/example.io/scrub-report.json"
+
+// ScrubFinding describes a single problem found in a stored backup.
+type ScrubFinding struct {
+	Backup  string `json:"backup"`
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// ScrubReport is the outcome of one pass over a backup storage location.
+type ScrubReport struct {
+	Bucket          string         `json:"bucket"`
+	Prefix          string         `json:"prefix,omitempty"`
+	StartTime       time.Time      `json:"startTime"`
+	CompletionTime  time.Time      `json:"completionTime"`
+	BackupsScanned  int            `json:"backupsScanned"`
+	ObjectsVerified int            `json:"objectsVerified"`
+	Findings        []ScrubFinding `json:"findings"`
+}
+
+var (
+	scrubFindings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "velero_plugin_example",
+		Subsystem: "scrub",
+		Name:      "findings",
+		Help:      "Number of problems found by the last scrub, by problem.",
+	}, []string{"bucket", "problem"})
+	scrubBackups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "velero_plugin_example",
+		Subsystem: "scrub",
+		Name:      "backups_scanned",
+		Help:      "Number of backups checked by the last scrub.",
+	}, []string{"bucket"})
+	scrubLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "velero_plugin_example",
+		Subsystem: "scrub",
+		Name:      "last_completion_timestamp_seconds",
+		Help:      "Time the last scrub completed, in seconds since the epoch.",
+	}, []string{"bucket"})
+	scrubDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "velero_plugin_example",
+		Subsystem: "scrub",
+		Name:      "duration_seconds",
+		Help:      "How long the last scrub took.",
+	}, []string{"bucket"})
+)
+
+// ScrubCollectors returns the metrics updated by the Scrubber so that they can be
+// registered with a Prometheus registry.
+func ScrubCollectors() []prometheus.Collector {
+	return []prometheus.Collector{scrubFindings, scrubBackups, scrubLastRun, scrubDuration}
+}
+
+// Scrubber re-verifies the backups kept in a FileObjectStore bucket, so that
+// corruption is found before a restore needs the data.
+type Scrubber struct {
+	log    logrus.FieldLogger
+	store  *FileObjectStore
+	bucket string
+	prefix string
+}
+
+// NewScrubber instantiates a Scrubber for the backups under the given bucket and prefix.
+func NewScrubber(log logrus.FieldLogger, store *FileObjectStore, bucket, prefix string) *Scrubber {
+	return &Scrubber{
+		log:    log.WithFields(logrus.Fields{"bucket": bucket, "prefix": prefix}),
+		store:  store,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// Run scrubs the bucket every interval until the context is cancelled. Errors
+// from a single pass are logged and don't stop the loop.
+func (s *Scrubber) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Scrub(); err != nil {
+			s.log.WithError(err).Error("Scrub failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scrub checks every backup once, writes the report back into the bucket and
+// updates the scrub metrics.
+func (s *Scrubber) Scrub() (*ScrubReport, error) {
+	report := &ScrubReport{
+		Bucket:    s.bucket,
+		Prefix:    s.prefix,
+		StartTime: time.Now().UTC(),
+		Findings:  []ScrubFinding{},
+	}
+	s.log.Info("Starting scrub")
+
+	backupsDir := filepath.Join(s.store.Root(), s.bucket, s.prefix, "backups")
+	entries, err := os.ReadDir(backupsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "error listing %s", backupsDir)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s.scrubBackup(report, entry.Name())
+		report.BackupsScanned++
+	}
+	report.CompletionTime = time.Now().UTC()
+
+	s.recordMetrics(report)
+	if err := s.writeReport(report); err != nil {
+		return report, err
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"backups":  report.BackupsScanned,
+		"objects":  report.ObjectsVerified,
+		"findings": len(report.Findings),
+	}).Info("Scrub complete")
+	return report, nil
+}
+
+func (s *Scrubber) scrubBackup(report *ScrubReport, backup string) {
+	prefix := path.Join(s.prefix, "backups", backup)
+	log := s.log.WithField("backup", backup)
+
+	// These are the objects Velero always uploads for a completed backup.
+	tarball := path.Join(prefix, backup+".tar.gz")
+	logs := path.Join(prefix, backup+"-logs.gz")
+	for _, key := range []string{path.Join(prefix, "velero-backup.json"), tarball, logs} {
+		if _, err := os.Stat(filepath.Join(s.store.Root(), s.bucket, key)); os.IsNotExist(err) {
+			report.Findings = append(report.Findings, ScrubFinding{Backup: backup, Key: key, Problem: ScrubMissingObject})
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.store.Root(), s.bucket, prefix))
+	if err != nil {
+		report.Findings = append(report.Findings, ScrubFinding{Backup: backup, Key: prefix, Problem: ScrubUnreadable, Detail: err.Error()})
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		key := path.Join(prefix, entry.Name())
+		log.WithField("key", key).Debug("Verifying object")
+
+		finding := s.verifyObject(key, key == tarball || key == logs, key == tarball)
+		report.ObjectsVerified++
+		if finding != nil {
+			finding.Backup = backup
+			report.Findings = append(report.Findings, *finding)
+		}
+	}
+}
+
+// verifyObject reads an object once, comparing it with its recorded checksum and,
+// for gzipped objects, making sure the whole stream decompresses.
+func (s *Scrubber) verifyObject(key string, gzipped, tarred bool) *ScrubFinding {
+	expected, err := s.store.Checksum(s.bucket, key)
+	if err != nil {
+		return &ScrubFinding{Key: key, Problem: ScrubUnreadable, Detail: err.Error()}
+	}
+
+	file, err := os.Open(filepath.Join(s.store.Root(), s.bucket, key))
+	if err != nil {
+		return &ScrubFinding{Key: key, Problem: ScrubUnreadable, Detail: err.Error()}
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	body := io.TeeReader(file, hash)
+	if gzipped {
+		if err := readGzip(body, tarred); err != nil {
+			return &ScrubFinding{Key: key, Problem: ScrubUnreadable, Detail: err.Error()}
+		}
+	}
+	// Drain whatever the decompressor left unread so the checksum covers the whole object.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return &ScrubFinding{Key: key, Problem: ScrubUnreadable, Detail: err.Error()}
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	switch {
+	case expected == "":
+		return &ScrubFinding{Key: key, Problem: ScrubMissingChecksum}
+	case expected != actual:
+		return &ScrubFinding{Key: key, Problem: ScrubChecksumMismatch, Detail: "expected " + expected + ", got " + actual}
+	}
+	return nil
+}
+
+func readGzip(r io.Reader, tarred bool) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "error opening gzip stream")
+	}
+	defer gzr.Close()
+
+	if tarred {
+		tr := tar.NewReader(gzr)
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrap(err, "error reading tar stream")
+			}
+		}
+	}
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return errors.Wrap(err, "error reading gzip stream")
+	}
+	return nil
+}
+
+func (s *Scrubber) recordMetrics(report *ScrubReport) {
+	counts := make(map[string]int)
+	for _, finding := range report.Findings {
+		counts[finding.Problem]++
+	}
+	for _, problem := range scrubProblems {
+		scrubFindings.WithLabelValues(s.bucket, problem).Set(float64(counts[problem]))
+	}
+	scrubBackups.WithLabelValues(s.bucket).Set(float64(report.BackupsScanned))
+	scrubLastRun.WithLabelValues(s.bucket).Set(float64(report.CompletionTime.Unix()))
+	scrubDuration.WithLabelValues(s.bucket).Set(report.CompletionTime.Sub(report.StartTime).Seconds())
+}
+
+func (s *Scrubber) writeReport(report *ScrubReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := path.Join(s.prefix, ScrubReportKey)
+	return errors.Wrapf(s.store.PutObject(s.bucket, key, bytes.NewReader(data)), "error writing scrub report %s", key)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStateDir = "/tmp/volume-snapshots"
+	catalogFile     = "catalog.json"
+	catalogLockFile = "catalog.lock"
+)
+
+// SnapshotCatalog is the state of a NoOpVolumeSnapshotter that has to outlive the
+// plugin process: the volumes it knows about and the snapshots it has taken.
+type SnapshotCatalog struct {
+	Volumes   map[string]Volume   `json:"volumes"`
+	Snapshots map[string]Snapshot `json:"snapshots"`
+	// Tags indexes the snapshots by tag, from tag keys to values to snapshot IDs,
+	// so that tools can find the snapshots of a backup, schedule or PVC. It's
+	// rebuilt whenever the catalog is saved.
+	Tags map[string]map[string][]string `json:"tags,omitempty"`
+}
+
+// NewSnapshotCatalog returns an empty catalog.
+func NewSnapshotCatalog() *SnapshotCatalog {
+	return &SnapshotCatalog{
+		Volumes:   make(map[string]Volume),
+		Snapshots: make(map[string]Snapshot),
+	}
+}
+
+// StateDir returns the state directory of a volume snapshot location config.
+func StateDir(config map[string]string) string {
+	if stateDir := config["stateDir"]; stateDir != "" {
+		return stateDir
+	}
+	return defaultStateDir
+}
+
+// CatalogPath returns where the catalog is kept in a state directory.
+func CatalogPath(stateDir string) string {
+	return filepath.Join(stateDir, catalogFile)
+}
+
+// LoadSnapshotCatalog reads the catalog kept in a state directory. A directory
+// without a catalog yields an empty one.
+func LoadSnapshotCatalog(stateDir string) (*SnapshotCatalog, error) {
+	data, err := ioutil.ReadFile(CatalogPath(stateDir))
+	if os.IsNotExist(err) {
+		return NewSnapshotCatalog(), nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	catalog := NewSnapshotCatalog()
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s", CatalogPath(stateDir))
+	}
+	if catalog.Volumes == nil {
+		catalog.Volumes = make(map[string]Volume)
+	}
+	if catalog.Snapshots == nil {
+		catalog.Snapshots = make(map[string]Snapshot)
+	}
+	// Catalogs saved before snapshots were indexed don't have the index.
+	catalog.indexTags()
+	return catalog, nil
+}
+
+// Save writes the catalog to a state directory. The catalog is replaced
+// atomically, so a crash leaves either the old or the new catalog behind.
+func (c *SnapshotCatalog) Save(stateDir string) error {
+	c.indexTags()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(writeFileAtomic(CatalogPath(stateDir), data), "error saving %s", CatalogPath(stateDir))
+}
+
+// UpdateSnapshotCatalog applies a change to the catalog kept in a state directory
+// and returns the changed catalog. The directory is locked while the catalog is
+// read, changed and saved, so that processes sharing it don't overwrite each
+// other's changes. The change reports whether it changed anything, as unchanged
+// catalogs aren't saved.
+func UpdateSnapshotCatalog(stateDir string, change func(*SnapshotCatalog) bool) (*SnapshotCatalog, error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lock, err := lockFile(filepath.Join(stateDir, catalogLockFile), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error locking the catalog of %s", stateDir)
+	}
+	defer lock.Close()
+
+	catalog, err := LoadSnapshotCatalog(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	if !change(catalog) {
+		return catalog, nil
+	}
+	if err := catalog.Save(stateDir); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func (c *SnapshotCatalog) indexTags() {
+	c.Tags = make(map[string]map[string][]string)
+	for id, snapshot := range c.Snapshots {
+		for key, value := range snapshot.Tags {
+			if c.Tags[key] == nil {
+				c.Tags[key] = make(map[string][]string)
+			}
+			c.Tags[key][value] = append(c.Tags[key][value], id)
+		}
+	}
+	for _, values := range c.Tags {
+		for _, ids := range values {
+			sort.Strings(ids)
+		}
+	}
+}
+
+// SnapshotsTagged returns the IDs of the snapshots that have all the given tags,
+// sorted. Without tags, it returns every snapshot.
+func (c *SnapshotCatalog) SnapshotsTagged(tags map[string]string) []string {
+	var ids []string
+	if len(tags) == 0 {
+		for id := range c.Snapshots {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// Start from the index of any of the tags, and check the others on the
+	// snapshots, which also leaves out snapshots removed since the last save.
+	for key, value := range tags {
+		ids = c.Tags[key][value]
+		break
+	}
+	var matching []string
+	for _, id := range ids {
+		snapshot, ok := c.Snapshots[id]
+		if ok && hasTags(snapshot.Tags, tags) {
+			matching = append(matching, id)
+		}
+	}
+	return matching
+}
+
+func hasTags(tags, want map[string]string) bool {
+	for key, value := range want {
+		if v, ok := tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic replaces a file by writing a temporary file next to it, syncing
+// it to disk and renaming it over the original.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
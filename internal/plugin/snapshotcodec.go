@@ -0,0 +1,475 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The compressions snapshot streams support.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// encryptionAESGCM is the only encryption of snapshot streams: AES-GCM over
+// segments of the stream.
+const encryptionAESGCM = "aes-gcm"
+
+// SnapshotEncryption records how the data of a snapshot was encrypted.
+type SnapshotEncryption struct {
+	Algorithm string `json:"algorithm"`
+	// KeyVersion is the version of the key in the keyring, which is also the
+	// suffix of the snapshot ID.
+	KeyVersion string `json:"keyVersion"`
+}
+
+// snapshotIDKeySuffix separates the version of the key a snapshot was encrypted
+// with from the rest of its ID.
+const snapshotIDKeySuffix = ".key-"
+
+// keyVersionFromID returns the version of the key a snapshot ID says the
+// snapshot was encrypted with, or an empty string.
+func keyVersionFromID(snapshotID string) string {
+	i := strings.LastIndex(snapshotID, snapshotIDKeySuffix)
+	if i < 0 || !strings.Contains(snapshotID[:i], ".snap.") {
+		return ""
+	}
+	return snapshotID[i+len(snapshotIDKeySuffix):]
+}
+
+// withoutKeyVersion returns a snapshot ID without the version of the key it
+// says the snapshot was encrypted with.
+func withoutKeyVersion(snapshotID string) string {
+	if keyVersionFromID(snapshotID) == "" {
+		return snapshotID
+	}
+	return snapshotID[:strings.LastIndex(snapshotID, snapshotIDKeySuffix)]
+}
+
+// keyVersionPattern keeps key versions usable in snapshot IDs.
+var keyVersionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// keyring holds the keys snapshots are encrypted with, by version. Keys stay in
+// the keyring after rotation, to decrypt the snapshots taken with them.
+type keyring struct {
+	keys map[string][]byte
+	// current is the version of the key new snapshots are encrypted with.
+	current string
+}
+
+// The encodings of keys. Keys files hold base64 keys, and Secrets raw keys
+// unless "encryptionKeySecretEncoding" says otherwise.
+const (
+	keyEncodingRaw    = "raw"
+	keyEncodingBase64 = "base64"
+)
+
+// loadKeyring reads the keys named by the volume snapshot location config, from
+// the file of "encryptionKeyFile" or the Secret of "encryptionKeySecret". It
+// returns nil if neither is set.
+func loadKeyring(config map[string]string, getClient func() (kubernetes.Interface, error)) (*keyring, error) {
+	file, secret := config["encryptionKeyFile"], config["encryptionKeySecret"]
+	secretEncoding := config["encryptionKeySecretEncoding"]
+	if secretEncoding != "" && secret == "" {
+		return nil, errors.New("encryptionKeySecretEncoding needs encryptionKeySecret")
+	}
+	var keys map[string][]byte
+	var encoding string
+	var err error
+	switch {
+	case file != "" && secret != "":
+		return nil, errors.New("set only one of encryptionKeyFile and encryptionKeySecret")
+	case file != "":
+		keys, err = readKeyFile(file)
+		encoding = keyEncodingBase64
+	case secret != "":
+		keys, err = readKeySecret(secret, getClient)
+		encoding = keyEncodingRaw
+		if secretEncoding != "" {
+			encoding = secretEncoding
+		}
+	default:
+		if config["encryptionKeyVersion"] != "" {
+			return nil, errors.New("encryptionKeyVersion needs encryptionKeyFile or encryptionKeySecret")
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{keys: make(map[string][]byte), current: config["encryptionKeyVersion"]}
+	for version, key := range keys {
+		if !keyVersionPattern.MatchString(version) {
+			return nil, errors.Errorf("invalid key version %q, use letters, digits, - and _", version)
+		}
+		if key, err = decodeKey(key, encoding); err != nil {
+			return nil, errors.Wrapf(err, "invalid key %s", version)
+		}
+		k.keys[version] = key
+	}
+	if k.current == "" {
+		if len(k.keys) != 1 {
+			return nil, errors.Errorf("set encryptionKeyVersion to the key to encrypt snapshots with, one of: %s", strings.Join(k.versions(), ", "))
+		}
+		for version := range k.keys {
+			k.current = version
+		}
+	}
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, errors.Errorf("encryptionKeyVersion %q isn't in the keyring, which has: %s", k.current, strings.Join(k.versions(), ", "))
+	}
+	return k, nil
+}
+
+// readKeyFile reads a file of <version>=<base64 key> lines. Empty lines and
+// lines starting with # are skipped.
+func readKeyFile(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading encryptionKeyFile")
+	}
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		version, key, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, errors.Errorf("%s:%d: expected <version>=<base64 key>", path, n)
+		}
+		keys[strings.TrimSpace(version)] = []byte(strings.TrimSpace(key))
+	}
+	return keys, nil
+}
+
+// readKeySecret reads the keys of a Secret named <namespace>/<name>, or <name>
+// in Velero's namespace. Every entry is a key, named by its version.
+func readKeySecret(ref string, getClient func() (kubernetes.Interface, error)) (map[string][]byte, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		namespace, name = os.Getenv("VELERO_NAMESPACE"), ref
+		if namespace == "" {
+			namespace = "velero"
+		}
+	}
+	client, err := getClient()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading encryptionKeySecret %s/%s", namespace, name)
+	}
+	return secret.Data, nil
+}
+
+// decodeKey decodes an AES key of the given encoding. Keys aren't guessed to be
+// base64 or raw, as raw keys can be valid base64 too.
+func decodeKey(key []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case keyEncodingRaw:
+	case keyEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+		if err != nil {
+			return nil, errors.New("keys must be base64-encoded")
+		}
+		key = decoded
+	default:
+		return nil, errors.Errorf("unsupported key encoding %q, use raw or base64", encoding)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, errors.Errorf("keys must be 16, 24 or 32 bytes once decoded from %s", encoding)
+	}
+	return key, nil
+}
+
+func (k *keyring) versions() []string {
+	versions := make([]string, 0, len(k.keys))
+	for version := range k.keys {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// aead returns the cipher of a version of the key.
+func (k *keyring) aead(version string) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, errors.Errorf("the data is encrypted with key version %s, but no encryptionKeyFile or encryptionKeySecret is configured", version)
+	}
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, errors.Errorf("the data is encrypted with key version %s, which isn't in the keyring anymore", version)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// newCompressWriter compresses what's written to it into w.
+func newCompressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "":
+		return nopWriteCloser{w}, nil
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, errors.Errorf("unsupported compression %q, use gzip or zstd", compression)
+}
+
+// newDecompressReader decompresses what's read from r.
+func newDecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return io.NopCloser(r), nil
+	case compressionGzip:
+		gz, err := gzip.NewReader(r)
+		return gz, errors.WithStack(err)
+	case compressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, errors.Errorf("unsupported compression %q", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Encrypted streams are split into segments of segmentSize bytes, each sealed
+// with AES-GCM on its own so that the stream can be decrypted as it's read. The
+// nonce of a segment is the random prefix written at the start of the stream,
+// the number of the segment, and whether it's the last one, so that segments
+// can't be reordered, dropped or truncated without decryption failing.
+const (
+	segmentSize     = 64 << 10
+	noncePrefixSize = 7
+)
+
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts what's written to it into w. Close seals the last
+// segment and must be called for the stream to be complete.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD) (*encryptWriter, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// A full segment is only sealed once more data comes, as the last
+		// segment is sealed differently.
+		if len(e.buf) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.prefix, e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader decrypts a stream written by an encryptWriter.
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	plain  []byte
+	done   bool
+}
+
+func newDecryptReader(r io.Reader, aead cipher.AEAD) (*decryptReader, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrap(err, "error reading the header of the encrypted stream")
+	}
+	return &decryptReader{r: bufio.NewReaderSize(r, segmentSize+aead.Overhead()+1), aead: aead, prefix: prefix}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	sealed := make([]byte, segmentSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	switch err {
+	case nil:
+		// A full segment is the last one if nothing follows it.
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+	case io.ErrUnexpectedEOF, io.EOF:
+		d.done = true
+	default:
+		return errors.WithStack(err)
+	}
+
+	plain, err := d.aead.Open(sealed[:0], segmentNonce(d.prefix, d.n, d.done), sealed[:n], nil)
+	if err != nil {
+		return errors.Errorf("segment %d of the encrypted stream is corrupt, truncated or encrypted with another key", d.n)
+	}
+	d.n++
+	d.plain = plain
+	return nil
+}
+
+// streamEncoding is how the tar stream of a snapshot is compressed and
+// encrypted.
+type streamEncoding struct {
+	compression string
+	encryption  *SnapshotEncryption
+}
+
+// encode returns a writer that compresses and then encrypts into w. Closing it
+// completes the stream, but doesn't close w.
+func (e streamEncoding) encode(w io.Writer, keys *keyring) (io.WriteCloser, error) {
+	var closers []io.Closer
+	if e.encryption != nil {
+		aead, err := keys.aead(e.encryption.KeyVersion)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := newEncryptWriter(w, aead)
+		if err != nil {
+			return nil, err
+		}
+		w = enc
+		closers = append(closers, enc)
+	}
+	cw, err := newCompressWriter(w, e.compression)
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, cw)
+	return &stackedWriter{Writer: cw, closers: closers}, nil
+}
+
+// decode returns a reader of the tar stream in r.
+func (e streamEncoding) decode(r io.Reader, keys *keyring) (io.ReadCloser, error) {
+	if e.encryption != nil {
+		if e.encryption.Algorithm != encryptionAESGCM {
+			return nil, errors.Errorf("unsupported encryption %q", e.encryption.Algorithm)
+		}
+		aead, err := keys.aead(e.encryption.KeyVersion)
+		if err != nil {
+			return nil, err
+		}
+		if r, err = newDecryptReader(r, aead); err != nil {
+			return nil, err
+		}
+	}
+	return newDecompressReader(r, e.compression)
+}
+
+// stackedWriter closes a stack of writers from the top, each flushing into the
+// one below.
+type stackedWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *stackedWriter) Close() error {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamEncodingRoundTrip(t *testing.T) {
+	keys := &keyring{keys: map[string][]byte{"v1": make([]byte, 32)}, current: "v1"}
+	encryption := &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v1"}
+
+	random := make([]byte, 3*segmentSize+123)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	inputs := map[string][]byte{
+		"empty":        nil,
+		"one segment":  bytes.Repeat([]byte("a"), segmentSize),
+		"two segments": bytes.Repeat([]byte("b"), 2*segmentSize),
+		"random":       random,
+	}
+
+	for _, compression := range []string{"", compressionGzip, compressionZstd} {
+		for _, encryption := range []*SnapshotEncryption{nil, encryption} {
+			encoding := streamEncoding{compression: compression, encryption: encryption}
+			for name, input := range inputs {
+				var buf bytes.Buffer
+				w, err := encoding.encode(&buf, keys)
+				require.NoError(t, err)
+				_, err = w.Write(input)
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+
+				r, err := encoding.decode(bytes.NewReader(buf.Bytes()), keys)
+				require.NoError(t, err)
+				output, err := io.ReadAll(r)
+				require.NoError(t, err, "%s %v %s", compression, encryption, name)
+				assert.Equal(t, len(input), len(output), "%s %v %s", compression, encryption, name)
+				assert.True(t, bytes.Equal(input, output), "%s %v %s", compression, encryption, name)
+			}
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	keys := &keyring{keys: map[string][]byte{"v1": key, "v2": bytes.Repeat([]byte{1}, 32)}}
+	encoding := streamEncoding{encryption: &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v1"}}
+
+	var buf bytes.Buffer
+	w, err := encoding.encode(&buf, keys)
+	require.NoError(t, err)
+	_, err = w.Write(bytes.Repeat([]byte("data"), segmentSize))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	sealed := buf.Bytes()
+
+	decrypt := func(data []byte, encoding streamEncoding) error {
+		r, err := encoding.decode(bytes.NewReader(data), keys)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+	require.NoError(t, decrypt(sealed, encoding))
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	assert.Error(t, decrypt(flipped, encoding))
+
+	// Dropping whole segments is caught as well as cutting one short.
+	segment := segmentSize + 16
+	assert.Error(t, decrypt(sealed[:noncePrefixSize+segment], encoding))
+	assert.Error(t, decrypt(sealed[:len(sealed)-1], encoding))
+
+	wrongKey := streamEncoding{encryption: &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v2"}}
+	assert.Error(t, decrypt(sealed, wrongKey))
+	missingKey := streamEncoding{encryption: &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v3"}}
+	assert.Error(t, decrypt(sealed, missingKey))
+}
+
+func TestKeyVersionFromID(t *testing.T) {
+	assert.Equal(t, "v2", keyVersionFromID("hostPath:/data.snap.42.key-v2"))
+	assert.Equal(t, "", keyVersionFromID("hostPath:/data.snap.42"))
+	assert.Equal(t, "", keyVersionFromID("hostPath:/my.key-dir.snap.42"))
+}
+
+func TestSnapshotEncoding(t *testing.T) {
+	encrypted := Snapshot{Compression: compressionZstd, Encryption: &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v2"}}
+	encoding, err := snapshotEncoding("hostPath:/data.snap.42.key-v2", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, streamEncoding{compression: compressionZstd, encryption: encrypted.Encryption}, encoding)
+
+	// The ID stands in for encryption missing from the catalog...
+	encoding, err = snapshotEncoding("hostPath:/data.snap.42.key-v2", Snapshot{})
+	require.NoError(t, err)
+	assert.Equal(t, &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v2"}, encoding.encryption)
+
+	// ...and has to agree with the catalog otherwise.
+	_, err = snapshotEncoding("hostPath:/data.snap.42.key-v1", encrypted)
+	assert.ErrorContains(t, err, "key version v2 according to the catalog, but its ID says v1")
+
+	encoding, err = snapshotEncoding("hostPath:/data.snap.42", Snapshot{})
+	require.NoError(t, err)
+	assert.Nil(t, encoding.encryption)
+}
+
+func TestDecodeKey(t *testing.T) {
+	// Raw keys may be valid base64 too, which is why the encoding is explicit.
+	raw := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	encoded := []byte(base64.StdEncoding.EncodeToString(raw) + "\n")
+
+	for name, test := range map[string]struct {
+		key      []byte
+		encoding string
+		want     []byte
+		err      string
+	}{
+		"raw":             {key: raw, encoding: keyEncodingRaw, want: raw},
+		"base64":          {key: encoded, encoding: keyEncodingBase64, want: raw},
+		"base64 kept raw": {key: encoded, encoding: keyEncodingRaw, err: "keys must be 16, 24 or 32 bytes once decoded from raw"},
+		"raw decoded":     {key: []byte("not base64!"), encoding: keyEncodingBase64, err: "keys must be base64-encoded"},
+		"wrong size":      {key: []byte("short"), encoding: keyEncodingRaw, err: "keys must be 16, 24 or 32 bytes"},
+		"unsupported":     {key: raw, encoding: "hex", err: `unsupported key encoding "hex"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, err := decodeKey(test.key, test.encoding)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, key)
+		})
+	}
+}
@@ -0,0 +1,353 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// copyOptions tunes how copyTree copies a directory tree.
+type copyOptions struct {
+	// linkDest is a previous copy of the same tree. Files that haven't changed
+	// since are hardlinked to it instead of being copied.
+	linkDest string
+	// compareContent also compares the content of files before hardlinking them,
+	// instead of trusting their size, modification time, mode and ownership.
+	compareContent bool
+	// manifest, if set, gets an entry for everything copied. The hashes of files
+	// hardlinked to linkDest are taken from previous, the manifest of linkDest,
+	// when it has them.
+	manifest *SnapshotManifest
+	previous map[string]ManifestEntry
+	// job paces the copy of files, if it's set.
+	job *copyJob
+	// reflink clones files rather than copying their data, if it's set and the
+	// filesystems support it.
+	reflink *reflinker
+}
+
+// copyStats summarizes a copy of a directory tree.
+type copyStats struct {
+	Files    int64
+	Dirs     int64
+	Symlinks int64
+	Bytes    int64
+	// LinkedFiles and LinkedBytes count the files hardlinked to linkDest.
+	LinkedFiles int64
+	LinkedBytes int64
+	// ReflinkedFiles and ReflinkedBytes count the files cloned rather than
+	// copied.
+	ReflinkedFiles int64
+	ReflinkedBytes int64
+}
+
+// The strategies a copy uses for the data of files.
+const (
+	strategyCopy     = "copy"
+	strategyHardlink = "hardlink"
+	strategyReflink  = "reflink"
+	strategyStream   = "stream"
+)
+
+// strategy describes how the data of files was copied, joining the strategies
+// used with "+".
+func (s copyStats) strategy() string {
+	var strategies []string
+	if s.LinkedFiles > 0 {
+		strategies = append(strategies, strategyHardlink)
+	}
+	if s.ReflinkedFiles > 0 {
+		strategies = append(strategies, strategyReflink)
+	}
+	if s.Files > s.LinkedFiles+s.ReflinkedFiles || len(strategies) == 0 {
+		strategies = append(strategies, strategyCopy)
+	}
+	return strings.Join(strategies, "+")
+}
+
+// copyTree copies the directory tree at src to dst, which must not exist yet.
+// Modes, ownership, symlinks, extended attributes and modification times are
+// preserved where the platform and our privileges allow it. Sockets, devices and
+// named pipes are skipped.
+//
+// Files hardlinked to opts.linkDest share their inode, and so their content and
+// metadata, with it. Neither copy may ever be modified in place.
+func copyTree(log logrus.FieldLogger, src, dst string, opts copyOptions) (copyStats, error) {
+	var stats copyStats
+
+	// Directories get their metadata once everything in them has been copied, as
+	// copying changes their modification time and their mode may not allow it.
+	type dir struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []dir
+
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if opts.job.excluded(rel) {
+			return skipEntry(entry)
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir{target, info})
+			stats.Dirs++
+			opts.manifest.add(newManifestEntry(rel, info, ""))
+			return nil
+		case mode.IsRegular():
+			stats.Files++
+			stats.Bytes += info.Size()
+			entry := newManifestEntry(rel, info, "")
+			if opts.linkDest != "" {
+				linked, err := linkUnchanged(path, filepath.Join(opts.linkDest, rel), target, info, opts.compareContent)
+				if err != nil {
+					return err
+				}
+				if linked {
+					stats.LinkedFiles++
+					stats.LinkedBytes += info.Size()
+					if opts.manifest != nil {
+						if entry.SHA256, err = linkedFileHash(target, opts.previous[entry.Path]); err != nil {
+							return err
+						}
+						opts.manifest.add(entry)
+					}
+					return nil
+				}
+			}
+			sum, cloned, err := copyFile(path, target, opts)
+			if err != nil {
+				return err
+			}
+			if cloned {
+				stats.ReflinkedFiles++
+				stats.ReflinkedBytes += info.Size()
+			}
+			entry.SHA256 = hex.EncodeToString(sum)
+			opts.manifest.add(entry)
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			stats.Symlinks++
+			opts.manifest.add(newManifestEntry(rel, info, link))
+		default:
+			log.WithField("path", path).Warnf("Skipping %s, only regular files, directories and symlinks are copied", mode.Type())
+			return nil
+		}
+
+		return copyMetadata(log, path, target, info)
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "error copying %s to %s", src, dst)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		source := filepath.Join(src, mustRel(dst, dirs[i].path))
+		if err := copyMetadata(log, source, dirs[i].path, dirs[i].info); err != nil {
+			return stats, errors.Wrapf(err, "error copying %s to %s", src, dst)
+		}
+	}
+
+	return stats, nil
+}
+
+// copyFile copies a file, cloning it if opts.reflink can, and returns the
+// SHA-256 of what it copied and whether it was cloned. Cloned files are only
+// hashed for opts.manifest.
+func copyFile(src, dst string, opts copyOptions) ([]byte, bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if opts.reflink.clone(out, in) {
+		if opts.manifest == nil {
+			return nil, true, out.Close()
+		}
+		// Cloning doesn't move the offset of in.
+		if _, err := io.Copy(hash, opts.job.reader(in)); err != nil {
+			return nil, true, err
+		}
+		return hash.Sum(nil), true, out.Close()
+	}
+	if _, err := io.Copy(io.MultiWriter(opts.job.writer(out), hash), opts.job.reader(in)); err != nil {
+		return nil, false, err
+	}
+	return hash.Sum(nil), false, out.Close()
+}
+
+// reflinker clones files with cloneFile, until the filesystems turn out not to
+// support it. A nil reflinker never clones.
+type reflinker struct {
+	log         logrus.FieldLogger
+	cloneFile   func(dst, src *os.File) error
+	unsupported bool
+}
+
+func newReflinker(log logrus.FieldLogger, cloneFile func(dst, src *os.File) error) *reflinker {
+	if cloneFile == nil {
+		return nil
+	}
+	return &reflinker{log: log, cloneFile: cloneFile}
+}
+
+// clone makes dst share the data of src, and reports whether it did. Once a
+// clone fails, files are copied instead.
+func (r *reflinker) clone(dst, src *os.File) bool {
+	if r == nil || r.unsupported {
+		return false
+	}
+	if err := r.cloneFile(dst, src); err != nil {
+		r.log.WithError(err).WithField("path", src.Name()).Debug("Unable to clone files, copying them instead")
+		r.unsupported = true
+		return false
+	}
+	return true
+}
+
+// linkedFileHash returns the SHA-256 of a file hardlinked to a previous copy,
+// from the manifest entry of that copy if it has one of the same size.
+func linkedFileHash(path string, previous ManifestEntry) (string, error) {
+	if info, err := os.Lstat(path); err == nil && previous.SHA256 != "" && previous.Size == info.Size() {
+		return previous.SHA256, nil
+	}
+	sum, err := hashFile(path)
+	return hex.EncodeToString(sum), err
+}
+
+// linkUnchanged hardlinks target to previous if it's a copy of path that hasn't
+// changed since. Changes to only the extended attributes of a file go unnoticed.
+func linkUnchanged(path, previous, target string, info fs.FileInfo, compareContent bool) (bool, error) {
+	previousInfo, err := os.Lstat(previous)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !previousInfo.Mode().IsRegular() || !sameFileMetadata(info, previousInfo) {
+		return false, nil
+	}
+
+	if compareContent {
+		same, err := sameContent(path, previous)
+		if err != nil || !same {
+			return false, err
+		}
+	}
+
+	// Fall back to copying, e.g. when the file has as many links as the file system allows.
+	return os.Link(previous, target) == nil, nil
+}
+
+func sameContent(a, b string) (bool, error) {
+	hashA, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashA, hashB), nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func mustRel(base, target string) string {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		panic(err)
+	}
+	return rel
+}
+
+// skipEntry leaves an entry out of a walk, with everything below it if it's a
+// directory.
+func skipEntry(entry fs.DirEntry) error {
+	if entry.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// removeTree removes a directory tree copied by copyTree. Copies keep the modes
+// of the original, so directories that don't allow their entries to be removed
+// are made writable first.
+func removeTree(path string) error {
+	if err := os.RemoveAll(path); err == nil {
+		return nil
+	}
+
+	filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return errors.WithStack(os.RemoveAll(path))
+}
@@ -0,0 +1,321 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// exportFormat is the version of the layout of exported snapshots.
+	exportFormat = 1
+	// exportDescriptionName is the first entry of an exported snapshot, and
+	// manifestName the second one. The directory tree of the volume follows,
+	// under exportDataDir.
+	exportDescriptionName = "snapshot.json"
+	exportDataDir         = "data"
+)
+
+// SnapshotExport describes an exported snapshot.
+type SnapshotExport struct {
+	Format            int               `json:"format"`
+	SnapshotID        string            `json:"snapshotID"`
+	VolumeID          string            `json:"volumeID"`
+	AZ                string            `json:"az,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Size              int64             `json:"size"`
+}
+
+// ExportSnapshot writes a snapshot to w as a tar stream that describes itself:
+// snapshot.json, then manifest.json, then the directory tree of the volume with
+// its metadata under data/. The stream is compressed with compression, gzip or
+// zstd, if it's set. It can be read by tar, and by ImportSnapshot.
+func (p *NoOpVolumeSnapshotter) ExportSnapshot(snapshotID string, w io.Writer, compression string) error {
+	snapshot, store, err := p.acquireSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	defer p.releaseReader(snapshotID)
+
+	entries, err := snapshotFiles(store, snapshotID, snapshot)
+	if err != nil {
+		return err
+	}
+	cw, err := newCompressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	description := SnapshotExport{
+		Format:            exportFormat,
+		SnapshotID:        snapshotID,
+		VolumeID:          snapshot.VolumeID,
+		AZ:                snapshot.AZ,
+		Tags:              snapshot.Tags,
+		CreationTimestamp: snapshot.CreationTimestamp,
+		Size:              snapshot.Size,
+	}
+	if err := writeTarJSON(tw, exportDescriptionName, description); err != nil {
+		return errors.Wrapf(err, "error exporting snapshot %s", snapshotID)
+	}
+	if err := writeTarJSON(tw, manifestName, SnapshotManifest{Entries: entries}); err != nil {
+		return errors.Wrapf(err, "error exporting snapshot %s", snapshotID)
+	}
+
+	r, err := store.Open(snapshotID, snapshot)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reading snapshot %s", snapshotID)
+		}
+		name := path.Join(exportDataDir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "error exporting snapshot %s", snapshotID)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "error exporting snapshot %s", snapshotID)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrapf(err, "error exporting snapshot %s", snapshotID)
+	}
+	return errors.Wrapf(cw.Close(), "error exporting snapshot %s", snapshotID)
+}
+
+func writeTarJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now().UTC(), Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func readTarJSON(tr *tar.Reader, name string, v interface{}) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", name)
+	}
+	if path.Clean(hdr.Name) != name {
+		return errors.Errorf("expected %s, found %s, this isn't an exported snapshot", name, hdr.Name)
+	}
+	return errors.Wrapf(json.NewDecoder(tr).Decode(v), "error decoding %s", name)
+}
+
+// detectCompression tells how a stream is compressed from its first bytes.
+func detectCompression(r *bufio.Reader) string {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return compressionGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return compressionZstd
+	}
+	return ""
+}
+
+// ImportSnapshot registers a snapshot written by ExportSnapshot in the catalog,
+// under its original ID and with its original tags, so that volumes can be
+// created from it. Its data goes where new snapshots go, and is checked against
+// the exported manifest first. The compression of the stream is detected.
+// Snapshots can't be imported in dry run mode, which would drop their data.
+//
+// The version of the key the exported snapshot was encrypted with, if its ID
+// ends with one, is replaced by the version of the key it's encrypted with now,
+// if any. ImportSnapshot returns the resulting ID.
+func (p *NoOpVolumeSnapshotter) ImportSnapshot(r io.Reader) (string, error) {
+	p.mu.Lock()
+	dryRun := p.config["dryRun"] == "true"
+	p.mu.Unlock()
+	if dryRun {
+		return "", errors.New("snapshots can't be imported in dry run mode, as their data would be dropped")
+	}
+
+	br := bufio.NewReader(r)
+	dr, err := newDecompressReader(br, detectCompression(br))
+	if err != nil {
+		return "", errors.Wrap(err, "error reading exported snapshot")
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+
+	var description SnapshotExport
+	if err := readTarJSON(tr, exportDescriptionName, &description); err != nil {
+		return "", err
+	}
+	if description.Format != exportFormat {
+		return "", errors.Errorf("unsupported export format %d", description.Format)
+	}
+	if _, err := parseVolumeID(description.VolumeID); err != nil {
+		return "", errors.Wrapf(err, "invalid exported snapshot %s", description.SnapshotID)
+	}
+	var manifest SnapshotManifest
+	if err := readTarJSON(tr, manifestName, &manifest); err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	store, keySuffix := p.newSnapshotStore()
+	snapshotID := withoutKeyVersion(description.SnapshotID) + keySuffix
+	log := p.WithField("snapshotID", snapshotID)
+	if snapshotID != description.SnapshotID {
+		log = log.WithField("exportedSnapshotID", description.SnapshotID)
+	}
+	snapshot := Snapshot{
+		VolumeID:          description.VolumeID,
+		AZ:                description.AZ,
+		Tags:              description.Tags,
+		CreationTimestamp: description.CreationTimestamp,
+		Phase:             PhaseCreating,
+	}
+	// The snapshot is checked for under the lock of the catalog, as another
+	// process may be importing it too.
+	exists := false
+	catalog, err := UpdateSnapshotCatalog(p.stateDir, func(c *SnapshotCatalog) bool {
+		if _, exists = c.Snapshots[snapshotID]; exists {
+			return false
+		}
+		c.Snapshots[snapshotID] = snapshot
+		return true
+	})
+	if err != nil {
+		p.mu.Unlock()
+		return "", err
+	}
+	p.catalog = catalog
+	if exists {
+		p.mu.Unlock()
+		return "", errors.Errorf("snapshot %s is already in the catalog", snapshotID)
+	}
+	p.creating[snapshotID] = true
+	p.mu.Unlock()
+
+	err = p.importSnapshot(log, tr, &manifest, store, snapshotID, &snapshot)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.dataChanged.Broadcast()
+	delete(p.creating, snapshotID)
+	if err != nil {
+		p.updateCatalog(func(c *SnapshotCatalog) { delete(c.Snapshots, snapshotID) })
+		return "", errors.Wrapf(err, "error importing snapshot %s", snapshotID)
+	}
+	snapshot.Phase = ""
+	if err := p.updateCatalog(func(c *SnapshotCatalog) { c.Snapshots[snapshotID] = snapshot }); err != nil {
+		return "", err
+	}
+	log.WithField("bytes", snapshot.Size).Info("Imported snapshot")
+	return snapshotID, nil
+}
+
+// importSnapshot extracts the directory tree of an exported snapshot next to the
+// catalog, checks it against its manifest, and saves it to store.
+func (p *NoOpVolumeSnapshotter) importSnapshot(log logrus.FieldLogger, tr *tar.Reader, manifest *SnapshotManifest, store snapshotStore, snapshotID string, snapshot *Snapshot) error {
+	tmp, err := os.MkdirTemp(p.stateDir, ".import-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer removeTree(tmp)
+	dir := filepath.Join(tmp, "volume")
+
+	// The data entries are turned back into the stream of the snapshot.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(unwrapExportData(tr, pw))
+	}()
+	err = extractTarTree(log, pr, dir, nil)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	scanned, err := scanTree(dir)
+	if err != nil {
+		return err
+	}
+	if findings := compareManifest(manifest, scanned); len(findings) > 0 {
+		first := findings[0]
+		return errors.Errorf("the data doesn't match the exported manifest, %d problems, the first being %s %s: %s",
+			len(findings), first.Problem, first.Path, first.Detail)
+	}
+	_, err = store.Save(snapshotID, dir, snapshot, nil)
+	return err
+}
+
+// unwrapExportData writes the data entries of an exported snapshot to w as the
+// tar stream writeTarTree would have written.
+func unwrapExportData(tr *tar.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading exported snapshot")
+		}
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == exportDataDir:
+			name = "."
+		case strings.HasPrefix(name, exportDataDir+"/"):
+			name = strings.TrimPrefix(name, exportDataDir+"/")
+		default:
+			return errors.Errorf("exported snapshot contains %s, which is outside of %s/", hdr.Name, exportDataDir)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
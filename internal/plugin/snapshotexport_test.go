@@ -0,0 +1,149 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportSnapshot(t *testing.T) {
+	for _, compression := range []string{"", compressionGzip, compressionZstd} {
+		compression := compression
+		t.Run("compression "+compression, func(t *testing.T) {
+			p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "incremental": "true"})
+			volume := newTestVolume(t)
+			snapshotID, err := p.CreateSnapshot("hostPath:"+volume, "zone-a", map[string]string{"velero.io/backup": "b1"})
+			require.NoError(t, err)
+
+			var exported bytes.Buffer
+			require.NoError(t, p.ExportSnapshot(snapshotID, &exported, compression))
+
+			// Another cluster imports it into its own kind of store.
+			other := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "dedup": "true"})
+			imported, err := other.ImportSnapshot(bytes.NewReader(exported.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, snapshotID, imported)
+			snapshot := other.catalog.Snapshots[snapshotID]
+			assert.Equal(t, p.catalog.Snapshots[snapshotID].Tags, snapshot.Tags)
+			assert.Equal(t, "zone-a", snapshot.AZ)
+			assert.True(t, snapshot.Dedup)
+			assert.Equal(t, []string{snapshotID}, other.SnapshotIDs(map[string]string{"velero.io/backup": "b1"}))
+
+			volumeID, err := other.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+			require.NoError(t, err)
+			assert.Equal(t, readTestTree(t, volume), readTestTree(t, testVolumeDir(t, other, volumeID)))
+
+			_, err = other.ImportSnapshot(bytes.NewReader(exported.Bytes()))
+			assert.EqualError(t, err, "snapshot "+snapshotID+" is already in the catalog")
+		})
+	}
+}
+
+// TestExportImportEncryptedSnapshot imports a snapshot exported from an
+// encrypted object store, whose ID ends with the version of its key, into
+// stores that don't use that key.
+func TestExportImportEncryptedSnapshot(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "objectStore": testObjectStore,
+		"objectStoreBucket": "snapshots", "encryptionKeyFile": newTestKeyFile(t, "v1")})
+	volume := newTestVolume(t)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+volume, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "v1", keyVersionFromID(snapshotID))
+	var exported bytes.Buffer
+	require.NoError(t, p.ExportSnapshot(snapshotID, &exported, compressionGzip))
+
+	for name, test := range map[string]struct {
+		config     map[string]string
+		keyVersion string
+	}{
+		"plain store": {
+			config: map[string]string{},
+		},
+		"store encrypted with another key": {
+			config: map[string]string{"objectStore": testObjectStore, "objectStoreBucket": "imported",
+				"encryptionKeyFile": newTestKeyFile(t, "v2")},
+			keyVersion: "v2",
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test.config["stateDir"] = t.TempDir()
+			other := newTestSnapshotter(t, test.config)
+			imported, err := other.ImportSnapshot(bytes.NewReader(exported.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, withoutKeyVersion(snapshotID), withoutKeyVersion(imported))
+			assert.Equal(t, test.keyVersion, keyVersionFromID(imported))
+
+			volumeID, err := other.CreateVolumeFromSnapshot(imported, "", "", nil)
+			require.NoError(t, err)
+			assert.Equal(t, readTestTree(t, volume), readTestTree(t, testVolumeDir(t, other, volumeID)))
+		})
+	}
+}
+
+func TestExportedSnapshotLayout(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	var exported bytes.Buffer
+	require.NoError(t, p.ExportSnapshot(snapshotID, &exported, ""))
+
+	var names []string
+	tr := tar.NewReader(&exported)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{"snapshot.json", "manifest.json", "data/", "data/data/", "data/data/nested/", "data/data/nested/big", "data/empty", "data/link"}, names)
+}
+
+func TestImportRejectsTamperedSnapshot(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	var exported bytes.Buffer
+	require.NoError(t, p.ExportSnapshot(snapshotID, &exported, ""))
+
+	// The content of data/data/nested/big follows its header block.
+	data := exported.Bytes()
+	i := bytes.LastIndex(data, []byte("data/data/nested/big\x00"))
+	require.Zero(t, i%512)
+	data[i+512+100] = 1
+
+	other := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	_, err = other.ImportSnapshot(bytes.NewReader(data))
+	assert.ErrorContains(t, err, "data/nested/big: content differs")
+	assert.Empty(t, other.catalog.Snapshots)
+
+	_, err = other.ImportSnapshot(bytes.NewReader([]byte("not an export")))
+	assert.Error(t, err)
+}
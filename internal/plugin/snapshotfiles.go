@@ -0,0 +1,157 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotFiles lists the directories, files and symlinks of a snapshot, from
+// its manifest or, for snapshots taken before manifests were recorded, by
+// reading its data.
+func (p *NoOpVolumeSnapshotter) SnapshotFiles(snapshotID string) ([]ManifestEntry, error) {
+	snapshot, store, err := p.acquireSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer p.releaseReader(snapshotID)
+	return snapshotFiles(store, snapshotID, snapshot)
+}
+
+func snapshotFiles(store snapshotStore, snapshotID string, snapshot Snapshot) ([]ManifestEntry, error) {
+	manifest, err := store.Manifest(snapshotID, snapshot)
+	if err == errNoManifest {
+		entries, err := store.Scan(snapshotID, snapshot)
+		return entries, errors.Wrapf(err, "unable to list snapshot %s", snapshotID)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list snapshot %s", snapshotID)
+	}
+	return manifest.Entries, nil
+}
+
+// RestoreSnapshotFiles extracts the entries of a snapshot matching patterns into
+// dir, with their metadata, without creating a volume. Patterns are paths
+// relative to the root of the volume, or globs as path.Match takes them, and
+// directories are extracted with everything below them. The directories leading
+// to the entries are extracted too, unless dir already has them, in which case
+// they're left as they are, so that files can be recovered into the volume they
+// were taken from. dir is created if it doesn't exist, but none of the entries
+// may exist in it yet.
+//
+// It returns the paths extracted. Patterns that match nothing are an error, and
+// nothing is extracted then.
+func (p *NoOpVolumeSnapshotter) RestoreSnapshotFiles(snapshotID string, patterns []string, dir string) ([]string, error) {
+	snapshot, store, err := p.acquireSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer p.releaseReader(snapshotID)
+
+	entries, err := snapshotFiles(store, snapshotID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectEntries(entries, patterns)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to restore files from snapshot %s", snapshotID)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r, err := store.Open(snapshotID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// The root of the volume is dir, which keeps its own metadata.
+	include := func(name string) (bool, bool) {
+		matched, ok := selected[name]
+		return ok && name != ".", !matched
+	}
+	if err := extractTarTree(p, r, dir, include); err != nil {
+		return nil, errors.Wrapf(err, "error restoring files from snapshot %s", snapshotID)
+	}
+
+	paths := make([]string, 0, len(selected))
+	for name := range selected {
+		if name != "." {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+	p.WithField("snapshotID", snapshotID).WithField("dir", dir).Infof("Restored %d entries from snapshot", len(paths))
+	return paths, nil
+}
+
+// selectEntries returns the paths of the entries matching patterns and of the
+// entries below them, which are true, and of the directories leading to them,
+// which are false.
+func selectEntries(entries []ManifestEntry, patterns []string) (map[string]bool, error) {
+	cleaned := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		cleaned[i] = path.Clean(strings.TrimPrefix(pattern, "/"))
+		if _, err := path.Match(cleaned[i], ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+
+	selected := make(map[string]bool)
+	matched := make([]bool, len(patterns))
+	for _, entry := range entries {
+		// Entries below a matching directory match too.
+		for name := entry.Path; ; name = path.Dir(name) {
+			found := false
+			for i, pattern := range cleaned {
+				if ok, _ := path.Match(pattern, name); ok {
+					matched[i], found = true, true
+				}
+			}
+			if found {
+				selected[entry.Path] = true
+				for dir := entry.Path; dir != "."; {
+					dir = path.Dir(dir)
+					if _, ok := selected[dir]; ok {
+						break
+					}
+					selected[dir] = false
+				}
+				break
+			}
+			if name == "." {
+				break
+			}
+		}
+	}
+
+	var missing []string
+	for i, ok := range matched {
+		if !ok {
+			missing = append(missing, patterns[i])
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("nothing matches %s", strings.Join(missing, ", "))
+	}
+	return selected, nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreSnapshotFiles(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+
+	for name, config := range map[string]map[string]string{
+		"local":        {},
+		"dedup":        {"dedup": "true", "dedupChunkSize": "1Ki"},
+		"object store": {"objectStore": testObjectStore, "objectStoreBucket": "snapshots", "compression": "gzip"},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config["stateDir"] = t.TempDir()
+			p := newTestSnapshotter(t, config)
+			volume := newTestVolume(t)
+			snapshotID, err := p.CreateSnapshot("hostPath:"+volume, "", nil)
+			require.NoError(t, err)
+
+			entries, err := p.SnapshotFiles(snapshotID)
+			require.NoError(t, err)
+			assert.Len(t, entries, 6)
+
+			dir := filepath.Join(t.TempDir(), "restored")
+			paths, err := p.RestoreSnapshotFiles(snapshotID, []string{"/data/nested", "emp*"}, dir)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"data", "data/nested", "data/nested/big", "empty"}, paths)
+			want := readTestTree(t, volume)
+			delete(want, "link")
+			assert.Equal(t, want, readTestTree(t, dir))
+			assert.Equal(t, os.FileMode(0750), mustStat(t, filepath.Join(dir, "data")).Mode().Perm())
+
+			// Nothing is extracted over existing files, or for patterns that
+			// match nothing.
+			_, err = p.RestoreSnapshotFiles(snapshotID, []string{"empty"}, dir)
+			assert.Error(t, err)
+			_, err = p.RestoreSnapshotFiles(snapshotID, []string{"link", "missing"}, dir)
+			assert.EqualError(t, err, "unable to restore files from snapshot "+snapshotID+": nothing matches missing")
+			_, err = os.Lstat(filepath.Join(dir, "link"))
+			assert.True(t, os.IsNotExist(err))
+
+			// A deleted file is recovered into the volume it was taken from,
+			// whose directories are left as they are.
+			require.NoError(t, os.Remove(filepath.Join(volume, "data", "nested", "big")))
+			require.NoError(t, os.Chmod(filepath.Join(volume, "data"), 0700))
+			paths, err = p.RestoreSnapshotFiles(snapshotID, []string{"data/nested/big"}, volume)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"data", "data/nested", "data/nested/big"}, paths)
+			assert.Equal(t, os.FileMode(0700), mustStat(t, filepath.Join(volume, "data")).Mode().Perm())
+			assert.Equal(t, os.FileMode(0640), mustStat(t, filepath.Join(volume, "data", "nested", "big")).Mode().Perm())
+
+			// Directories that are restored themselves still must not exist.
+			_, err = p.RestoreSnapshotFiles(snapshotID, []string{"data/nested"}, volume)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSelectEntries(t *testing.T) {
+	entries := []ManifestEntry{{Path: "."}, {Path: "a"}, {Path: "a/b"}, {Path: "a/b/c.log"}, {Path: "a/d.txt"}, {Path: "e.log"}}
+
+	selected, err := selectEntries(entries, []string{"a/*/*.log"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{".": false, "a": false, "a/b": false, "a/b/c.log": true}, selected)
+
+	selected, err = selectEntries(entries, []string{"*.log", "a/b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{".": false, "a": false, "a/b": true, "a/b/c.log": true, "e.log": true}, selected)
+
+	_, err = selectEntries(entries, []string{"["})
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"sort"
+	"time"
+)
+
+// VeleroPVTag is the tag Velero passes with the name of the PersistentVolume a
+// snapshot is taken of.
+const VeleroPVTag = "velero.io/pv"
+
+// CatalogListing describes the volumes and snapshots of a catalog.
+type CatalogListing struct {
+	Volumes   []VolumeListing   `json:"volumes"`
+	Snapshots []SnapshotListing `json:"snapshots"`
+}
+
+// VolumeListing describes a volume of the catalog.
+type VolumeListing struct {
+	VolumeID string `json:"volumeID"`
+	Volume
+	// Snapshots counts the snapshots of the volume in the listing.
+	Snapshots int `json:"snapshots"`
+}
+
+// SnapshotListing describes a snapshot of the catalog.
+type SnapshotListing struct {
+	SnapshotID string `json:"snapshotID"`
+	// SourcePV is the name of the PersistentVolume the snapshot was taken of,
+	// if Velero passed it.
+	SourcePV          string            `json:"sourcePV,omitempty"`
+	VolumeID          string            `json:"volumeID"`
+	AZ                string            `json:"az,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Size              int64             `json:"size"`
+	StoredSize        int64             `json:"storedSize"`
+	Parent            string            `json:"parent,omitempty"`
+	CopyStrategy      string            `json:"copyStrategy,omitempty"`
+	Phase             string            `json:"phase,omitempty"`
+	Error             string            `json:"error,omitempty"`
+}
+
+// List describes the snapshots that have all the given tags, oldest first, and
+// the volumes. Volumes are sorted by ID and, with tags, only those with a
+// snapshot in the listing are included.
+func (c *SnapshotCatalog) List(tags map[string]string) CatalogListing {
+	listing := CatalogListing{Volumes: []VolumeListing{}, Snapshots: []SnapshotListing{}}
+
+	ids := c.SnapshotsTagged(tags)
+	sortSnapshots(c, ids)
+	counts := make(map[string]int)
+	for _, id := range ids {
+		snapshot := c.Snapshots[id]
+		counts[snapshot.VolumeID]++
+		listing.Snapshots = append(listing.Snapshots, SnapshotListing{
+			SnapshotID:        id,
+			SourcePV:          snapshot.Tags[VeleroPVTag],
+			VolumeID:          snapshot.VolumeID,
+			AZ:                snapshot.AZ,
+			Tags:              snapshot.Tags,
+			CreationTimestamp: snapshot.CreationTimestamp,
+			Size:              snapshot.Size,
+			StoredSize:        snapshot.StoredSize,
+			Parent:            snapshot.Parent,
+			CopyStrategy:      snapshot.CopyStrategy,
+			Phase:             snapshot.Phase,
+			Error:             snapshot.Error,
+		})
+	}
+
+	for id, volume := range c.Volumes {
+		if len(tags) > 0 && counts[id] == 0 {
+			continue
+		}
+		listing.Volumes = append(listing.Volumes, VolumeListing{VolumeID: id, Volume: volume, Snapshots: counts[id]})
+	}
+	sort.Slice(listing.Volumes, func(i, j int) bool {
+		return listing.Volumes[i].VolumeID < listing.Volumes[j].VolumeID
+	})
+	return listing
+}
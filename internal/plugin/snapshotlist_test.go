@@ -0,0 +1,83 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotCatalogList(t *testing.T) {
+	stateDir := t.TempDir()
+	p := newTestSnapshotter(t, map[string]string{"stateDir": stateDir, "incremental": "true"})
+	volume := "hostPath:" + newTestVolume(t)
+	other := "hostPath:" + newTestVolume(t)
+
+	first, err := p.CreateSnapshot(volume, "zone-a", map[string]string{"velero.io/backup": "b1", VeleroPVTag: "pv-1"})
+	require.NoError(t, err)
+	second, err := p.CreateSnapshot(volume, "zone-a", map[string]string{"velero.io/backup": "b2", VeleroPVTag: "pv-1"})
+	require.NoError(t, err)
+	third, err := p.CreateSnapshot(other, "zone-b", map[string]string{"velero.io/backup": "b2"})
+	require.NoError(t, err)
+
+	// The listing is read from the catalog on disk.
+	catalog, err := LoadSnapshotCatalog(stateDir)
+	require.NoError(t, err)
+	listing := catalog.List(nil)
+	require.Len(t, listing.Volumes, 2)
+	assert.Less(t, listing.Volumes[0].VolumeID, listing.Volumes[1].VolumeID)
+	volumes := make(map[string]VolumeListing)
+	for _, v := range listing.Volumes {
+		volumes[v.VolumeID] = v
+	}
+	assert.Equal(t, 2, volumes[volume].Snapshots)
+	assert.Equal(t, "zone-a", volumes[volume].AZ)
+	assert.Equal(t, 1, volumes[other].Snapshots)
+
+	require.Len(t, listing.Snapshots, 3)
+	assert.Equal(t, []string{first, second, third},
+		[]string{listing.Snapshots[0].SnapshotID, listing.Snapshots[1].SnapshotID, listing.Snapshots[2].SnapshotID})
+	assert.Equal(t, "pv-1", listing.Snapshots[1].SourcePV)
+	assert.Equal(t, first, listing.Snapshots[1].Parent)
+	assert.EqualValues(t, 5000, listing.Snapshots[1].Size)
+	assert.EqualValues(t, 0, listing.Snapshots[1].StoredSize)
+	assert.Equal(t, "b2", listing.Snapshots[1].Tags["velero.io/backup"])
+	assert.Empty(t, listing.Snapshots[2].SourcePV)
+
+	listing = catalog.List(map[string]string{"velero.io/backup": "b2"})
+	require.Len(t, listing.Snapshots, 2)
+	assert.Equal(t, second, listing.Snapshots[0].SnapshotID)
+	assert.Equal(t, third, listing.Snapshots[1].SnapshotID)
+	assert.Len(t, listing.Volumes, 2)
+
+	listing = catalog.List(map[string]string{VeleroPVTag: "pv-1", "velero.io/backup": "b1"})
+	require.Len(t, listing.Snapshots, 1)
+	assert.Equal(t, first, listing.Snapshots[0].SnapshotID)
+	require.Len(t, listing.Volumes, 1)
+	assert.Equal(t, volume, listing.Volumes[0].VolumeID)
+
+	// Volumes are listed with their fields flattened.
+	data, err := json.Marshal(catalog.List(map[string]string{"velero.io/backup": "missing"}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"volumes": [], "snapshots": []}`, string(data))
+	data, err = json.Marshal(listing.Volumes[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"type":`)
+}
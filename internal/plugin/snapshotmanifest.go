@@ -0,0 +1,333 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The types of the entries of a manifest.
+const (
+	entryDir     = "dir"
+	entryFile    = "file"
+	entrySymlink = "symlink"
+)
+
+// SnapshotManifest lists everything a snapshot captured, so that the snapshot
+// can be checked to still be restorable.
+type SnapshotManifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes a directory, file or symlink of a snapshot. Paths are
+// slash-separated and relative to the root of the volume, which is ".".
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Mode holds the permission, setuid, setgid and sticky bits in octal. It's
+	// empty for symlinks, whose mode isn't portable.
+	Mode   string `json:"mode,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+func (m *SnapshotManifest) add(entry ManifestEntry) {
+	if m != nil {
+		m.Entries = append(m.Entries, entry)
+	}
+}
+
+// byPath indexes the entries of a manifest by path.
+func (m *SnapshotManifest) byPath() map[string]ManifestEntry {
+	entries := make(map[string]ManifestEntry, len(m.Entries))
+	for _, entry := range m.Entries {
+		entries[entry.Path] = entry
+	}
+	return entries
+}
+
+// newManifestEntry describes a directory tree entry. Files are hashed by the
+// caller.
+func newManifestEntry(rel string, info fs.FileInfo, target string) ManifestEntry {
+	entry := ManifestEntry{Path: path.Clean(filepath.ToSlash(rel))}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		entry.Type = entryDir
+	case mode.IsRegular():
+		entry.Type = entryFile
+		entry.Size = info.Size()
+	default:
+		entry.Type = entrySymlink
+		entry.Target = target
+		return entry
+	}
+	entry.Mode = formatMode(info.Mode())
+	return entry
+}
+
+// formatMode writes the mode bits a manifest records the way chmod takes them.
+func formatMode(mode fs.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// scanTree describes the directory tree at root as a manifest does, hashing
+// every file.
+func scanTree(root string) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var target string
+		switch mode := info.Mode(); {
+		case mode&fs.ModeSymlink != 0:
+			if target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case !mode.IsDir() && !mode.IsRegular():
+			return nil
+		}
+
+		entry := newManifestEntry(mustRel(root, p), info, target)
+		if entry.Type == entryFile {
+			sum, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			entry.SHA256 = hex.EncodeToString(sum)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, errors.Wrapf(err, "error reading %s", root)
+}
+
+// scanTar describes a tar stream written by writeTarTree as a manifest does,
+// hashing every file.
+func scanTar(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, errors.Wrap(err, "error reading snapshot stream")
+		}
+
+		entry := newManifestEntry(hdr.Name, hdr.FileInfo(), hdr.Linkname)
+		if entry.Type == entryFile {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return entries, errors.Wrapf(err, "error reading %s from snapshot stream", hdr.Name)
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Problems reported by snapshot verification.
+const (
+	VerifyMissing    = "Missing"
+	VerifyUnexpected = "Unexpected"
+	VerifyDrift      = "Drift"
+	VerifyUnreadable = "Unreadable"
+)
+
+// VerifyFinding describes a difference between a snapshot and its manifest.
+type VerifyFinding struct {
+	Path    string `json:"path,omitempty"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// VerifyReport is the outcome of checking a snapshot against its manifest.
+type VerifyReport struct {
+	SnapshotID string          `json:"snapshotID"`
+	Entries    int             `json:"entries"`
+	Findings   []VerifyFinding `json:"findings"`
+}
+
+// compareManifest reports the entries of a manifest that are missing from what
+// was read back, differ from it, or weren't in the manifest, by path.
+func compareManifest(manifest *SnapshotManifest, scanned []ManifestEntry) []VerifyFinding {
+	findings := []VerifyFinding{}
+	expected := manifest.byPath()
+	seen := make(map[string]bool, len(scanned))
+	for _, entry := range scanned {
+		seen[entry.Path] = true
+		want, ok := expected[entry.Path]
+		if !ok {
+			findings = append(findings, VerifyFinding{Path: entry.Path, Problem: VerifyUnexpected, Detail: entry.Type + " isn't in the manifest"})
+			continue
+		}
+		if drift := describeDrift(want, entry); drift != "" {
+			findings = append(findings, VerifyFinding{Path: entry.Path, Problem: VerifyDrift, Detail: drift})
+		}
+	}
+	for _, entry := range manifest.Entries {
+		if !seen[entry.Path] {
+			findings = append(findings, VerifyFinding{Path: entry.Path, Problem: VerifyMissing, Detail: entry.Type + " is in the manifest"})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+	return findings
+}
+
+func describeDrift(want, got ManifestEntry) string {
+	if want.Type != got.Type {
+		return fmt.Sprintf("%s instead of %s", got.Type, want.Type)
+	}
+	var drift []string
+	if want.Mode != got.Mode {
+		drift = append(drift, fmt.Sprintf("mode %s instead of %s", got.Mode, want.Mode))
+	}
+	if want.Size != got.Size {
+		drift = append(drift, fmt.Sprintf("size %d instead of %d", got.Size, want.Size))
+	} else if want.SHA256 != got.SHA256 {
+		drift = append(drift, "content differs")
+	}
+	if want.Target != got.Target {
+		drift = append(drift, fmt.Sprintf("target %s instead of %s", got.Target, want.Target))
+	}
+	return strings.Join(drift, ", ")
+}
+
+// VerifySnapshot reads back the data of a snapshot and checks it against the
+// manifest saved with it. Differences are findings of the report; errors mean
+// the snapshot couldn't be checked at all.
+func (p *NoOpVolumeSnapshotter) VerifySnapshot(snapshotID string) (*VerifyReport, error) {
+	snapshot, store, err := p.acquireSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer p.releaseReader(snapshotID)
+	return verifySnapshot(store, snapshotID, snapshot)
+}
+
+// VerifiableSnapshotIDs returns the IDs of the snapshots VerifySnapshot can
+// check, sorted: those that are ready and have data, leaving out snapshots that
+// are being taken, failed or were taken in dry run mode.
+func (p *NoOpVolumeSnapshotter) VerifiableSnapshotIDs() []string {
+	var ids []string
+	for _, id := range p.SnapshotIDs(nil) {
+		p.mu.Lock()
+		snapshot, ok := p.catalog.Snapshots[id]
+		p.mu.Unlock()
+		if ok && snapshot.Phase == "" && !snapshot.DryRun {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// acquireSnapshot returns a snapshot that is ready with the store holding its
+// data, counting a reader so that it isn't deleted while it's read. Callers
+// release it with releaseReader.
+func (p *NoOpVolumeSnapshotter) acquireSnapshot(snapshotID string) (Snapshot, snapshotStore, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot, ok := p.catalog.Snapshots[snapshotID]
+	switch {
+	case !ok:
+		return snapshot, nil, errors.Errorf("snapshot %s not found", snapshotID)
+	case snapshot.Phase != "":
+		return snapshot, nil, errors.Errorf("snapshot %s isn't ready, it's %s", snapshotID, snapshot.Phase)
+	case p.deleting[snapshotID]:
+		return snapshot, nil, errors.Errorf("snapshot %s is being deleted", snapshotID)
+	}
+	store, err := p.snapshotStoreFor(snapshot)
+	if err != nil {
+		return snapshot, nil, err
+	}
+	p.readers[snapshotID]++
+	return snapshot, store, nil
+}
+
+func (p *NoOpVolumeSnapshotter) releaseReader(snapshotID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseSnapshot(snapshotID)
+}
+
+func verifySnapshot(store snapshotStore, snapshotID string, snapshot Snapshot) (*VerifyReport, error) {
+	manifest, err := store.Manifest(snapshotID, snapshot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to verify snapshot %s", snapshotID)
+	}
+	report := &VerifyReport{SnapshotID: snapshotID, Entries: len(manifest.Entries)}
+	scanned, err := store.Scan(snapshotID, snapshot)
+	if err != nil {
+		// Everything after the error would show up as missing.
+		report.Findings = []VerifyFinding{{Problem: VerifyUnreadable, Detail: err.Error()}}
+		return report, nil
+	}
+	report.Findings = compareManifest(manifest, scanned)
+	return report, nil
+}
+
+// verifyCreated checks a snapshot that was just saved against its manifest, and
+// deletes its data if it doesn't match.
+func verifyCreated(log logrus.FieldLogger, store snapshotStore, snapshotID string, snapshot Snapshot) error {
+	report, err := verifySnapshot(store, snapshotID, snapshot)
+	if err == nil && len(report.Findings) > 0 {
+		for _, finding := range report.Findings {
+			log.WithFields(logrus.Fields{"snapshotID": snapshotID, "path": finding.Path, "problem": finding.Problem}).Error(finding.Detail)
+		}
+		first := report.Findings[0]
+		err = errors.Errorf("snapshot %s doesn't match its manifest, %d problems, the first being %s %s: %s",
+			snapshotID, len(report.Findings), first.Problem, first.Path, first.Detail)
+	}
+	if err != nil {
+		if deleteErr := store.Delete(snapshotID, snapshot); deleteErr != nil {
+			log.WithError(deleteErr).WithField("snapshotID", snapshotID).Warn("Unable to delete snapshot that failed verification")
+		}
+		return err
+	}
+	log.WithField("snapshotID", snapshotID).WithField("entries", report.Entries).Info("Verified snapshot against its manifest")
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotManifest(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	keyFile := newTestKeyFile(t, "v1")
+	sum := sha256.Sum256(make([]byte, 5000))
+	big := hex.EncodeToString(sum[:])
+
+	for name, config := range map[string]map[string]string{
+		"local":       {},
+		"incremental": {"incremental": "true", "verifyAfterCreate": "true"},
+		"dedup":       {"dedup": "true", "verifyAfterCreate": "true"},
+		"object store": {"objectStore": testObjectStore, "objectStoreBucket": "snapshots", "objectStoreChunkSize": "1Ki",
+			"compression": "zstd", "encryptionKeyFile": keyFile, "verifyAfterCreate": "true"},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config["stateDir"] = t.TempDir()
+			p := newTestSnapshotter(t, config)
+			dir := newTestVolume(t)
+			first, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+			require.NoError(t, err)
+			second, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+			require.NoError(t, err)
+
+			store, err := p.snapshotStoreFor(p.catalog.Snapshots[second])
+			require.NoError(t, err)
+			manifest, err := store.Manifest(second, p.catalog.Snapshots[second])
+			require.NoError(t, err)
+			assert.Equal(t, []ManifestEntry{
+				{Path: ".", Type: entryDir, Mode: formatMode(mustStat(t, dir).Mode())},
+				{Path: "data", Type: entryDir, Mode: "0750"},
+				{Path: "data/nested", Type: entryDir, Mode: "0750"},
+				{Path: "data/nested/big", Type: entryFile, Mode: "0640", Size: 5000, SHA256: big},
+				{Path: "empty", Type: entryFile, Mode: "0600", SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+				{Path: "link", Type: entrySymlink, Target: "data/nested/big"},
+			}, manifest.Entries)
+
+			for _, snapshotID := range []string{first, second} {
+				report, err := p.VerifySnapshot(snapshotID)
+				require.NoError(t, err)
+				assert.Equal(t, 6, report.Entries)
+				assert.Empty(t, report.Findings)
+			}
+			_, err = p.VerifySnapshot("missing")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestVerifySnapshotFindsDrift(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+
+	data := p.local.dataDir(snapshotID)
+	require.NoError(t, os.WriteFile(filepath.Join(data, "data", "nested", "big"), []byte("changed"), 0640))
+	require.NoError(t, os.Chmod(filepath.Join(data, "empty"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(data, "link")))
+	require.NoError(t, os.WriteFile(filepath.Join(data, "extra"), nil, 0600))
+
+	report, err := p.VerifySnapshot(snapshotID)
+	require.NoError(t, err)
+	assert.Equal(t, []VerifyFinding{
+		{Path: "data/nested/big", Problem: VerifyDrift, Detail: "size 7 instead of 5000"},
+		{Path: "empty", Problem: VerifyDrift, Detail: "mode 0644 instead of 0600"},
+		{Path: "extra", Problem: VerifyUnexpected, Detail: "file isn't in the manifest"},
+		{Path: "link", Problem: VerifyMissing, Detail: "symlink is in the manifest"},
+	}, report.Findings)
+
+	// Snapshots that fail the check after being created are discarded.
+	err = verifyCreated(p, p.local, snapshotID, p.catalog.Snapshots[snapshotID])
+	assert.Error(t, err)
+	_, err = os.Stat(data)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(p.local.manifestPath(snapshotID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerifySnapshotCorruptStream(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "objectStore": testObjectStore, "objectStoreBucket": "snapshots", "compression": "gzip"})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+
+	chunk := filepath.Join(objectStoreRoot, "snapshots", p.objectStore.keyPrefix(snapshotID), "data.tar.00000000")
+	data, err := os.ReadFile(chunk)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(chunk, data, 0644))
+
+	report, err := p.VerifySnapshot(snapshotID)
+	require.NoError(t, err)
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, VerifyUnreadable, report.Findings[0].Problem)
+}
+
+func TestVerifySnapshotWithoutManifest(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(p.local.manifestPath(snapshotID)))
+
+	_, err = p.VerifySnapshot(snapshotID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "taken before manifests were recorded")
+	// Deleting it doesn't need the manifest either.
+	require.NoError(t, p.DeleteSnapshot(snapshotID))
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info
+}
@@ -0,0 +1,460 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// defaultChunkSize is the size of the objects snapshot streams are split into.
+	defaultChunkSize = 64 << 20
+	// objectStoreConfigPrefix marks the keys of the volume snapshot location config
+	// that are passed on to the object store holding snapshot data.
+	objectStoreConfigPrefix = "objectStoreConfig."
+)
+
+// snapshotObjectStores are the object store plugins that snapshot data can be
+// streamed to, by name.
+var snapshotObjectStores = make(map[string]func(logrus.FieldLogger) (interface{}, error))
+
+// RegisterSnapshotObjectStore makes an object store plugin available for keeping
+// snapshot data in, under the name it's registered with in the plugin server.
+func RegisterSnapshotObjectStore(name string, initializer func(logrus.FieldLogger) (interface{}, error)) {
+	snapshotObjectStores[name] = initializer
+}
+
+// SnapshotObjectStore locates the data of a snapshot kept in an object store, so
+// that it can still be found after the volume snapshot location config changes.
+type SnapshotObjectStore struct {
+	Provider string            `json:"provider"`
+	Bucket   string            `json:"bucket"`
+	Prefix   string            `json:"prefix,omitempty"`
+	Config   map[string]string `json:"config,omitempty"`
+	// Chunks is the number of objects the snapshot stream was split into.
+	Chunks int `json:"chunks"`
+}
+
+// maxNameLength leaves room for the suffixes added to the names of snapshot and
+// volume directories, below the 255 bytes most file systems allow.
+const maxNameLength = 200
+
+// escapeName turns a snapshot ID, which starts with the path of the volume, into
+// the name of a single directory or object key segment. Names that would be too
+// long keep their end, which tells snapshots apart, behind a hash of the ID.
+func escapeName(id string) string {
+	name := url.PathEscape(id)
+	if len(name) <= maxNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:8])
+	return hash + "-" + name[len(name)-(maxNameLength-len(hash)-1):]
+}
+
+// snapshotStore keeps the data of snapshots.
+type snapshotStore interface {
+	// Save captures the directory tree at src as the data of a snapshot, and
+	// records its size and location in snapshot. The manifest of what was
+	// captured is saved with the data. The copy is paced by job, if it's set.
+	Save(snapshotID, src string, snapshot *Snapshot, job *copyJob) (copyStats, error)
+	// Manifest returns the manifest saved with a snapshot.
+	Manifest(snapshotID string, snapshot Snapshot) (*SnapshotManifest, error)
+	// Scan reads back the data of a snapshot, describing it as its manifest does.
+	Scan(snapshotID string, snapshot Snapshot) ([]ManifestEntry, error)
+	// Restore recreates the directory tree of a snapshot at dst, which must not
+	// exist yet.
+	Restore(snapshotID string, snapshot Snapshot, dst string) error
+	// Open reads the data of a snapshot as a tar stream, as written by
+	// writeTarTree.
+	Open(snapshotID string, snapshot Snapshot) (io.ReadCloser, error)
+	// Delete removes the data of a snapshot.
+	Delete(snapshotID string, snapshot Snapshot) error
+}
+
+// errNoManifest is returned for snapshots taken before manifests were recorded.
+var errNoManifest = errors.New("the snapshot has no manifest, it was taken before manifests were recorded")
+
+// manifestName is the name of the manifest of a snapshot, next to its data.
+const manifestName = "manifest.json"
+
+// localSnapshotStore keeps snapshots as copies of the volume in a directory.
+type localSnapshotStore struct {
+	log logrus.FieldLogger
+	dir string
+	// compareContent is passed on to copyTree for incremental snapshots.
+	compareContent bool
+	// cloneFile clones files on filesystems that support it, if it's set.
+	cloneFile func(dst, src *os.File) error
+}
+
+// dataDir returns the directory holding the copy of a volume taken by a snapshot.
+func (s *localSnapshotStore) dataDir(snapshotID string) string {
+	return filepath.Join(s.dir, escapeName(snapshotID))
+}
+
+// manifestPath returns the file holding the manifest of a snapshot, which is
+// kept out of its data directory so that restores don't copy it.
+func (s *localSnapshotStore) manifestPath(snapshotID string) string {
+	return s.dataDir(snapshotID) + "." + manifestName
+}
+
+// Save copies the volume. Files that haven't changed since snapshot.Parent, if
+// set, are hardlinked to it, and the others cloned if the filesystems allow.
+func (s *localSnapshotStore) Save(snapshotID, src string, snapshot *Snapshot, job *copyJob) (copyStats, error) {
+	manifest := &SnapshotManifest{}
+	opts := copyOptions{
+		compareContent: s.compareContent,
+		manifest:       manifest,
+		job:            job,
+		reflink:        newReflinker(s.log, s.cloneFile),
+	}
+	if snapshot.Parent != "" {
+		opts.linkDest = s.dataDir(snapshot.Parent)
+		if previous, err := s.Manifest(snapshot.Parent, Snapshot{}); err == nil {
+			opts.previous = previous.byPath()
+		}
+	}
+	stats, err := copyTreeAtomic(s.log, src, s.dataDir(snapshotID), opts)
+	if err != nil {
+		return stats, err
+	}
+	data, err := json.Marshal(manifest)
+	if err == nil {
+		err = writeFileAtomic(s.manifestPath(snapshotID), data)
+	}
+	if err != nil {
+		removeTree(s.dataDir(snapshotID))
+		return stats, errors.Wrapf(err, "error saving the manifest of snapshot %s", snapshotID)
+	}
+	snapshot.Size = stats.Bytes
+	snapshot.StoredSize = stats.Bytes - stats.LinkedBytes
+	snapshot.CopyStrategy = stats.strategy()
+	return stats, nil
+}
+
+func (s *localSnapshotStore) Restore(snapshotID string, snapshot Snapshot, dst string) error {
+	stats, err := copyTreeAtomic(s.log, s.dataDir(snapshotID), dst, copyOptions{reflink: newReflinker(s.log, s.cloneFile)})
+	if err == nil {
+		s.log.WithField("snapshotID", snapshotID).WithField("strategy", stats.strategy()).Debug("Restored volume data")
+	}
+	return err
+}
+
+// Open archives the copy of the volume as it's read.
+func (s *localSnapshotStore) Open(snapshotID string, snapshot Snapshot) (io.ReadCloser, error) {
+	dir := s.dataDir(snapshotID)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := writeTarTree(s.log, dir, pw, nil, nil)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (s *localSnapshotStore) Manifest(snapshotID string, snapshot Snapshot) (*SnapshotManifest, error) {
+	data, err := os.ReadFile(s.manifestPath(snapshotID))
+	if os.IsNotExist(err) {
+		return nil, errNoManifest
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	manifest := new(SnapshotManifest)
+	return manifest, errors.Wrapf(json.Unmarshal(data, manifest), "error decoding the manifest of snapshot %s", snapshotID)
+}
+
+func (s *localSnapshotStore) Scan(snapshotID string, snapshot Snapshot) ([]ManifestEntry, error) {
+	return scanTree(s.dataDir(snapshotID))
+}
+
+// Delete removes the copy of the volume. Files of incremental snapshots are
+// hardlinks shared with other snapshots of the volume; removing the directory
+// only drops its own links, so the others are intact.
+func (s *localSnapshotStore) Delete(snapshotID string, snapshot Snapshot) error {
+	if err := removeTree(s.dataDir(snapshotID)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.manifestPath(snapshotID)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// objectSnapshotStore streams snapshots as tar archives to an object store, split
+// into chunks under snapshots/<snapshot ID>/. The archives may be compressed and
+// encrypted.
+type objectSnapshotStore struct {
+	log       logrus.FieldLogger
+	store     velero.ObjectStore
+	location  SnapshotObjectStore
+	chunkSize int64
+	// encoding is how new snapshots are compressed and encrypted, with keys
+	// from keys, which also decrypts older snapshots.
+	encoding streamEncoding
+	keys     *keyring
+}
+
+// newObjectSnapshotStore instantiates and initializes the object store plugin
+// registered under location.Provider.
+func newObjectSnapshotStore(log logrus.FieldLogger, location SnapshotObjectStore, chunkSize int64, keys *keyring) (*objectSnapshotStore, error) {
+	initializer, ok := snapshotObjectStores[location.Provider]
+	if !ok {
+		var names []string
+		for name := range snapshotObjectStores {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("object store %q is not available for snapshot data, use one of: %s", location.Provider, strings.Join(names, ", "))
+	}
+
+	instance, err := initializer(log)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	store, ok := instance.(velero.ObjectStore)
+	if !ok {
+		return nil, errors.Errorf("plugin %q is not an object store", location.Provider)
+	}
+
+	// Like Velero does for backup storage locations, the bucket and prefix are
+	// part of the config.
+	config := map[string]string{"bucket": location.Bucket, "prefix": location.Prefix}
+	for key, value := range location.Config {
+		config[key] = value
+	}
+	if err := store.Init(config); err != nil {
+		return nil, errors.Wrapf(err, "error initializing object store %q", location.Provider)
+	}
+
+	return &objectSnapshotStore{
+		log:       log.WithFields(logrus.Fields{"objectStore": location.Provider, "bucket": location.Bucket, "prefix": location.Prefix}),
+		store:     store,
+		location:  location,
+		chunkSize: chunkSize,
+		keys:      keys,
+	}, nil
+}
+
+// objectSnapshotLocation reads where snapshot data is streamed to from the volume
+// snapshot location config. It returns nil if snapshots are kept locally.
+func objectSnapshotLocation(config map[string]string) (*SnapshotObjectStore, int64, error) {
+	provider := config["objectStore"]
+	if provider == "" {
+		return nil, 0, nil
+	}
+	location := &SnapshotObjectStore{
+		Provider: provider,
+		Bucket:   config["objectStoreBucket"],
+		Prefix:   config["objectStorePrefix"],
+	}
+	if location.Bucket == "" {
+		return nil, 0, errors.New("objectStoreBucket is required with objectStore")
+	}
+	for key, value := range config {
+		if strings.HasPrefix(key, objectStoreConfigPrefix) {
+			if location.Config == nil {
+				location.Config = make(map[string]string)
+			}
+			location.Config[strings.TrimPrefix(key, objectStoreConfigPrefix)] = value
+		}
+	}
+
+	chunkSize := int64(defaultChunkSize)
+	if value := config["objectStoreChunkSize"]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "invalid objectStoreChunkSize %q", value)
+		}
+		if chunkSize = quantity.Value(); chunkSize <= 0 {
+			return nil, 0, errors.Errorf("invalid objectStoreChunkSize %q, it must be positive", value)
+		}
+	}
+	return location, chunkSize, nil
+}
+
+// keyPrefix returns the prefix of the objects holding a snapshot.
+func (s *objectSnapshotStore) keyPrefix(snapshotID string) string {
+	return path.Join(s.location.Prefix, "snapshots", escapeName(snapshotID)) + "/"
+}
+
+// Save streams the volume to the object store. A failed upload removes the chunks
+// already written.
+func (s *objectSnapshotStore) Save(snapshotID, src string, snapshot *Snapshot, job *copyJob) (copyStats, error) {
+	w := newChunkWriter(s.store, s.location.Bucket, s.keyPrefix(snapshotID), s.chunkSize)
+	var stats copyStats
+	manifest := &SnapshotManifest{}
+	enc, err := s.encoding.encode(job.writer(w), s.keys)
+	if err == nil {
+		if stats, err = writeTarTree(s.log, src, enc, manifest, job); err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		w.Abort(err)
+	} else {
+		err = w.Close()
+	}
+	if err == nil {
+		err = s.putManifest(snapshotID, manifest)
+	}
+	if err != nil {
+		if deleteErr := s.deleteObjects(snapshotID); deleteErr != nil {
+			s.log.WithError(deleteErr).Warn("Unable to clean up after failed upload")
+		}
+		return stats, errors.Wrapf(err, "error uploading snapshot %s", snapshotID)
+	}
+
+	location := s.location
+	location.Chunks = w.Chunks
+	snapshot.ObjectStore = &location
+	snapshot.CopyStrategy = strategyStream
+	snapshot.Compression = s.encoding.compression
+	snapshot.Encryption = s.encoding.encryption
+	snapshot.Size = stats.Bytes
+	snapshot.StoredSize = w.Bytes
+	return stats, nil
+}
+
+func (s *objectSnapshotStore) Restore(snapshotID string, snapshot Snapshot, dst string) error {
+	return createTreeAtomic(dst, func(partial string) error {
+		tr, err := s.Open(snapshotID, snapshot)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+		return errors.Wrapf(extractTarTree(s.log, tr, partial, nil), "error downloading snapshot %s", snapshotID)
+	})
+}
+
+// Open downloads the chunks of a snapshot and decodes them as they're read.
+func (s *objectSnapshotStore) Open(snapshotID string, snapshot Snapshot) (io.ReadCloser, error) {
+	encoding, err := snapshotEncoding(snapshotID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	r := newChunkReader(s.store, s.location.Bucket, s.keyPrefix(snapshotID), snapshot.ObjectStore.Chunks)
+	tr, err := encoding.decode(r, s.keys)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrapf(err, "error downloading snapshot %s", snapshotID)
+	}
+	return &stackedReader{ReadCloser: tr, source: r}, nil
+}
+
+// putManifest uploads the manifest of a snapshot, encoded like its data.
+func (s *objectSnapshotStore) putManifest(snapshotID string, manifest *SnapshotManifest) error {
+	var buf bytes.Buffer
+	enc, err := s.encoding.encode(&buf, s.keys)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(enc).Encode(manifest); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := enc.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(s.store.PutObject(s.location.Bucket, s.keyPrefix(snapshotID)+manifestName, &buf), "error uploading the manifest of snapshot %s", snapshotID)
+}
+
+func (s *objectSnapshotStore) Manifest(snapshotID string, snapshot Snapshot) (*SnapshotManifest, error) {
+	encoding, err := snapshotEncoding(snapshotID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	key := s.keyPrefix(snapshotID) + manifestName
+	exists, err := s.store.ObjectExists(s.location.Bucket, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking for %s", key)
+	}
+	if !exists {
+		return nil, errNoManifest
+	}
+	body, err := s.store.GetObject(s.location.Bucket, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error downloading %s", key)
+	}
+	defer body.Close()
+	r, err := encoding.decode(body, s.keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	manifest := new(SnapshotManifest)
+	return manifest, errors.Wrapf(json.NewDecoder(r).Decode(manifest), "error decoding the manifest of snapshot %s", snapshotID)
+}
+
+func (s *objectSnapshotStore) Scan(snapshotID string, snapshot Snapshot) ([]ManifestEntry, error) {
+	tr, err := s.Open(snapshotID, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+	return scanTar(tr)
+}
+
+// snapshotEncoding returns how the data of a snapshot was encoded. The version of
+// the key its ID ends with is checked against the catalog, and stands in for the
+// encryption of snapshots the catalog has none recorded for.
+func snapshotEncoding(snapshotID string, snapshot Snapshot) (streamEncoding, error) {
+	encoding := streamEncoding{compression: snapshot.Compression, encryption: snapshot.Encryption}
+	version := keyVersionFromID(snapshotID)
+	switch {
+	case version == "":
+	case encoding.encryption == nil:
+		encoding.encryption = &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: version}
+	case encoding.encryption.KeyVersion != version:
+		return encoding, errors.Errorf("snapshot %s is encrypted with key version %s according to the catalog, but its ID says %s", snapshotID, encoding.encryption.KeyVersion, version)
+	}
+	return encoding, nil
+}
+
+func (s *objectSnapshotStore) Delete(snapshotID string, snapshot Snapshot) error {
+	return s.deleteObjects(snapshotID)
+}
+
+func (s *objectSnapshotStore) deleteObjects(snapshotID string) error {
+	keys, err := s.store.ListObjects(s.location.Bucket, s.keyPrefix(snapshotID))
+	if err != nil {
+		return errors.Wrapf(err, "error listing the objects of snapshot %s", snapshotID)
+	}
+	for _, key := range keys {
+		if err := s.store.DeleteObject(s.location.Bucket, key); err != nil {
+			return errors.Wrapf(err, "error deleting %s", key)
+		}
+	}
+	return nil
+}
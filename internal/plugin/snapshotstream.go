@@ -0,0 +1,370 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// xattrPAXPrefix is how extended attributes are recorded in PAX headers, as GNU
+// tar and bsdtar do.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// writeTarTree writes the directory tree at src to w as a tar stream. The same
+// files as with copyTree are kept, with the same metadata, and added to manifest
+// if it's set. Files are read at the pace of job.
+func writeTarTree(log logrus.FieldLogger, src string, w io.Writer, manifest *SnapshotManifest, job *copyJob) (copyStats, error) {
+	var stats copyStats
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(src, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if job.excluded(mustRel(src, p)) {
+			return skipEntry(entry)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			stats.Dirs++
+		case mode.IsRegular():
+			stats.Files++
+			stats.Bytes += info.Size()
+		case mode&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			stats.Symlinks++
+		default:
+			log.WithField("path", p).Warnf("Skipping %s, only regular files, directories and symlinks are copied", mode.Type())
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(mustRel(src, p))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		xattrs, err := readXattrs(p)
+		if err != nil {
+			log.WithError(err).WithField("path", p).Debug("Unable to read extended attributes")
+		}
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		described := newManifestEntry(hdr.Name, info, link)
+		if !info.Mode().IsRegular() {
+			manifest.add(described)
+			return nil
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(tw, hash), job.reader(file), hdr.Size); err != nil {
+			return errors.Wrapf(err, "error reading %s, did it change while being snapshotted?", p)
+		}
+		described.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		manifest.add(described)
+		return nil
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "error archiving %s", src)
+	}
+	return stats, errors.Wrapf(tw.Close(), "error archiving %s", src)
+}
+
+// extractTarTree recreates a directory tree written by writeTarTree at dst, which
+// must not exist yet. With include, only the entries it accepts, by their
+// slash-separated path, are extracted, and dst must exist unless "." is one.
+// Directories include reports as parents, only extracted because they lead to
+// other entries, may already exist, and then keep their metadata.
+func extractTarTree(log logrus.FieldLogger, r io.Reader, dst string, include func(name string) (extract, parent bool)) error {
+	// As with copyTree, directories get their metadata once they're complete.
+	var dirs []*tar.Header
+	// Entries are never written below a symlink, which could point anywhere.
+	symlinks := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading snapshot stream")
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("snapshot stream contains %s, which is outside of the volume", hdr.Name)
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return errors.Errorf("snapshot stream contains %s, which is below the symlink %s", hdr.Name, dir)
+			}
+		}
+		parent := false
+		if include != nil {
+			var extract bool
+			if extract, parent = include(name); !extract {
+				continue
+			}
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil {
+				if info, statErr := os.Lstat(target); parent && statErr == nil && info.IsDir() {
+					continue
+				}
+				return errors.WithStack(err)
+			}
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeReg:
+			if err := extractFile(tr, target); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return errors.WithStack(err)
+			}
+			symlinks[name] = true
+		default:
+			log.WithField("path", target).Warnf("Skipping unexpected entry of type %q in snapshot stream", hdr.Typeflag)
+			continue
+		}
+
+		if err := applyTarMetadata(log, target, hdr); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dst, filepath.FromSlash(path.Clean(dirs[i].Name)))
+		if err := applyTarMetadata(log, target, dirs[i]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// stackedReader closes a reader, then the reader it reads from.
+type stackedReader struct {
+	io.ReadCloser
+	source io.Closer
+}
+
+func (s *stackedReader) Close() error {
+	err := s.ReadCloser.Close()
+	if sourceErr := s.source.Close(); err == nil {
+		err = sourceErr
+	}
+	return err
+}
+
+func extractFile(r io.Reader, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(out.Close())
+}
+
+// chunkWriter uploads a stream to an object store as a series of objects of at
+// most size bytes, named after their position in the stream. Each chunk is
+// streamed to PutObject as it's written, so a chunk is never held in memory.
+type chunkWriter struct {
+	store  velero.ObjectStore
+	bucket string
+	prefix string
+	size   int64
+
+	// Chunks and Bytes count what has been written so far.
+	Chunks int
+	Bytes  int64
+
+	pipe    *io.PipeWriter
+	done    chan error
+	written int64
+}
+
+func newChunkWriter(store velero.ObjectStore, bucket, prefix string, size int64) *chunkWriter {
+	return &chunkWriter{store: store, bucket: bucket, prefix: prefix, size: size}
+}
+
+// chunkKey returns the key of the nth chunk of a stream stored under prefix.
+func chunkKey(prefix string, n int) string {
+	return fmt.Sprintf("%sdata.tar.%08d", prefix, n)
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.pipe == nil {
+			w.startChunk()
+		}
+		part := p
+		if left := w.size - w.written; int64(len(part)) > left {
+			part = part[:left]
+		}
+		m, err := w.pipe.Write(part)
+		n += m
+		w.written += int64(m)
+		w.Bytes += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		if w.written == w.size {
+			if err := w.finishChunk(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *chunkWriter) startChunk() {
+	r, pipe := io.Pipe()
+	key := chunkKey(w.prefix, w.Chunks)
+	done := make(chan error, 1)
+	go func() {
+		err := w.store.PutObject(w.bucket, key, r)
+		// Unblock the writer if the object store gave up before the end of the chunk.
+		r.CloseWithError(err)
+		done <- errors.Wrapf(err, "error uploading %s", key)
+	}()
+	w.pipe, w.done, w.written = pipe, done, 0
+	w.Chunks++
+}
+
+func (w *chunkWriter) finishChunk() error {
+	w.pipe.Close()
+	err := <-w.done
+	w.pipe = nil
+	return err
+}
+
+// Close uploads the last, partial chunk.
+func (w *chunkWriter) Close() error {
+	if w.pipe == nil {
+		return nil
+	}
+	return w.finishChunk()
+}
+
+// Abort fails the upload of the current chunk, so that the object store doesn't
+// keep a truncated chunk.
+func (w *chunkWriter) Abort(err error) {
+	if w.pipe == nil {
+		return
+	}
+	w.pipe.CloseWithError(err)
+	<-w.done
+	w.pipe = nil
+}
+
+// chunkReader reads back a stream written by a chunkWriter, fetching one chunk at
+// a time.
+type chunkReader struct {
+	store  velero.ObjectStore
+	bucket string
+	keys   []string
+	body   io.ReadCloser
+}
+
+func newChunkReader(store velero.ObjectStore, bucket, prefix string, chunks int) *chunkReader {
+	keys := make([]string, chunks)
+	for i := range keys {
+		keys[i] = chunkKey(prefix, i)
+	}
+	return &chunkReader{store: store, bucket: bucket, keys: keys}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			body, err := r.store.GetObject(r.bucket, r.keys[0])
+			if err != nil {
+				return 0, errors.Wrapf(err, "error downloading %s", r.keys[0])
+			}
+			r.body, r.keys = body, r.keys[1:]
+		}
+
+		n, err := r.body.Read(p)
+		if err == io.EOF {
+			r.body.Close()
+			r.body = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,70 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChunkWriterAbort aborts an upload in the middle of a chunk, which must
+// leave the complete chunks behind, but not a truncated one.
+func TestChunkWriterAbort(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileObjectStoreAt(newTestLogger(), root)
+	data := bytes.Repeat([]byte("0123456789"), 3)
+
+	w := newChunkWriter(store, "snapshots", "snap/", 10)
+	n, err := w.Write(data[:25])
+	require.NoError(t, err)
+	assert.Equal(t, 25, n)
+	w.Abort(errors.New("copy failed"))
+
+	keys, err := store.ListObjects("snapshots", "snap/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{chunkKey("snap/", 0), chunkKey("snap/", 1)}, keys)
+	for i, key := range keys {
+		body, err := store.GetObject("snapshots", key)
+		require.NoError(t, err)
+		chunk, err := io.ReadAll(body)
+		body.Close()
+		require.NoError(t, err)
+		assert.Len(t, chunk, 10, "chunk %d", i)
+	}
+	// Nor is the truncated chunk left in the staging area.
+	staged, err := os.ReadDir(filepath.Join(root, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+
+	// Aborting again, or once the writer is closed, does nothing.
+	w.Abort(errors.New("copy failed"))
+	w = newChunkWriter(store, "snapshots", "other/", 10)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	w.Abort(errors.New("too late"))
+	keys, err = store.ListObjects("snapshots", "other/")
+	require.NoError(t, err)
+	assert.Len(t, keys, 3)
+}
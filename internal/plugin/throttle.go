@@ -0,0 +1,305 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// defaultProgressInterval is how often the progress of snapshot copies is
+	// logged.
+	defaultProgressInterval = 30 * time.Second
+	// windowPollInterval is how often copies waiting to start, or paused, check
+	// whether a snapshot window has opened.
+	windowPollInterval = time.Minute
+	// maxBandwidthBurst caps how much can be transferred at once under a
+	// bandwidth limit.
+	maxBandwidthBurst = 4 << 20
+)
+
+// throttle paces the copies of snapshots. The bandwidth limits are shared by all
+// the copies, which only progress within the snapshot windows, if there are
+// any.
+type throttle struct {
+	// read limits how fast volumes are read, and write how fast snapshot data
+	// is written to the state directory or the object store. They're nil
+	// without a limit.
+	read, write *rate.Limiter
+	windows     []snapshotWindow
+	now         func() time.Time
+	poll        time.Duration
+}
+
+// snapshotWindow is a daily period of time in UTC, as offsets from midnight. A
+// window that ends before it starts spans midnight.
+type snapshotWindow struct {
+	start, end time.Duration
+}
+
+func (w snapshotWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	offset := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// parseSnapshotWindows parses comma-separated windows written as HH:MM-HH:MM,
+// e.g. "22:00-06:00,12:00-13:00".
+func parseSnapshotWindows(s string) ([]snapshotWindow, error) {
+	var windows []snapshotWindow
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		start, startErr := parseClock(from)
+		end, endErr := parseClock(to)
+		if !ok || startErr != nil || endErr != nil || start == end {
+			return nil, errors.Errorf("invalid snapshot window %q, expected HH:MM-HH:MM", part)
+		}
+		windows = append(windows, snapshotWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, hErr := strconv.Atoi(hours)
+	m, mErr := strconv.Atoi(minutes)
+	if !ok || hErr != nil || mErr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, errors.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// newThrottle reads the "readBandwidth", "writeBandwidth" and "snapshotWindows"
+// keys of the config.
+func newThrottle(config map[string]string) (*throttle, error) {
+	t := &throttle{now: time.Now, poll: windowPollInterval}
+	var err error
+	if t.read, err = parseBandwidth(config, "readBandwidth"); err != nil {
+		return nil, err
+	}
+	if t.write, err = parseBandwidth(config, "writeBandwidth"); err != nil {
+		return nil, err
+	}
+	if t.windows, err = parseSnapshotWindows(config["snapshotWindows"]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseBandwidth(config map[string]string, key string) (*rate.Limiter, error) {
+	value := config[key]
+	if value == "" {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s %q", key, value)
+	}
+	bytesPerSecond := quantity.Value()
+	if bytesPerSecond <= 0 {
+		return nil, errors.Errorf("invalid %s %q, it must be a positive number of bytes per second", key, value)
+	}
+	burst := bytesPerSecond
+	if burst > maxBandwidthBurst {
+		burst = maxBandwidthBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst)), nil
+}
+
+func (t *throttle) inWindow() bool {
+	if len(t.windows) == 0 {
+		return true
+	}
+	now := t.now()
+	for _, window := range t.windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyJob is the copy of a snapshot, paced by a throttle. It counts the bytes
+// read and written for its progress. A nil copyJob doesn't do anything.
+type copyJob struct {
+	log      logrus.FieldLogger
+	throttle *throttle
+	read     int64
+	written  int64
+	paused   int32
+	// quiesced is set when a pre hook holds the application of the volume
+	// quiesced during the copy, which then runs to the end once started
+	// rather than pausing outside of the snapshot windows.
+	quiesced bool
+	// excludes holds the paths, relative to the volume directory, left out of
+	// the copy.
+	excludes map[string]bool
+}
+
+func newCopyJob(log logrus.FieldLogger, throttle *throttle) *copyJob {
+	return &copyJob{log: log, throttle: throttle}
+}
+
+// exclude leaves paths, relative to the volume directory, out of the copy.
+func (j *copyJob) exclude(paths []string) {
+	for _, path := range paths {
+		if j.excludes == nil {
+			j.excludes = make(map[string]bool)
+		}
+		j.excludes[path] = true
+	}
+}
+
+// excluded reports whether a path, relative to the volume directory, is left
+// out of the copy.
+func (j *copyJob) excluded(rel string) bool {
+	return j != nil && j.excludes[rel]
+}
+
+// waitForWindow blocks until a snapshot window is open, before the copy starts.
+func (j *copyJob) waitForWindow() {
+	if j == nil || j.throttle.inWindow() {
+		return
+	}
+	j.log.Info("Waiting for the next snapshot window to start the snapshot copy")
+	for !j.throttle.inWindow() {
+		time.Sleep(j.throttle.poll)
+	}
+	j.log.Info("Starting snapshot copy in the snapshot window")
+}
+
+// pauseOutsideWindow blocks while no snapshot window is open, unless the
+// application of the volume is quiesced.
+func (j *copyJob) pauseOutsideWindow() {
+	if j.quiesced || j.throttle.inWindow() {
+		return
+	}
+	j.log.Info("Pausing snapshot copy until the next snapshot window")
+	atomic.StoreInt32(&j.paused, 1)
+	for !j.throttle.inWindow() {
+		time.Sleep(j.throttle.poll)
+	}
+	atomic.StoreInt32(&j.paused, 0)
+	j.log.Info("Resuming snapshot copy in the snapshot window")
+}
+
+// wait blocks until n bytes may go through limiter, and the copy isn't paused.
+func (j *copyJob) wait(limiter *rate.Limiter, n int) {
+	j.pauseOutsideWindow()
+	for limiter != nil && n > 0 {
+		part := n
+		if burst := limiter.Burst(); part > burst {
+			part = burst
+		}
+		// The wait can't fail, as part is within the burst and the context is
+		// never done.
+		_ = limiter.WaitN(context.Background(), part)
+		n -= part
+	}
+}
+
+// writing paces n bytes that are about to be written.
+func (j *copyJob) writing(n int) {
+	if j == nil {
+		return
+	}
+	j.wait(j.throttle.write, n)
+	atomic.AddInt64(&j.written, int64(n))
+}
+
+// reader paces what's read from a volume through r.
+func (j *copyJob) reader(r io.Reader) io.Reader {
+	if j == nil {
+		return r
+	}
+	return &jobReader{job: j, r: r}
+}
+
+// writer paces what's written to snapshot data through w.
+func (j *copyJob) writer(w io.Writer) io.Writer {
+	if j == nil {
+		return w
+	}
+	return &jobWriter{job: j, w: w}
+}
+
+type jobReader struct {
+	job *copyJob
+	r   io.Reader
+}
+
+func (r *jobReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.job.wait(r.job.throttle.read, n)
+	atomic.AddInt64(&r.job.read, int64(n))
+	return n, err
+}
+
+type jobWriter struct {
+	job *copyJob
+	w   io.Writer
+}
+
+func (w *jobWriter) Write(p []byte) (int, error) {
+	w.job.writing(len(p))
+	return w.w.Write(p)
+}
+
+// reportProgress logs the progress of the copy every interval, until stop is
+// called.
+func (j *copyJob) reportProgress(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastRead, lastWritten int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			read, written := atomic.LoadInt64(&j.read), atomic.LoadInt64(&j.written)
+			j.log.WithFields(logrus.Fields{
+				"bytesRead":        read,
+				"bytesWritten":     written,
+				"readBytesPerSec":  int64(float64(read-lastRead) / interval.Seconds()),
+				"writeBytesPerSec": int64(float64(written-lastWritten) / interval.Seconds()),
+				"paused":           atomic.LoadInt32(&j.paused) == 1,
+			}).Info("Snapshot copy in progress")
+			lastRead, lastWritten = read, written
+		}
+	}()
+	return func() { close(done) }
+}
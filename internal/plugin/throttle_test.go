@@ -0,0 +1,237 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotWindows(t *testing.T) {
+	windows, err := parseSnapshotWindows("22:00-06:00, 12:00-12:30")
+	require.NoError(t, err)
+	throttle := &throttle{windows: windows}
+	for clock, open := range map[string]bool{
+		"23:59": true,
+		"00:00": true,
+		"05:59": true,
+		"06:00": false,
+		"12:15": true,
+		"12:30": false,
+		"21:59": false,
+	} {
+		now, err := time.Parse("15:04", clock)
+		require.NoError(t, err)
+		throttle.now = func() time.Time { return now }
+		assert.Equal(t, open, throttle.inWindow(), clock)
+	}
+
+	for _, s := range []string{"22:00", "22:00-24:00", "6-7", "10:00-10:00"} {
+		_, err := parseSnapshotWindows(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func newTestVolumeOfSize(t *testing.T, size int) string {
+	volume := t.TempDir()
+	data := make([]byte, size)
+	rand.Read(data)
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), data, 0644))
+	return volume
+}
+
+func TestSnapshotBandwidthLimits(t *testing.T) {
+	for name, config := range map[string]map[string]string{
+		"local read":  {"readBandwidth": "32Ki"},
+		"local write": {"writeBandwidth": "32Ki"},
+		"dedup write": {"writeBandwidth": "32Ki", "dedup": "true", "dedupChunkSize": "4Ki"},
+		"dedup read":  {"readBandwidth": "32Ki", "dedup": "true"},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config["stateDir"] = t.TempDir()
+			p := newTestSnapshotter(t, config)
+			// The first 32Ki go through right away, the rest at 32Ki a second.
+			volume := newTestVolumeOfSize(t, 48<<10)
+			start := time.Now()
+			_, err := p.CreateSnapshot("hostPath:"+volume, "", nil)
+			require.NoError(t, err)
+			assert.Greater(t, time.Since(start), 400*time.Millisecond)
+		})
+	}
+}
+
+// TestSnapshotWindowPausesCopies closes the snapshot window while a copy runs,
+// which pauses until the window opens again.
+func TestSnapshotWindowPausesCopies(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	p := NewNoOpVolumeSnapshotter(logger)
+	require.NoError(t, p.Init(map[string]string{"stateDir": t.TempDir(), "snapshotWindows": "01:00-02:00", "readBandwidth": "32Ki", "progressInterval": "20ms"}))
+	open := int32(1)
+	p.throttle.poll = 10 * time.Millisecond
+	p.throttle.now = func() time.Time {
+		if atomic.LoadInt32(&open) == 1 {
+			return time.Date(2026, 1, 1, 1, 30, 0, 0, time.UTC)
+		}
+		return time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.CreateSnapshot("hostPath:"+newTestVolumeOfSize(t, 48<<10), "", nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	atomic.StoreInt32(&open, 0)
+	select {
+	case err := <-done:
+		t.Fatalf("snapshot copy went on outside of the window: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	atomic.StoreInt32(&open, 1)
+	require.NoError(t, <-done)
+
+	var messages []string
+	paused := false
+	for _, entry := range logs.AllEntries() {
+		messages = append(messages, entry.Message)
+		if entry.Message == "Snapshot copy in progress" && entry.Data["paused"] == true {
+			paused = true
+		}
+	}
+	assert.Contains(t, messages, "Pausing snapshot copy until the next snapshot window")
+	assert.Contains(t, messages, "Resuming snapshot copy in the snapshot window")
+	assert.True(t, paused, "the progress doesn't show the copy paused")
+}
+
+// TestSnapshotWindowDelaysQuiescedCopies checks that copies whose application
+// is quiesced by a pre hook wait for a snapshot window to start, but aren't
+// paused when it closes, so that the application isn't left quiesced.
+func TestSnapshotWindowDelaysQuiescedCopies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	logger, logs := test.NewNullLogger()
+	p := NewNoOpVolumeSnapshotter(logger)
+	require.NoError(t, p.Init(map[string]string{"stateDir": t.TempDir(), "snapshotWindows": "01:00-02:00", "readBandwidth": "32Ki",
+		"progressInterval": "20ms", "preSnapshotHook": server.URL + "/quiesce"}))
+	// Once opened, the window closes right after the copy checked it.
+	var open int32
+	p.throttle.poll = 10 * time.Millisecond
+	p.throttle.now = func() time.Time {
+		if atomic.CompareAndSwapInt32(&open, 1, 0) {
+			return time.Date(2026, 1, 1, 1, 30, 0, 0, time.UTC)
+		}
+		return time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.CreateSnapshot("hostPath:"+newTestVolumeOfSize(t, 48<<10), "", nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("snapshot was taken outside of the window: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.StoreInt32(&open, 1)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshot copy was paused when the window closed")
+	}
+
+	var messages []string
+	for _, entry := range logs.AllEntries() {
+		messages = append(messages, entry.Message)
+	}
+	assert.Contains(t, messages, "Waiting for the next snapshot window to start the snapshot copy")
+	assert.Contains(t, messages, "Starting snapshot copy in the snapshot window")
+	assert.NotContains(t, messages, "Pausing snapshot copy until the next snapshot window")
+}
+
+func TestSnapshotProgressIsLogged(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	p := NewNoOpVolumeSnapshotter(logger)
+	require.NoError(t, p.Init(map[string]string{"stateDir": t.TempDir(), "readBandwidth": "32Ki", "progressInterval": "100ms"}))
+	_, err := p.CreateSnapshot("hostPath:"+newTestVolumeOfSize(t, 48<<10), "", nil)
+	require.NoError(t, err)
+
+	var progress []int64
+	for _, entry := range logs.AllEntries() {
+		if entry.Message == "Snapshot copy in progress" {
+			progress = append(progress, entry.Data["bytesRead"].(int64))
+		}
+	}
+	require.NotEmpty(t, progress)
+	assert.Positive(t, progress[len(progress)-1])
+}
+
+func TestMaxConcurrentSnapshots(t *testing.T) {
+	// The hooks fail if another snapshot holds the lock directory.
+	lock := filepath.Join(t.TempDir(), "lock")
+	p := newTestSnapshotter(t, map[string]string{
+		"stateDir":               t.TempDir(),
+		"maxConcurrentSnapshots": "1",
+		"preSnapshotHook":        "exec:mkdir " + lock,
+		"postSnapshotHook":       "exec:rmdir " + lock,
+		"allowExecHooks":         "true",
+		"readBandwidth":          "64Ki",
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		volume := newTestVolumeOfSize(t, 72<<10)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.CreateSnapshot("hostPath:"+volume, "", nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestInvalidThrottleConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"readBandwidth": "fast"},
+		{"writeBandwidth": "0"},
+		{"maxConcurrentSnapshots": "0"},
+		{"snapshotWindows": "nightly"},
+		{"progressInterval": "-1s"},
+	} {
+		config["stateDir"] = t.TempDir()
+		assert.Error(t, NewNoOpVolumeSnapshotter(newTestLogger()).Init(config), "%v", config)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The prefixes of the volume snapshot location config keys that translate the
+// volumes of another cluster on restore.
+const (
+	volumeTypeMapPrefix       = "volumeTypeMap."
+	availabilityZoneMapPrefix = "availabilityZoneMap."
+	iopsOverridePrefix        = "iopsOverride."
+)
+
+// volumeMapping translates the type, availability zone and IOPS of the volumes
+// a snapshot was taken of into those of the cluster it's restored into. Types and
+// zones are only translated if their table has entries, and must be in it then.
+type volumeMapping struct {
+	types map[string]string
+	zones map[string]string
+	// iops overrides the IOPS of volumes by their translated type.
+	iops map[string]int64
+}
+
+func parseVolumeMapping(config map[string]string) (volumeMapping, error) {
+	m := volumeMapping{
+		types: make(map[string]string),
+		zones: make(map[string]string),
+		iops:  make(map[string]int64),
+	}
+	for key, value := range config {
+		switch {
+		case strings.HasPrefix(key, volumeTypeMapPrefix):
+			m.types[strings.TrimPrefix(key, volumeTypeMapPrefix)] = value
+		case strings.HasPrefix(key, availabilityZoneMapPrefix):
+			m.zones[strings.TrimPrefix(key, availabilityZoneMapPrefix)] = value
+		case strings.HasPrefix(key, iopsOverridePrefix):
+			iops, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || iops <= 0 {
+				return m, errors.Errorf("invalid %s %q, it must be a positive number", key, value)
+			}
+			m.iops[strings.TrimPrefix(key, iopsOverridePrefix)] = iops
+		}
+	}
+	return m, nil
+}
+
+// translate returns the type, availability zone and IOPS of a volume restored in
+// this cluster. Empty types and zones are kept as they are.
+func (m volumeMapping) translate(volumeType, volumeAZ string, iops *int64) (string, string, *int64, error) {
+	targetType, err := lookupMapping(m.types, volumeTypeMapPrefix, "volume type", volumeType)
+	if err != nil {
+		return "", "", nil, err
+	}
+	targetAZ, err := lookupMapping(m.zones, availabilityZoneMapPrefix, "availability zone", volumeAZ)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if override, ok := m.iops[targetType]; ok {
+		iops = &override
+	}
+	return targetType, targetAZ, iops, nil
+}
+
+// sameIOPS reports whether two IOPS are the same, either both unset or set to
+// the same value.
+func sameIOPS(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func lookupMapping(table map[string]string, prefix, what, value string) (string, error) {
+	if len(table) == 0 || value == "" {
+		return value, nil
+	}
+	if target, ok := table[value]; ok {
+		return target, nil
+	}
+	known := make([]string, 0, len(table))
+	for source := range table {
+		known = append(known, source)
+	}
+	sort.Strings(known)
+	return "", errors.Errorf("%s %q isn't mapped for this cluster, add %s%s to the volume snapshot location config (mapped: %s)",
+		what, value, prefix, value, strings.Join(known, ", "))
+}
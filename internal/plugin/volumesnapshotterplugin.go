@@ -17,8 +17,16 @@ limitations under the License.
 package plugin
 
 import (
+	"context"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -26,31 +34,154 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 )
 
 // Volume keeps track of volumes created by this plugin
 type Volume struct {
-	volType, az string
-	iops        int64
+	Type string `json:"type"`
+	AZ   string `json:"az,omitempty"`
+	// IOPS is nil for volumes without provisioned IOPS.
+	IOPS *int64 `json:"iops,omitempty"`
+	// Phase is empty once the volume is ready.
+	Phase string `json:"phase,omitempty"`
+	// Error is why creating the volume failed.
+	Error string `json:"error,omitempty"`
 }
 
+// The type and IOPS reported for volumes that weren't created by the plugin.
+const (
+	defaultVolumeType = "orignalVolumeType"
+	defaultVolumeIOPS = 100
+)
+
+// Phases of volumes and snapshots that aren't ready.
+const (
+	PhaseCreating = "Creating"
+	PhaseFailed   = "Failed"
+)
+
 // Snapshot keeps track of snapshots created by this plugin
 type Snapshot struct {
-	volID, az string
-	tags      map[string]string
+	VolumeID          string            `json:"volumeID"`
+	AZ                string            `json:"az,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	// Size is the number of bytes of file data in the snapshot.
+	Size int64 `json:"size"`
+	// StoredSize is the space the snapshot takes up: the part of Size that was
+	// copied rather than hardlinked to the parent snapshot or, for snapshots in
+	// an object store, the size of the stream.
+	StoredSize int64 `json:"storedSize"`
+	// Parent is the snapshot unchanged files were hardlinked to, if the snapshot
+	// is incremental. It may have been deleted since, which doesn't affect this
+	// snapshot.
+	Parent string `json:"parent,omitempty"`
+	// ObjectStore is where the data of the snapshot is kept, if it isn't in the
+	// state directory.
+	ObjectStore *SnapshotObjectStore `json:"objectStore,omitempty"`
+	// Compression and Encryption tell how the stream of a snapshot kept in an
+	// object store is encoded.
+	Compression string              `json:"compression,omitempty"`
+	Encryption  *SnapshotEncryption `json:"encryption,omitempty"`
+	// Dedup is set for snapshots kept as chunks in the dedup repository of the
+	// state directory.
+	Dedup bool `json:"dedup,omitempty"`
+	// CopyStrategy tells how the data of files was captured: copied, hardlinked
+	// to the parent snapshot, cloned, or a mix of these joined with "+", or
+	// streamed.
+	CopyStrategy string `json:"copyStrategy,omitempty"`
+	// DryRun is set for snapshots taken in dry run mode, which only sized the
+	// volume. They have no data.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Phase is empty once the snapshot is ready.
+	Phase string `json:"phase,omitempty"`
+	// Error is why taking the snapshot failed.
+	Error string `json:"error,omitempty"`
 }
 
-// NoOpVolumeSnapshotter is a plugin for containing state for the blockstore
+// NoOpVolumeSnapshotter is a plugin for containing state for the blockstore.
+// Despite its name, it snapshots hostPath, local, NFS and CSI volumes by copying
+// their directory tree, either into the state directory or into an object store,
+// so the volume directories must be visible to the plugin.
+//
+// Velero snapshots several volumes at once, so every method may be called
+// concurrently. The state below is guarded by mu, which isn't held while data is
+// copied, so that copies run in parallel.
 type NoOpVolumeSnapshotter struct {
+	mu     sync.Mutex
 	config map[string]string
 	logrus.FieldLogger
-	volumes   map[string]Volume
-	snapshots map[string]Snapshot
+	// stateDir holds the catalog and the snapshot data, so that volumes and
+	// snapshots survive restarts of the plugin process.
+	stateDir string
+	// volumesDir is where volumes created from snapshots are materialized.
+	volumesDir string
+	catalog    *SnapshotCatalog
+	// local keeps snapshots in the state directory, dedup in the dedup
+	// repository of the state directory, and objectStore in the object store new
+	// snapshots are streamed to, if one is configured.
+	local       *localSnapshotStore
+	dedup       *dedupSnapshotStore
+	objectStore *objectSnapshotStore
+	// keys decrypts snapshots, and encrypts new ones if set.
+	keys      *keyring
+	getClient func() (kubernetes.Interface, error)
+	// mapping translates volumes from other clusters on restore.
+	mapping volumeMapping
+
+	// readers counts the copies reading the data of each snapshot, deleting
+	// marks the snapshots whose data is being deleted, and creating those this
+	// process is taking or importing. Deleting a snapshot waits for its readers,
+	// and snapshots being deleted can't be read. Changes to all three are
+	// broadcast on dataChanged. Snapshots other processes are creating aren't
+	// waited for.
+	readers     map[string]int
+	deleting    map[string]bool
+	creating    map[string]bool
+	dataChanged *sync.Cond
+
+	// In async mode, snapshots and volumes are created by background jobs, at
+	// most as many at once as workers has room for, and taking at least
+	// asyncDuration each.
+	async         bool
+	asyncDuration time.Duration
+	workers       chan struct{}
+	jobs          sync.WaitGroup
+
+	// throttle paces the copies of snapshots, at most as many at once as
+	// snapshotSlots has room for if it's set, and their progress is logged every
+	// progressInterval.
+	throttle         *throttle
+	snapshotSlots    chan struct{}
+	progressInterval time.Duration
+
+	// claims remembers the PersistentVolumeClaim of the volumes GetVolumeID was
+	// called for, which Velero does before snapshotting them, to tag snapshots
+	// with it.
+	claims map[string]string
+	// annotations remembers the annotations of the same volumes, which may
+	// override the snapshot hooks of the config.
+	annotations map[string]map[string]string
+	// stopRetention stops applying the retention policy.
+	stopRetention context.CancelFunc
 }
 
 // NewNoOpVolumeSnapshotter instantiates a NoOpVolumeSnapshotter.
 func NewNoOpVolumeSnapshotter(log logrus.FieldLogger) *NoOpVolumeSnapshotter {
-	return &NoOpVolumeSnapshotter{FieldLogger: log}
+	p := &NoOpVolumeSnapshotter{
+		FieldLogger: log,
+		readers:     make(map[string]int),
+		creating:    make(map[string]bool),
+		deleting:    make(map[string]bool),
+		claims:      make(map[string]string),
+		annotations: make(map[string]map[string]string),
+		getClient: func() (kubernetes.Interface, error) {
+			return GetClient()
+		},
+	}
+	p.dataChanged = sync.NewCond(&p.mu)
+	return p
 }
 
 var _ vsv1.VolumeSnapshotter = (*NoOpVolumeSnapshotter)(nil)
@@ -58,100 +189,840 @@ var _ vsv1.VolumeSnapshotter = (*NoOpVolumeSnapshotter)(nil)
 // Init prepares the VolumeSnapshotter for usage using the provided map of
 // configuration key-value pairs. It returns an error if the VolumeSnapshotter
 // cannot be initialized from the provided config. Note that after v0.10.0, this will happen multiple times.
+//
+// The state directory is taken from the "stateDir" key of the config. Every change
+// to the catalog is applied to a copy reloaded under a lock on the directory and
+// saved right away, so that plugin processes can share it. Snapshots and volumes
+// that were still being created when the catalog was first loaded are marked as
+// failed.
+//
+// Restored volumes are created under "volumesDir", which defaults to the volumes
+// directory of the state directory. With "objectStore", snapshot data is streamed
+// to that object store plugin instead of being kept in the state directory.
+//
+// hostPath and local volumes are read at their path. NFS volumes are read below
+// "nfsMountRoot", where exports are mounted at <server>/<export path>, and CSI
+// volumes in "csiVolumesDir.<driver>", which holds a directory per volume handle.
+//
+// Snapshots streamed to an object store are compressed with "compression", gzip
+// or zstd, and encrypted with the "encryptionKeyVersion" key of the keyring read
+// from "encryptionKeyFile" or "encryptionKeySecret". The key version ends the
+// snapshot ID, and older versions stay usable as long as they're in the keyring.
+//
+// With "dedup", snapshots are kept in the state directory as content-defined
+// chunks of about "dedupChunkSize", shared with every other snapshot that has
+// them.
+//
+// Every snapshot is saved with a manifest of its files. With "verifyAfterCreate",
+// snapshots are read back and checked against it before they're reported as
+// taken.
+//
+// The application of a volume is quiesced while it's copied by the
+// "preSnapshotHook" and "postSnapshotHook", which take up to
+// "snapshotHookTimeout" and fail the snapshot when they fail unless
+// "snapshotHookOnError" is continue. Annotations of the PersistentVolume override
+// them.
+//
+// Snapshot copies read volumes at up to "readBandwidth" and write at up to
+// "writeBandwidth" bytes per second, all together, and at most
+// "maxConcurrentSnapshots" run at once. With "snapshotWindows", copies pause
+// outside of those daily windows. Their progress is logged every
+// "progressInterval".
+//
+// With "dryRun", snapshots only size their volume, recording the estimate in
+// their tags, and volumes can't be created from them.
+//
+// With "async", snapshots and volumes are created in the background by up to
+// "asyncWorkers" jobs at once, each taking at least "asyncDuration".
+//
+// Volumes are restored with the type and availability zone the
+// "volumeTypeMap.<type>" and "availabilityZoneMap.<zone>" keys map the original
+// ones to, and the IOPS of "iopsOverride.<restored type>".
+//
+// With "retention", snapshots selected by its rules are pruned every
+// "retentionInterval", or only logged with "retentionDryRun".
 func (p *NoOpVolumeSnapshotter) Init(config map[string]string) error {
 	p.Infof("Init called", config)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.config = config
 
-	// Make sure we don't overwrite data, now that we can re-initialize the plugin
-	if p.volumes == nil {
-		p.volumes = make(map[string]Volume)
+	stateDir := StateDir(config)
+	p.volumesDir = config["volumesDir"]
+	if p.volumesDir == "" {
+		p.volumesDir = filepath.Join(stateDir, "volumes")
+	}
+
+	if p.catalog == nil || stateDir != p.stateDir {
+		catalog, err := UpdateSnapshotCatalog(stateDir, failInterrupted)
+		if err != nil {
+			return err
+		}
+		p.catalog = catalog
+		p.dedup = newDedupSnapshotStore(p, filepath.Join(stateDir, "repository"))
+		p.stateDir = stateDir
+	}
+
+	p.local = &localSnapshotStore{
+		log:            p,
+		dir:            filepath.Join(p.stateDir, "snapshots"),
+		compareContent: config["incrementalCompareContent"] == "true",
+	}
+	switch config["reflink"] {
+	case "", "auto":
+		p.local.cloneFile = cloneFile
+	case "never":
+	default:
+		return errors.Errorf("invalid reflink %q, use auto or never", config["reflink"])
+	}
+	dedupChunkSize, err := parseDedupChunkSize(config)
+	if err != nil {
+		return err
+	}
+	p.dedup.setChunkSize(dedupChunkSize)
+	p.objectStore = nil
+	location, chunkSize, err := objectSnapshotLocation(config)
+	if err != nil {
+		return err
+	}
+	if location != nil && config["dedup"] == "true" {
+		return errors.New("dedup keeps snapshots in the state directory, it can't be used with objectStore")
+	}
+	if p.keys, err = loadKeyring(config, p.getClient); err != nil {
+		return err
+	}
+	encoding := streamEncoding{compression: config["compression"]}
+	if _, err := newCompressWriter(io.Discard, encoding.compression); err != nil {
+		return err
+	}
+	if p.keys != nil {
+		encoding.encryption = &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: p.keys.current}
+	}
+	if location != nil {
+		if p.objectStore, err = newObjectSnapshotStore(p, *location, chunkSize, p.keys); err != nil {
+			return err
+		}
+		p.objectStore.encoding = encoding
+	} else if encoding.compression != "" || encoding.encryption != nil {
+		return errors.New("compression and encryption apply to snapshots streamed to an object store, configure objectStore")
+	}
+
+	if p.mapping, err = parseVolumeMapping(config); err != nil {
+		return err
+	}
+	if _, err := parseSnapshotHooks(config["preSnapshotHook"], config["postSnapshotHook"], config["snapshotHookTimeout"], config["snapshotHookOnError"], config["allowExecHooks"] == "true"); err != nil {
+		return err
+	}
+	if err := p.initAsync(config); err != nil {
+		return err
+	}
+	if err := p.initThrottle(config); err != nil {
+		return err
+	}
+	return p.initRetention(config)
+}
+
+// failInterrupted marks the snapshots and volumes of a catalog that were still
+// being created as failed, as their jobs didn't survive the plugin process. It
+// reports whether anything changed.
+func failInterrupted(catalog *SnapshotCatalog) bool {
+	const interrupted = "interrupted by a restart of the plugin"
+	changed := false
+	for id, snapshot := range catalog.Snapshots {
+		if snapshot.Phase == PhaseCreating {
+			snapshot.Phase, snapshot.Error = PhaseFailed, interrupted
+			catalog.Snapshots[id] = snapshot
+			changed = true
+		}
+	}
+	for id, volume := range catalog.Volumes {
+		if volume.Phase == PhaseCreating {
+			volume.Phase, volume.Error = PhaseFailed, interrupted
+			catalog.Volumes[id] = volume
+			changed = true
+		}
+	}
+	return changed
+}
+
+// initThrottle reads the bandwidth limits, snapshot windows and
+// "maxConcurrentSnapshots" of the config. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) initThrottle(config map[string]string) error {
+	var err error
+	if p.throttle, err = newThrottle(config); err != nil {
+		return err
+	}
+
+	p.snapshotSlots = nil
+	if value := config["maxConcurrentSnapshots"]; value != "" {
+		slots, err := strconv.Atoi(value)
+		if err != nil || slots < 1 {
+			return errors.Errorf("invalid maxConcurrentSnapshots %q, it must be a positive number", value)
+		}
+		// Jobs that are already running keep the channel they were started with.
+		p.snapshotSlots = make(chan struct{}, slots)
+	}
+
+	p.progressInterval = defaultProgressInterval
+	if value := config["progressInterval"]; value != "" {
+		if p.progressInterval, err = time.ParseDuration(value); err != nil || p.progressInterval <= 0 {
+			return errors.Errorf("invalid progressInterval %q, it must be a positive duration", value)
+		}
+	}
+	return nil
+}
+
+func (p *NoOpVolumeSnapshotter) initAsync(config map[string]string) error {
+	p.async = config["async"] == "true"
+	if !p.async {
+		return nil
+	}
+
+	workers := 4
+	if value := config["asyncWorkers"]; value != "" {
+		var err error
+		if workers, err = strconv.Atoi(value); err != nil || workers < 1 {
+			return errors.Errorf("invalid asyncWorkers %q, it must be a positive number", value)
+		}
 	}
-	if p.snapshots == nil {
-		p.snapshots = make(map[string]Snapshot)
+	// Jobs that are already running keep the channel they were started with.
+	if p.workers == nil || cap(p.workers) != workers {
+		p.workers = make(chan struct{}, workers)
 	}
 
+	p.asyncDuration = 0
+	if value := config["asyncDuration"]; value != "" {
+		var err error
+		if p.asyncDuration, err = time.ParseDuration(value); err != nil {
+			return errors.Wrapf(err, "invalid asyncDuration %q", value)
+		}
+	}
+	return nil
+}
+
+// run runs a job that creates a snapshot or volume: right away, or in the
+// background in async mode. copy moves the data without p.mu held, then finish
+// records the outcome with p.mu held. Background jobs wait for a worker, and
+// aren't finished before asyncDuration. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) run(copy func() error, finish func(error) error) error {
+	if !p.async {
+		p.mu.Unlock()
+		err := copy()
+		p.mu.Lock()
+		return finish(err)
+	}
+
+	workers, duration := p.workers, p.asyncDuration
+	p.jobs.Add(1)
+	go func() {
+		defer p.jobs.Done()
+		workers <- struct{}{}
+		defer func() { <-workers }()
+
+		start := time.Now()
+		err := copy()
+		time.Sleep(duration - time.Since(start))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		finish(err)
+	}()
 	return nil
 }
 
 // CreateVolumeFromSnapshot creates a new volume in the specified
 // availability zone, initialized from the provided snapshot,
 // and with the specified type and IOPS (if using provisioned IOPS).
+// In async mode, the volume is created in the background once the
+// snapshot is ready; IsVolumeReady tells when it's done.
+//
+// The type, zone and IOPS are those of the snapshotted volume. They're
+// translated by the mapping of the config, and restores of volumes it has no
+// mapping for fail. Without a zone, the one recorded with the snapshot is used.
 func (p *NoOpVolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, *iops)
-	var volumeID string
-	for {
-		volumeID := snapshotID + ".vol." + strconv.FormatUint(rand.Uint64(), 10)
-		if _, ok := p.volumes[volumeID]; ok {
-			// Duplicate ? Retry
-			continue
+	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, iops)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.reloadCatalog(); err != nil {
+		return "", err
+	}
+	snapshot, ok := p.catalog.Snapshots[snapshotID]
+	if !ok {
+		return "", errors.Errorf("snapshot %s not found", snapshotID)
+	}
+	if p.deleting[snapshotID] {
+		return "", errors.Errorf("snapshot %s is being deleted", snapshotID)
+	}
+	if snapshot.Phase == PhaseFailed {
+		return "", errors.Errorf("snapshot %s failed: %s", snapshotID, snapshot.Error)
+	}
+	if snapshot.DryRun {
+		return "", errors.Errorf("snapshot %s was taken in dry run mode, it has no data to restore", snapshotID)
+	}
+	if volumeAZ == "" {
+		volumeAZ = snapshot.AZ
+	}
+	targetType, targetAZ, targetIOPS, err := p.mapping.translate(volumeType, volumeAZ, iops)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to restore snapshot %s", snapshotID)
+	}
+	if targetType != volumeType || targetAZ != volumeAZ || !sameIOPS(targetIOPS, iops) {
+		fields := logrus.Fields{
+			"snapshotID": snapshotID,
+			"volumeType": targetType,
+			"volumeAZ":   targetAZ,
 		}
-		break
+		if targetIOPS != nil {
+			fields["iops"] = *targetIOPS
+		}
+		p.WithFields(fields).Infof("Translated volume type %q, availability zone %q and IOPS for this cluster", volumeType, volumeAZ)
+	}
+	volumeType, volumeAZ, iops = targetType, targetAZ, targetIOPS
+
+	volumeID, dir, err := p.newVolume(snapshotID, snapshot)
+	if err != nil {
+		return "", err
 	}
 
-	p.volumes[volumeID] = Volume{
-		volType: volumeType,
-		az:      volumeAZ,
-		iops:    *iops,
+	volume := Volume{
+		Type:  volumeType,
+		AZ:    volumeAZ,
+		Phase: PhaseCreating,
+	}
+	if iops != nil {
+		value := *iops
+		volume.IOPS = &value
+	}
+	if err := p.updateCatalog(func(c *SnapshotCatalog) { c.Volumes[volumeID] = volume }); err != nil {
+		return "", err
+	}
+	p.readers[snapshotID]++
+
+	async := p.async
+	err = p.run(func() error {
+		return errors.Wrapf(p.restoreVolume(snapshotID, dir), "error creating volume from snapshot %s", snapshotID)
+	}, func(err error) error {
+		p.releaseSnapshot(snapshotID)
+		switch {
+		case err == nil:
+			volume.Phase = ""
+		case async:
+			p.WithError(err).WithField("volumeID", volumeID).Error("Failed to create volume")
+			volume.Phase, volume.Error = PhaseFailed, err.Error()
+		default:
+			// The caller gets the error, and never learns about the volume.
+			p.updateCatalog(func(c *SnapshotCatalog) { delete(c.Volumes, volumeID) })
+			return err
+		}
+		if saveErr := p.updateCatalog(func(c *SnapshotCatalog) { c.Volumes[volumeID] = volume }); saveErr != nil && err == nil {
+			return saveErr
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
 	return volumeID, nil
 }
 
+// restoreVolume creates dir from the data of a snapshot, which the caller has
+// registered as a reader of. Snapshots that are still being taken are waited for.
+func (p *NoOpVolumeSnapshotter) restoreVolume(snapshotID, dir string) error {
+	p.mu.Lock()
+	for p.creating[snapshotID] {
+		p.dataChanged.Wait()
+	}
+	snapshot := p.catalog.Snapshots[snapshotID]
+	switch snapshot.Phase {
+	case PhaseCreating:
+		p.mu.Unlock()
+		return errors.Errorf("snapshot %s is being taken by another process", snapshotID)
+	case PhaseFailed:
+		p.mu.Unlock()
+		return errors.Errorf("snapshot %s failed: %s", snapshotID, snapshot.Error)
+	}
+	store, err := p.snapshotStoreFor(snapshot)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return store.Restore(snapshotID, snapshot, dir)
+}
+
+// updateCatalog applies a change to the catalog of the state directory, reloaded
+// under its lock as other plugin processes may share it, and replaces the
+// catalog of p with the result. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) updateCatalog(change func(*SnapshotCatalog)) error {
+	catalog, err := UpdateSnapshotCatalog(p.stateDir, func(c *SnapshotCatalog) bool {
+		change(c)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	p.catalog = catalog
+	return nil
+}
+
+// reloadCatalog picks up the changes other plugin processes made to the catalog.
+// Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) reloadCatalog() error {
+	catalog, err := LoadSnapshotCatalog(p.stateDir)
+	if err != nil {
+		return err
+	}
+	p.catalog = catalog
+	return nil
+}
+
+// releaseSnapshot drops a reader of the data of a snapshot. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) releaseSnapshot(snapshotID string) {
+	if p.readers[snapshotID]--; p.readers[snapshotID] <= 0 {
+		delete(p.readers, snapshotID)
+	}
+	p.dataChanged.Broadcast()
+}
+
+// newVolume returns the ID and directory of a volume to create from a snapshot,
+// with the same source as the snapshotted volume. The volumes created from a
+// snapshot are numbered, skipping the numbers of known volumes and of directories
+// that are already there. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) newVolume(snapshotID string, snapshot Snapshot) (string, string, error) {
+	source, err := parseVolumeID(snapshot.VolumeID)
+	if err != nil {
+		return "", "", err
+	}
+	for n := 1; ; n++ {
+		ref := source.sibling(escapeName(snapshotID)+".vol."+strconv.Itoa(n), p.volumesDir)
+		if _, ok := p.catalog.Volumes[ref.String()]; ok {
+			continue
+		}
+		dir, err := p.volumeDir(ref)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := os.Lstat(dir); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", "", errors.WithStack(err)
+		}
+		return ref.String(), dir, nil
+	}
+}
+
+// volumeDir returns the directory the data of a volume can be found in. Callers
+// hold p.mu.
+func (p *NoOpVolumeSnapshotter) volumeDir(ref volumeRef) (string, error) {
+	switch ref.Source {
+	case sourceNFS:
+		root := p.config["nfsMountRoot"]
+		if root == "" {
+			return "", errors.Errorf("nfsMountRoot must be configured for NFS volume %s", ref)
+		}
+		return filepath.Join(root, ref.Server, filepath.FromSlash(ref.Path)), nil
+	case sourceCSI:
+		dir := p.config["csiVolumesDir."+ref.Driver]
+		if dir == "" {
+			return "", errors.Errorf("csiVolumesDir.%s must be configured for CSI volume %s", ref.Driver, ref)
+		}
+		if strings.Contains(ref.Handle, "/") || ref.Handle == "." || ref.Handle == ".." {
+			return "", errors.Errorf("volume handle of CSI volume %s can't be used as a directory name", ref)
+		}
+		return filepath.Join(dir, ref.Handle), nil
+	default:
+		return ref.Path, nil
+	}
+}
+
 // GetVolumeInfo returns the type and IOPS (if using provisioned IOPS) for
-// the specified volume in the given availability zone.
+// the specified volume in the given availability zone. Velero asks for it before
+// the first snapshot of a volume, so volumes that the plugin doesn't know yet get
+// the default type and IOPS, as long as their directory exists. Volumes that
+// failed to be created return why.
 func (p *NoOpVolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
 	p.Infof("GetVolumeInfo called", volumeID, volumeAZ)
-	if val, ok := p.volumes[volumeID]; ok {
-		iops := val.iops
-		return val.volType, &iops, nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.reloadCatalog(); err != nil {
+		return "", nil, err
+	}
+
+	if val, ok := p.catalog.Volumes[volumeID]; ok {
+		if val.Phase == PhaseFailed {
+			return "", nil, errors.Errorf("volume %s failed: %s", volumeID, val.Error)
+		}
+		var iops *int64
+		if val.IOPS != nil {
+			value := *val.IOPS
+			iops = &value
+		}
+		return val.Type, iops, nil
+	}
+	if !p.volumeExists(volumeID) {
+		return "", nil, errors.New("Volume " + volumeID + " not found")
+	}
+	iops := int64(defaultVolumeIOPS)
+	return defaultVolumeType, &iops, nil
+}
+
+// volumeExists reports whether a volume that isn't in the catalog has a
+// directory. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) volumeExists(volumeID string) bool {
+	ref, err := parseVolumeID(volumeID)
+	if err != nil {
+		return false
 	}
-	return "", nil, errors.New("Volume " + volumeID + " not found")
+	dir, err := p.volumeDir(ref)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
 }
 
-// IsVolumeReady Check if the volume is ready.
+// IsVolumeReady Check if the volume is ready. Volumes created from a snapshot in
+// async mode aren't ready until their data has been copied, and return an error
+// if that failed.
 func (p *NoOpVolumeSnapshotter) IsVolumeReady(volumeID, volumeAZ string) (ready bool, err error) {
 	p.Infof("IsVolumeReady called", volumeID, volumeAZ)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.reloadCatalog(); err != nil {
+		return false, err
+	}
+
+	if volume, ok := p.catalog.Volumes[volumeID]; ok {
+		switch volume.Phase {
+		case PhaseCreating:
+			return false, nil
+		case PhaseFailed:
+			return false, errors.Errorf("volume %s failed: %s", volumeID, volume.Error)
+		}
+		return true, nil
+	}
+	if !p.volumeExists(volumeID) {
+		return false, errors.New("Volume " + volumeID + " not found")
+	}
 	return true, nil
 }
 
 // CreateSnapshot creates a snapshot of the specified volume, and applies any provided
-// set of tags to the snapshot.
+// set of tags to the snapshot. In async mode, the snapshot is taken in the
+// background; restores from it wait for it to be ready.
 func (p *NoOpVolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
 	p.Infof("CreateSnapshot called", volumeID, volumeAZ, tags)
+	ref, err := parseVolumeID(volumeID)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dir, err := p.volumeDir(ref)
+	if err != nil {
+		return "", err
+	}
+	hooks, err := p.snapshotHooks(volumeID)
+	if err != nil {
+		return "", err
+	}
+	store, keySuffix := p.newSnapshotStore()
 	var snapshotID string
 	for {
-		snapshotID = volumeID + ".snap." + strconv.FormatUint(rand.Uint64(), 10)
+		snapshotID = volumeID + ".snap." + strconv.FormatUint(rand.Uint64(), 10) + keySuffix
 		p.Infof("CreateSnapshot trying to create snapshot", snapshotID)
-		if _, ok := p.snapshots[snapshotID]; ok {
+		if _, ok := p.catalog.Snapshots[snapshotID]; ok {
 			// Duplicate ? Retry
 			continue
 		}
 		break
 	}
 
-	// Remember the "original" volume, only required for the first
-	// time.
-	if _, exists := p.volumes[volumeID]; !exists {
-		p.volumes[volumeID] = Volume{
-			volType: "orignalVolumeType",
-			az:      volumeAZ,
-			iops:    100,
-		}
+	// The snapshot is a copy of the directory of the volume. Incremental snapshots
+	// hardlink unchanged files to the last snapshot of the volume, as long as both
+	// are kept in the state directory.
+	snapshot := Snapshot{
+		VolumeID:          volumeID,
+		AZ:                volumeAZ,
+		Tags:              p.snapshotTags(volumeID, tags),
+		CreationTimestamp: time.Now().UTC(),
+		DryRun:            p.config["dryRun"] == "true",
+		Phase:             PhaseCreating,
+	}
+	if store == p.local && p.config["incremental"] == "true" {
+		snapshot.Parent = p.latestLocalSnapshot(ref)
 	}
 
-	// Remember the snapshot
-	p.snapshots[snapshotID] = Snapshot{volID: volumeID,
-		az:   volumeAZ,
-		tags: tags}
+	if err := p.updateCatalog(func(c *SnapshotCatalog) { c.Snapshots[snapshotID] = snapshot }); err != nil {
+		return "", err
+	}
+	p.creating[snapshotID] = true
+	if snapshot.Parent != "" {
+		p.readers[snapshot.Parent]++
+	}
+
+	async := p.async
+	verify := p.config["verifyAfterCreate"] == "true"
+	job := newCopyJob(p.WithField("snapshotID", snapshotID), p.throttle)
+	job.exclude(hooks.markerFiles())
+	job.quiesced = hooks.pre != ""
+	slots, progressInterval := p.snapshotSlots, p.progressInterval
+	var stats copyStats
+	err = p.run(func() error {
+		// Dry runs don't copy anything, so they neither wait nor need the
+		// application to be quiesced.
+		if snapshot.DryRun {
+			var err error
+			stats, err = store.Save(snapshotID, dir, &snapshot, nil)
+			return errors.Wrapf(err, "error sizing volume %s", volumeID)
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				job.log.Info("Waiting for other snapshots to be copied")
+				slots <- struct{}{}
+			}
+			defer func() { <-slots }()
+		}
+		// Applications aren't quiesced until the copy can start.
+		job.waitForWindow()
+		stop := job.reportProgress(progressInterval)
+		defer stop()
+		err := hooks.quiesce(job.log, volumeID, snapshotID, dir, func() error {
+			var err error
+			stats, err = store.Save(snapshotID, dir, &snapshot, job)
+			return err
+		})
+		if err == nil && verify {
+			err = verifyCreated(p, store, snapshotID, snapshot)
+		}
+		return errors.Wrapf(err, "error snapshotting volume %s", volumeID)
+	}, func(err error) error {
+		if snapshot.Parent != "" {
+			p.releaseSnapshot(snapshot.Parent)
+		}
+		// Restores and deletions may be waiting for the snapshot.
+		defer p.dataChanged.Broadcast()
+		delete(p.creating, snapshotID)
+
+		switch {
+		case err == nil && snapshot.DryRun:
+			p.WithFields(logrus.Fields{
+				"snapshotID": snapshotID,
+				"volumeID":   volumeID,
+				"files":      stats.Files,
+				"dirs":       stats.Dirs,
+				"symlinks":   stats.Symlinks,
+				"bytes":      stats.Bytes,
+			}).Info("Dry run, sized volume data without copying it")
+			snapshot.Phase = ""
+		case err == nil:
+			p.WithFields(logrus.Fields{
+				"snapshotID":     snapshotID,
+				"parent":         snapshot.Parent,
+				"files":          stats.Files,
+				"bytes":          stats.Bytes,
+				"linkedFiles":    stats.LinkedFiles,
+				"linkedBytes":    stats.LinkedBytes,
+				"reflinkedFiles": stats.ReflinkedFiles,
+				"strategy":       snapshot.CopyStrategy,
+				"storedBytes":    snapshot.StoredSize,
+			}).Info("Copied volume data")
+			snapshot.Phase = ""
+		case async:
+			p.WithError(err).WithField("snapshotID", snapshotID).Error("Failed to take snapshot")
+			snapshot.Phase, snapshot.Error = PhaseFailed, err.Error()
+		default:
+			// The caller gets the error, and never learns about the snapshot.
+			p.updateCatalog(func(c *SnapshotCatalog) { delete(c.Snapshots, snapshotID) })
+			return err
+		}
+
+		saveErr := p.updateCatalog(func(c *SnapshotCatalog) {
+			// Remember the "original" volume, only required for the first
+			// time.
+			if _, exists := c.Volumes[volumeID]; !exists && snapshot.Phase == "" && !snapshot.DryRun {
+				iops := int64(defaultVolumeIOPS)
+				c.Volumes[volumeID] = Volume{
+					Type: defaultVolumeType,
+					AZ:   volumeAZ,
+					IOPS: &iops,
+				}
+			}
+			// Remember the snapshot
+			c.Snapshots[snapshotID] = snapshot
+		})
+		if saveErr != nil && err == nil {
+			return saveErr
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
 
 	p.Infof("CreateSnapshot returning", snapshotID)
 	return snapshotID, nil
 }
 
-// DeleteSnapshot deletes the specified volume snapshot.
+// snapshotTags returns the tags Velero passed for a snapshot, with the PVC of the
+// volume if it's known. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) snapshotTags(volumeID string, tags map[string]string) map[string]string {
+	claim, ok := p.claims[volumeID]
+	if _, tagged := tags[PVCTag]; !ok || tagged {
+		return tags
+	}
+	withClaim := map[string]string{PVCTag: claim}
+	for key, value := range tags {
+		withClaim[key] = value
+	}
+	return withClaim
+}
+
+// newSnapshotStore returns the store new snapshots go to, and what ends the IDs
+// of snapshots kept in it. Callers hold p.mu.
+func (p *NoOpVolumeSnapshotter) newSnapshotStore() (snapshotStore, string) {
+	switch {
+	case p.config["dryRun"] == "true":
+		return dryRunSnapshotStore{}, ""
+	case p.objectStore != nil:
+		if encryption := p.objectStore.encoding.encryption; encryption != nil {
+			return p.objectStore, snapshotIDKeySuffix + encryption.KeyVersion
+		}
+		return p.objectStore, ""
+	case p.config["dedup"] == "true":
+		return p.dedup, ""
+	default:
+		return p.local, ""
+	}
+}
+
+// latestLocalSnapshot returns the most recent snapshot of a volume kept in the
+// state directory, or an empty string if there is none. Volume IDs are compared
+// parsed, as hostPath volumes used to be identified by their path only. Callers
+// hold p.mu.
+func (p *NoOpVolumeSnapshotter) latestLocalSnapshot(volume volumeRef) string {
+	var latest string
+	var latestTime time.Time
+	for id, snapshot := range p.catalog.Snapshots {
+		if ref, err := parseVolumeID(snapshot.VolumeID); err != nil || ref != volume {
+			continue
+		}
+		if snapshot.ObjectStore == nil && !snapshot.Dedup && !snapshot.DryRun && snapshot.Phase == "" && !p.deleting[id] && snapshot.CreationTimestamp.After(latestTime) {
+			latest, latestTime = id, snapshot.CreationTimestamp
+		}
+	}
+	return latest
+}
+
+// DeleteSnapshot deletes the specified volume snapshot. It waits for the snapshot
+// to be taken, and for restores from it and incremental snapshots based on it to
+// finish reading it.
 func (p *NoOpVolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
 	p.Infof("DeleteSnapshot called", snapshotID)
-	delete(p.snapshots, snapshotID)
-	return nil
+	p.mu.Lock()
+	for p.readers[snapshotID] > 0 || p.deleting[snapshotID] || p.creating[snapshotID] {
+		p.dataChanged.Wait()
+	}
+	if err := p.reloadCatalog(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if p.catalog.Snapshots[snapshotID].Phase == PhaseCreating {
+		p.mu.Unlock()
+		return errors.Errorf("snapshot %s is being taken by another process", snapshotID)
+	}
+	// Snapshots that aren't in the catalog may still have left data behind in the
+	// state directory.
+	var store snapshotStore = p.local
+	snapshot, ok := p.catalog.Snapshots[snapshotID]
+	if ok {
+		var err error
+		if store, err = p.snapshotStoreFor(snapshot); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+	p.deleting[snapshotID] = true
+	p.mu.Unlock()
+
+	err := store.Delete(snapshotID, snapshot)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.deleting, snapshotID)
+	p.dataChanged.Broadcast()
+	if err != nil {
+		return errors.Wrapf(err, "error deleting the data of snapshot %s", snapshotID)
+	}
+	return p.updateCatalog(func(c *SnapshotCatalog) { delete(c.Snapshots, snapshotID) })
+}
+
+// SnapshotIDs returns the IDs of the snapshots in the catalog that have all the
+// given tags, sorted.
+func (p *NoOpVolumeSnapshotter) SnapshotIDs(tags map[string]string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.reloadCatalog(); err != nil {
+		p.WithError(err).Warn("Unable to reload the catalog, listing the snapshots known to this process")
+	}
+	return p.catalog.SnapshotsTagged(tags)
+}
+
+// snapshotStoreFor returns the store holding the data of a snapshot, which may
+// not be the one new snapshots go to if the config changed since. Callers hold
+// p.mu.
+func (p *NoOpVolumeSnapshotter) snapshotStoreFor(snapshot Snapshot) (snapshotStore, error) {
+	if snapshot.DryRun {
+		return dryRunSnapshotStore{}, nil
+	}
+	if snapshot.Dedup {
+		return p.dedup, nil
+	}
+	if snapshot.ObjectStore == nil {
+		return p.local, nil
+	}
+	location := *snapshot.ObjectStore
+	location.Chunks = 0
+	if p.objectStore != nil && reflect.DeepEqual(location, p.objectStore.location) {
+		return p.objectStore, nil
+	}
+	return newObjectSnapshotStore(p, location, defaultChunkSize, p.keys)
+}
+
+// copyTreeAtomic copies src to dst through a temporary directory next to dst,
+// so that dst only ever exists complete.
+func copyTreeAtomic(log logrus.FieldLogger, src, dst string, opts copyOptions) (copyStats, error) {
+	var stats copyStats
+	err := createTreeAtomic(dst, func(partial string) error {
+		var err error
+		stats, err = copyTree(log, src, partial, opts)
+		return err
+	})
+	return stats, err
+}
+
+// createTreeAtomic creates the directory tree dst by having create fill a
+// temporary directory next to it, which is then renamed into place.
+func createTreeAtomic(dst string, create func(partial string) error) error {
+	partial := dst + ".partial"
+	if err := removeTree(partial); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := create(partial); err != nil {
+		removeTree(partial)
+		return err
+	}
+	return errors.WithStack(os.Rename(partial, dst))
 }
 
 // GetVolumeID returns the specific identifier for the PersistentVolume.
@@ -163,15 +1034,18 @@ func (p *NoOpVolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured)
 		return "", errors.WithStack(err)
 	}
 
-	if pv.Spec.HostPath == nil {
-		return "", nil
+	ref, err := volumeRefFromPV(pv)
+	if err != nil {
+		return "", err
 	}
 
-	if pv.Spec.HostPath.Path == "" {
-		return "", errors.New("spec.hostPath.path not found")
+	p.mu.Lock()
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		p.claims[ref.String()] = claim.Namespace + "/" + claim.Name
 	}
-
-	return pv.Spec.HostPath.Path, nil
+	p.annotations[ref.String()] = pv.Annotations
+	p.mu.Unlock()
+	return ref.String(), nil
 }
 
 // SetVolumeID sets the specific identifier for the PersistentVolume.
@@ -183,11 +1057,13 @@ func (p *NoOpVolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured,
 		return nil, errors.WithStack(err)
 	}
 
-	if pv.Spec.HostPath == nil {
-		return nil, errors.New("spec.hostPath.path not found")
+	ref, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ref.applyTo(pv); err != nil {
+		return nil, err
 	}
-
-	pv.Spec.HostPath.Path = volumeID
 
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
@@ -0,0 +1,902 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testObjectStore = "example.io/test-object-store"
+
+// TestVolumeSnapshotterRoundTrip goes through the calls Velero makes to back up a
+// volume and restore it, with a restart of the plugin in between.
+func TestVolumeSnapshotterRoundTrip(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	keyFile := newTestKeyFile(t, "v1")
+
+	for name, config := range map[string]map[string]string{
+		"local":        {},
+		"incremental":  {"incremental": "true"},
+		"dedup":        {"dedup": "true", "dedupChunkSize": "1Ki"},
+		"object store": {"objectStore": testObjectStore, "objectStoreBucket": "snapshots", "objectStoreChunkSize": "1Ki"},
+		"gzip":         {"objectStore": testObjectStore, "objectStoreBucket": "snapshots", "compression": "gzip"},
+		"zstd encrypted": {"objectStore": testObjectStore, "objectStoreBucket": "snapshots", "objectStoreChunkSize": "1Ki",
+			"compression": "zstd", "encryptionKeyFile": keyFile},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config["stateDir"] = t.TempDir()
+			dir := newTestVolume(t)
+			volume := "hostPath:" + dir
+
+			p := newTestSnapshotter(t, config)
+			volumeType, iops, err := p.GetVolumeInfo(volume, "zone-a")
+			require.NoError(t, err)
+			assert.Equal(t, defaultVolumeType, volumeType)
+			require.NotNil(t, iops)
+			assert.EqualValues(t, defaultVolumeIOPS, *iops)
+
+			snapshotID, err := p.CreateSnapshot(volume, "zone-a", map[string]string{"velero.io/backup": "b1"})
+			require.NoError(t, err)
+
+			// Restores happen in another plugin process, which only has the catalog.
+			p = newTestSnapshotter(t, config)
+			requestedIOPS := int64(3000)
+			first, err := p.CreateVolumeFromSnapshot(snapshotID, "fast", "zone-b", &requestedIOPS)
+			require.NoError(t, err)
+			assert.Equal(t, "hostPath:"+filepath.Join(p.volumesDir, escapeName(snapshotID)+".vol.1"), first)
+			assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, first)))
+
+			volumeType, iops, err = p.GetVolumeInfo(first, "zone-b")
+			require.NoError(t, err)
+			assert.Equal(t, "fast", volumeType)
+			require.NotNil(t, iops)
+			assert.EqualValues(t, 3000, *iops)
+
+			second, err := p.CreateVolumeFromSnapshot(snapshotID, "slow", "zone-b", nil)
+			require.NoError(t, err)
+			assert.Equal(t, "hostPath:"+filepath.Join(p.volumesDir, escapeName(snapshotID)+".vol.2"), second)
+			assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, second)))
+
+			volumeType, iops, err = p.GetVolumeInfo(second, "zone-b")
+			require.NoError(t, err)
+			assert.Equal(t, "slow", volumeType)
+			assert.Nil(t, iops)
+
+			_, err = p.CreateVolumeFromSnapshot("missing", "fast", "zone-b", nil)
+			assert.Error(t, err)
+
+			require.NoError(t, p.DeleteSnapshot(snapshotID))
+			_, err = p.CreateVolumeFromSnapshot(snapshotID, "fast", "zone-b", nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestVolumeSnapshotterSkipsTakenVolumeIDs(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+
+	// A directory left behind, e.g. by a previous state directory.
+	taken := filepath.Join(p.volumesDir, escapeName(snapshotID)+".vol.1")
+	require.NoError(t, os.MkdirAll(taken, 0755))
+
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "hostPath:"+filepath.Join(p.volumesDir, escapeName(snapshotID)+".vol.2"), volumeID)
+}
+
+// TestVolumeSnapshotterSources snapshots and restores a PersistentVolume of every
+// supported source, the way Velero does.
+func TestVolumeSnapshotterSources(t *testing.T) {
+	nfsRoot := t.TempDir()
+	csiDir := t.TempDir()
+	config := map[string]string{
+		"nfsMountRoot":                      nfsRoot,
+		"csiVolumesDir.hostpath.csi.k8s.io": csiDir,
+	}
+
+	for name, test := range map[string]struct {
+		dir    string
+		source v1.PersistentVolumeSource
+		// location returns where the source points at.
+		location func(v1.PersistentVolumeSource) string
+	}{
+		"hostPath": {
+			dir:      filepath.Join(t.TempDir(), "pv"),
+			source:   v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{}},
+			location: func(s v1.PersistentVolumeSource) string { return s.HostPath.Path },
+		},
+		"local": {
+			dir:      filepath.Join(t.TempDir(), "pv"),
+			source:   v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{}},
+			location: func(s v1.PersistentVolumeSource) string { return s.Local.Path },
+		},
+		"nfs": {
+			dir:    filepath.Join(nfsRoot, "nfs.example.com", "exports", "pv"),
+			source: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/pv"}},
+			location: func(s v1.PersistentVolumeSource) string {
+				return filepath.Join(nfsRoot, s.NFS.Server, s.NFS.Path)
+			},
+		},
+		"csi": {
+			dir:      filepath.Join(csiDir, "pv"),
+			source:   v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "hostpath.csi.k8s.io", VolumeHandle: "pv"}},
+			location: func(s v1.PersistentVolumeSource) string { return filepath.Join(csiDir, s.CSI.VolumeHandle) },
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.MkdirAll(filepath.Dir(test.dir), 0755))
+			require.NoError(t, os.Rename(newTestVolume(t), test.dir))
+			if test.source.HostPath != nil {
+				test.source.HostPath.Path = test.dir
+			}
+			if test.source.Local != nil {
+				test.source.Local.Path = test.dir
+			}
+
+			config := copyConfig(config)
+			config["stateDir"] = t.TempDir()
+			p := newTestSnapshotter(t, config)
+
+			pv := newTestPV(t, test.source)
+			volumeID, err := p.GetVolumeID(pv)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(volumeID, name+":"), volumeID)
+
+			snapshotID, err := p.CreateSnapshot(volumeID, "", nil)
+			require.NoError(t, err)
+			restoredID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+			require.NoError(t, err)
+
+			restored, err := p.SetVolumeID(pv, restoredID)
+			require.NoError(t, err)
+			restoredPV := new(v1.PersistentVolume)
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(restored.UnstructuredContent(), restoredPV))
+			restoredDir := test.location(restoredPV.Spec.PersistentVolumeSource)
+			assert.NotEqual(t, test.dir, restoredDir)
+			assert.Equal(t, readTestTree(t, test.dir), readTestTree(t, restoredDir))
+
+			id, err := p.GetVolumeID(restored)
+			require.NoError(t, err)
+			assert.Equal(t, restoredID, id)
+		})
+	}
+}
+
+func TestGetVolumeIDUnsupported(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	for name, source := range map[string]v1.PersistentVolumeSource{
+		"no source":    {},
+		"other source": {ISCSI: &v1.ISCSIPersistentVolumeSource{TargetPortal: "10.0.0.1", IQN: "iqn", Lun: 0}},
+		"empty path":   {HostPath: &v1.HostPathVolumeSource{}},
+		"no handle":    {CSI: &v1.CSIPersistentVolumeSource{Driver: "hostpath.csi.k8s.io"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := p.GetVolumeID(newTestPV(t, source))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSetVolumeIDMismatch(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	pv := newTestPV(t, v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: "a.csi.k8s.io", VolumeHandle: "h"}})
+	_, err := p.SetVolumeID(pv, "csi:b.csi.k8s.io:h")
+	assert.Error(t, err)
+	_, err = p.SetVolumeID(pv, "hostPath:/data")
+	assert.Error(t, err)
+	_, err = p.SetVolumeID(pv, "iscsi:target")
+	assert.Error(t, err)
+}
+
+func TestParseVolumeID(t *testing.T) {
+	for id, expected := range map[string]volumeRef{
+		"/legacy/path":              {Source: sourceHostPath, Path: "/legacy/path"},
+		"hostPath:/data":            {Source: sourceHostPath, Path: "/data"},
+		"local:/mnt/disks/a":        {Source: sourceLocal, Path: "/mnt/disks/a"},
+		"nfs:server:/exports/a:b":   {Source: sourceNFS, Server: "server", Path: "/exports/a:b"},
+		"csi:driver.io:handle:with": {Source: sourceCSI, Driver: "driver.io", Handle: "handle:with"},
+	} {
+		ref, err := parseVolumeID(id)
+		require.NoError(t, err, id)
+		assert.Equal(t, expected, ref)
+		if id != "/legacy/path" {
+			assert.Equal(t, id, ref.String())
+		}
+	}
+	for _, id := range []string{"", "hostPath:", "nfs:server", "csi::handle", "rbd:pool/image"} {
+		_, err := parseVolumeID(id)
+		assert.Error(t, err, id)
+	}
+}
+
+// TestVolumeSnapshotterConcurrency snapshots, restores and deletes from many
+// goroutines at once. Run it with -race to check that the snapshotter's state is
+// guarded.
+func TestVolumeSnapshotterConcurrency(t *testing.T) {
+	const volumes, snapshotsPerVolume, restoresPerSnapshot = 4, 8, 3
+	config := map[string]string{"stateDir": t.TempDir(), "incremental": "true"}
+	p := newTestSnapshotter(t, config)
+
+	volumeIDs := make([]string, volumes)
+	trees := make([]map[string]string, volumes)
+	for i := range volumeIDs {
+		dir := newTestVolume(t)
+		volumeIDs[i] = "hostPath:" + dir
+		trees[i] = readTestTree(t, dir)
+	}
+
+	// Snapshot every volume several times at once.
+	snapshotIDs := make([][]string, volumes)
+	var wg sync.WaitGroup
+	for i := range volumeIDs {
+		snapshotIDs[i] = make([]string, snapshotsPerVolume)
+		for j := range snapshotIDs[i] {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				_, _, err := p.GetVolumeInfo(volumeIDs[i], "")
+				assert.NoError(t, err)
+				snapshotIDs[i][j], err = p.CreateSnapshot(volumeIDs[i], "", nil)
+				assert.NoError(t, err)
+			}(i, j)
+		}
+	}
+	wg.Wait()
+	require.Len(t, p.catalog.Snapshots, volumes*snapshotsPerVolume)
+
+	// Restore every snapshot several times, while deleting every other snapshot.
+	// Restores racing with a deletion may fail, but never leave a partial volume.
+	var mu sync.Mutex
+	restored := make(map[string]int)
+	for i := range snapshotIDs {
+		for j, snapshotID := range snapshotIDs[i] {
+			deleted := j%2 == 1
+			for k := 0; k < restoresPerSnapshot; k++ {
+				wg.Add(1)
+				go func(i int, snapshotID string) {
+					defer wg.Done()
+					volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "type", "", nil)
+					if deleted && err != nil {
+						return
+					}
+					if !assert.NoError(t, err) {
+						return
+					}
+					volumeType, _, err := p.GetVolumeInfo(volumeID, "")
+					assert.NoError(t, err)
+					assert.Equal(t, "type", volumeType)
+
+					mu.Lock()
+					defer mu.Unlock()
+					restored[volumeID] = i
+				}(i, snapshotID)
+			}
+			if deleted {
+				wg.Add(1)
+				go func(snapshotID string) {
+					defer wg.Done()
+					assert.NoError(t, p.DeleteSnapshot(snapshotID))
+				}(snapshotID)
+			}
+		}
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, len(restored), volumes*snapshotsPerVolume/2*restoresPerSnapshot)
+	for volumeID, i := range restored {
+		assert.Equal(t, trees[i], readTestTree(t, testVolumeDir(t, p, volumeID)))
+	}
+
+	// Take incremental snapshots while the snapshots they may be based on are deleted.
+	latest := make([]string, volumes)
+	for i := range volumeIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			latest[i], err = p.CreateSnapshot(volumeIDs[i], "", nil)
+			assert.NoError(t, err)
+		}(i)
+		for j := 0; j < snapshotsPerVolume; j += 2 {
+			wg.Add(1)
+			go func(snapshotID string) {
+				defer wg.Done()
+				assert.NoError(t, p.DeleteSnapshot(snapshotID))
+			}(snapshotIDs[i][j])
+		}
+	}
+	wg.Wait()
+
+	assert.Len(t, p.catalog.Snapshots, volumes)
+	for i, snapshotID := range latest {
+		volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+		require.NoError(t, err)
+		assert.Equal(t, trees[i], readTestTree(t, testVolumeDir(t, p, volumeID)))
+	}
+
+	// The catalog on disk has seen every change.
+	catalog, err := LoadSnapshotCatalog(config["stateDir"])
+	require.NoError(t, err)
+	assert.Len(t, catalog.Snapshots, len(p.catalog.Snapshots))
+	assert.Len(t, catalog.Volumes, len(p.catalog.Volumes))
+	for snapshotID := range p.catalog.Snapshots {
+		assert.Contains(t, catalog.Snapshots, snapshotID)
+	}
+}
+
+func TestVolumeSnapshotterAsync(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir(), "async": "true", "asyncWorkers": "2", "asyncDuration": "200ms"}
+	p := newTestSnapshotter(t, config)
+	dir := newTestVolume(t)
+
+	start := time.Now()
+	snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	// The volume is restored once the snapshot is ready.
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "fast", "", nil)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	ready, err := p.IsVolumeReady(volumeID, "")
+	require.NoError(t, err)
+	assert.False(t, ready)
+	volumeType, _, err := p.GetVolumeInfo(volumeID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", volumeType)
+
+	assert.Eventually(t, func() bool {
+		ready, err := p.IsVolumeReady(volumeID, "")
+		require.NoError(t, err)
+		return ready
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, volumeID)))
+	assert.Empty(t, p.catalog.Snapshots[snapshotID].Phase)
+
+	require.NoError(t, p.DeleteSnapshot(snapshotID))
+	p.jobs.Wait()
+}
+
+func TestVolumeSnapshotterAsyncFailures(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "async": "true"})
+
+	missing, err := p.CreateSnapshot("hostPath:"+filepath.Join(t.TempDir(), "missing"), "", nil)
+	require.NoError(t, err)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+	p.jobs.Wait()
+
+	assert.Equal(t, PhaseFailed, p.catalog.Snapshots[missing].Phase)
+	assert.NotEmpty(t, p.catalog.Snapshots[missing].Error)
+	_, err = p.CreateVolumeFromSnapshot(missing, "", "", nil)
+	assert.Error(t, err)
+
+	// Restores fail once the data of the snapshot is gone.
+	require.NoError(t, os.RemoveAll(p.local.dataDir(snapshotID)))
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	p.jobs.Wait()
+	ready, err := p.IsVolumeReady(volumeID, "")
+	assert.Error(t, err)
+	assert.False(t, ready)
+	_, _, err = p.GetVolumeInfo(volumeID, "")
+	assert.Error(t, err)
+
+	// Failed snapshots are kept until Velero deletes them.
+	require.NoError(t, p.DeleteSnapshot(missing))
+	assert.NotContains(t, p.catalog.Snapshots, missing)
+}
+
+func TestVolumeSnapshotterFailsInterruptedJobs(t *testing.T) {
+	stateDir := t.TempDir()
+	catalog := NewSnapshotCatalog()
+	catalog.Snapshots["hostPath:/data.snap.1"] = Snapshot{VolumeID: "hostPath:/data", Phase: PhaseCreating}
+	catalog.Volumes["hostPath:/restored"] = Volume{Phase: PhaseCreating}
+	require.NoError(t, catalog.Save(stateDir))
+
+	p := newTestSnapshotter(t, map[string]string{"stateDir": stateDir})
+	assert.Equal(t, PhaseFailed, p.catalog.Snapshots["hostPath:/data.snap.1"].Phase)
+	_, err := p.IsVolumeReady("hostPath:/restored", "")
+	assert.Error(t, err)
+	// Deleting an interrupted snapshot doesn't wait for it.
+	require.NoError(t, p.DeleteSnapshot("hostPath:/data.snap.1"))
+
+	catalog, err = LoadSnapshotCatalog(stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, PhaseFailed, catalog.Volumes["hostPath:/restored"].Phase)
+}
+
+// TestVolumeSnapshotterReloadsCatalog restarts the plugin and checks that the
+// snapshots and volumes it knew about are loaded from the catalog.
+func TestVolumeSnapshotterReloadsCatalog(t *testing.T) {
+	config := map[string]string{"stateDir": t.TempDir()}
+	dir := newTestVolume(t)
+	p := newTestSnapshotter(t, config)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "zone-a", map[string]string{"velero.io/backup": "b1"})
+	require.NoError(t, err)
+	iops := int64(100)
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "fast", "zone-b", &iops)
+	require.NoError(t, err)
+	before := p.catalog
+
+	p = newTestSnapshotter(t, config)
+	assert.Equal(t, before, p.catalog)
+	assert.Equal(t, []string{snapshotID}, p.SnapshotIDs(map[string]string{"velero.io/backup": "b1"}))
+	ready, err := p.IsVolumeReady(volumeID, "zone-b")
+	require.NoError(t, err)
+	assert.True(t, ready)
+	volumeType, gotIOPS, err := p.GetVolumeInfo(volumeID, "zone-b")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", volumeType)
+	require.NotNil(t, gotIOPS)
+	assert.EqualValues(t, 100, *gotIOPS)
+
+	restored, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, restored)))
+}
+
+// TestVolumeSnapshotterSharedStateDir runs two plugin processes on one state
+// directory, which must not lose each other's changes to the catalog.
+func TestVolumeSnapshotterSharedStateDir(t *testing.T) {
+	const snapshotsPerProcess = 8
+	config := map[string]string{"stateDir": t.TempDir()}
+	processes := []*NoOpVolumeSnapshotter{newTestSnapshotter(t, config), newTestSnapshotter(t, config)}
+
+	snapshotIDs := make([][]string, len(processes))
+	var wg sync.WaitGroup
+	for i, p := range processes {
+		snapshotIDs[i] = make([]string, snapshotsPerProcess)
+		volumeID := "hostPath:" + newTestVolume(t)
+		for j := range snapshotIDs[i] {
+			wg.Add(1)
+			go func(p *NoOpVolumeSnapshotter, i, j int) {
+				defer wg.Done()
+				var err error
+				snapshotIDs[i][j], err = p.CreateSnapshot(volumeID, "", nil)
+				assert.NoError(t, err)
+			}(p, i, j)
+		}
+	}
+	wg.Wait()
+
+	catalog, err := LoadSnapshotCatalog(config["stateDir"])
+	require.NoError(t, err)
+	require.Len(t, catalog.Snapshots, len(processes)*snapshotsPerProcess)
+	for _, ids := range snapshotIDs {
+		for _, id := range ids {
+			assert.Contains(t, catalog.Snapshots, id)
+		}
+	}
+
+	// Each process sees, restores and deletes the snapshots of the other.
+	first, second := processes[0], processes[1]
+	assert.Len(t, first.SnapshotIDs(nil), len(processes)*snapshotsPerProcess)
+	volumeID, err := first.CreateVolumeFromSnapshot(snapshotIDs[1][0], "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, second.DeleteSnapshot(snapshotIDs[0][0]))
+	assert.NotContains(t, first.SnapshotIDs(nil), snapshotIDs[0][0])
+
+	catalog, err = LoadSnapshotCatalog(config["stateDir"])
+	require.NoError(t, err)
+	assert.Len(t, catalog.Snapshots, len(processes)*snapshotsPerProcess-1)
+	assert.Contains(t, catalog.Volumes, volumeID)
+
+	// A volume the other process is still copying in async mode isn't ready,
+	// even though its directory is already there.
+	_, err = UpdateSnapshotCatalog(config["stateDir"], func(catalog *SnapshotCatalog) bool {
+		volume := catalog.Volumes[volumeID]
+		volume.Phase = PhaseCreating
+		catalog.Volumes[volumeID] = volume
+		return true
+	})
+	require.NoError(t, err)
+	ready, err := second.IsVolumeReady(volumeID, "")
+	require.NoError(t, err)
+	assert.False(t, ready)
+}
+
+// TestVolumeSnapshotterDeletesIncrementalParents deletes the snapshots later
+// incremental snapshots hardlinked their files to, which must not affect them.
+func TestVolumeSnapshotterDeletesIncrementalParents(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir(), "incremental": "true"})
+	dir := newTestVolume(t)
+	volumeID := "hostPath:" + dir
+
+	var snapshotIDs []string
+	var trees []map[string]string
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), []byte("changed"), 0600))
+		}
+		snapshotID, err := p.CreateSnapshot(volumeID, "", nil)
+		require.NoError(t, err)
+		snapshotIDs = append(snapshotIDs, snapshotID)
+		trees = append(trees, readTestTree(t, dir))
+	}
+	for i := 1; i < len(snapshotIDs); i++ {
+		snapshot := p.catalog.Snapshots[snapshotIDs[i]]
+		require.Equal(t, snapshotIDs[i-1], snapshot.Parent)
+		require.Contains(t, snapshot.CopyStrategy, strategyHardlink)
+	}
+
+	// Delete the first snapshot, then the one in the middle of the chain.
+	for _, deleted := range snapshotIDs[:2] {
+		require.NoError(t, p.DeleteSnapshot(deleted))
+		_, err := os.Stat(p.local.dataDir(deleted))
+		assert.True(t, os.IsNotExist(err), "data of %s left behind", deleted)
+	}
+	last := snapshotIDs[2]
+	restored, err := p.CreateVolumeFromSnapshot(last, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, trees[2], readTestTree(t, testVolumeDir(t, p, restored)))
+	_, err = p.local.Manifest(last, p.catalog.Snapshots[last])
+	require.NoError(t, err)
+
+	// Snapshots taken after the deletions are based on the last one left.
+	next, err := p.CreateSnapshot(volumeID, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, last, p.catalog.Snapshots[next].Parent)
+}
+
+func TestVolumeSnapshotterMapsVolumeInfo(t *testing.T) {
+	config := map[string]string{
+		"stateDir":                       t.TempDir(),
+		"volumeTypeMap.gp2":              "standard",
+		"volumeTypeMap.io1":              "fast",
+		"availabilityZoneMap.us-east-1a": "zone-a",
+		"iopsOverride.fast":              "3000",
+	}
+	p := newTestSnapshotter(t, config)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "us-east-1a", nil)
+	require.NoError(t, err)
+
+	iops := int64(100)
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "gp2", "us-east-1a", &iops)
+	require.NoError(t, err)
+	volumeType, volumeIOPS, err := p.GetVolumeInfo(volumeID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "standard", volumeType)
+	assert.Equal(t, int64(100), *volumeIOPS)
+	assert.Equal(t, "zone-a", p.catalog.Volumes[volumeID].AZ)
+
+	// Without a zone, the zone of the snapshot is translated.
+	volumeID, err = p.CreateVolumeFromSnapshot(snapshotID, "io1", "", &iops)
+	require.NoError(t, err)
+	volumeType, volumeIOPS, err = p.GetVolumeInfo(volumeID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", volumeType)
+	assert.Equal(t, int64(3000), *volumeIOPS)
+	assert.Equal(t, "zone-a", p.catalog.Volumes[volumeID].AZ)
+
+	_, err = p.CreateVolumeFromSnapshot(snapshotID, "sc1", "us-east-1a", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `volume type "sc1" isn't mapped for this cluster, add volumeTypeMap.sc1 to the volume snapshot location config (mapped: gp2, io1)`)
+	_, err = p.CreateVolumeFromSnapshot(snapshotID, "gp2", "us-east-1b", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `availability zone "us-east-1b" isn't mapped`)
+	assert.Len(t, p.catalog.Volumes, 3)
+
+	config["iopsOverride.fast"] = "many"
+	assert.Error(t, p.Init(config))
+}
+
+// TestVolumeSnapshotterLogsTranslations checks that restores are only logged as
+// translated when the type, zone or value of the IOPS changes.
+func TestVolumeSnapshotterLogsTranslations(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	p := NewNoOpVolumeSnapshotter(logger)
+	require.NoError(t, p.Init(map[string]string{
+		"stateDir":           t.TempDir(),
+		"volumeTypeMap.io1":  "fast",
+		"volumeTypeMap.fast": "fast",
+		"volumeTypeMap.gp2":  "gp2",
+		"iopsOverride.fast":  "3000",
+	}))
+	snapshotID, err := p.CreateSnapshot("hostPath:"+newTestVolume(t), "", nil)
+	require.NoError(t, err)
+
+	iops := func(value int64) *int64 { return &value }
+	for name, test := range map[string]struct {
+		volumeType string
+		iops       *int64
+		translated bool
+		targetIOPS interface{}
+	}{
+		"unchanged":                   {volumeType: "gp2", iops: iops(100)},
+		"unchanged without IOPS":      {volumeType: "gp2"},
+		"overridden to the same IOPS": {volumeType: "fast", iops: iops(3000)},
+		"overridden IOPS":             {volumeType: "fast", iops: iops(100), translated: true, targetIOPS: int64(3000)},
+		"overridden missing IOPS":     {volumeType: "fast", translated: true, targetIOPS: int64(3000)},
+		"translated type":             {volumeType: "io1", iops: iops(3000), translated: true, targetIOPS: int64(3000)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs.Reset()
+			_, err := p.CreateVolumeFromSnapshot(snapshotID, test.volumeType, "", test.iops)
+			require.NoError(t, err)
+
+			var translations []*logrus.Entry
+			for _, entry := range logs.AllEntries() {
+				if strings.HasPrefix(entry.Message, "Translated") {
+					translations = append(translations, entry)
+				}
+			}
+			if !test.translated {
+				assert.Empty(t, translations)
+				return
+			}
+			require.Len(t, translations, 1)
+			assert.Equal(t, test.targetIOPS, translations[0].Data["iops"])
+		})
+	}
+}
+
+func TestVolumeSnapshotterKeyRotation(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	keyFile := newTestKeyFile(t, "v1", "v2")
+	config := map[string]string{
+		"stateDir":             t.TempDir(),
+		"objectStore":          testObjectStore,
+		"objectStoreBucket":    "snapshots",
+		"encryptionKeyFile":    keyFile,
+		"encryptionKeyVersion": "v1",
+	}
+	dir := newTestVolume(t)
+
+	p := newTestSnapshotter(t, config)
+	old, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(old, ".key-v1"), old)
+	assert.Equal(t, "v1", keyVersionFromID(old))
+	assert.Equal(t, &SnapshotEncryption{Algorithm: encryptionAESGCM, KeyVersion: "v1"}, p.catalog.Snapshots[old].Encryption)
+
+	// The stored data isn't readable without the key.
+	stored := readTestTree(t, objectStoreRoot)
+	for path, content := range readTestTree(t, dir) {
+		for key, data := range stored {
+			if len(content) > 16 {
+				assert.NotContains(t, data, content, "%s is stored in clear in %s", path, key)
+			}
+		}
+	}
+
+	config["encryptionKeyVersion"] = "v2"
+	p = newTestSnapshotter(t, config)
+	current, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", keyVersionFromID(current))
+	for _, snapshotID := range []string{old, current} {
+		volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+		require.NoError(t, err)
+		assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, volumeID)))
+	}
+
+	// Snapshots whose key was dropped from the keyring can't be restored.
+	config["encryptionKeyFile"] = newTestKeyFile(t, "v2")
+	config["encryptionKeyVersion"] = ""
+	p = newTestSnapshotter(t, config)
+	_, err = p.CreateVolumeFromSnapshot(old, "", "", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key version v1, which isn't in the keyring")
+
+	for _, invalid := range []map[string]string{
+		{"encryptionKeyFile": keyFile},
+		{"encryptionKeyFile": keyFile, "encryptionKeyVersion": "v3"},
+		{"encryptionKeyVersion": "v1"},
+		{"compression": "lz4", "objectStore": testObjectStore, "objectStoreBucket": "snapshots"},
+		{"compression": "gzip"},
+	} {
+		invalid["stateDir"] = config["stateDir"]
+		assert.Error(t, NewNoOpVolumeSnapshotter(newTestLogger()).Init(invalid), "%v", invalid)
+	}
+}
+
+func TestVolumeSnapshotterKeySecret(t *testing.T) {
+	objectStoreRoot := t.TempDir()
+	RegisterSnapshotObjectStore(testObjectStore, func(log logrus.FieldLogger) (interface{}, error) {
+		return NewFileObjectStoreAt(log, objectStoreRoot), nil
+	})
+	key := make([]byte, 32)
+	client := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "snapshot-keys"},
+		Data:       map[string][]byte{"2023-03": key},
+	})
+
+	p := NewNoOpVolumeSnapshotter(newTestLogger())
+	p.getClient = func() (kubernetes.Interface, error) { return client, nil }
+	require.NoError(t, p.Init(map[string]string{
+		"stateDir":            t.TempDir(),
+		"objectStore":         testObjectStore,
+		"objectStoreBucket":   "snapshots",
+		"encryptionKeySecret": "velero/snapshot-keys",
+	}))
+	dir := newTestVolume(t)
+	snapshotID, err := p.CreateSnapshot("hostPath:"+dir, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2023-03", keyVersionFromID(snapshotID))
+	volumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, volumeID)))
+
+	// Catalogs that lost the encryption of a snapshot fall back to its ID.
+	require.NoError(t, p.updateCatalog(func(c *SnapshotCatalog) {
+		snapshot := c.Snapshots[snapshotID]
+		snapshot.Encryption = nil
+		c.Snapshots[snapshotID] = snapshot
+	}))
+	volumeID, err = p.CreateVolumeFromSnapshot(snapshotID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, readTestTree(t, dir), readTestTree(t, testVolumeDir(t, p, volumeID)))
+
+	// Keys stored base64-encoded in the Secret have to say so.
+	config := map[string]string{
+		"stateDir":            t.TempDir(),
+		"objectStore":         testObjectStore,
+		"objectStoreBucket":   "snapshots",
+		"encryptionKeySecret": "velero/encoded-keys",
+	}
+	_, err = client.CoreV1().Secrets("velero").Create(context.TODO(), &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "encoded-keys"},
+		Data:       map[string][]byte{"v1": []byte(base64.StdEncoding.EncodeToString(key))},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Error(t, p.Init(config))
+	config["encryptionKeySecretEncoding"] = "base64"
+	require.NoError(t, p.Init(config))
+	assert.Equal(t, key, p.keys.keys["v1"])
+
+	assert.Error(t, p.Init(map[string]string{"stateDir": t.TempDir(), "encryptionKeySecret": "velero/missing"}))
+	assert.Error(t, p.Init(map[string]string{"stateDir": t.TempDir(), "encryptionKeyFile": newTestKeyFile(t, "v1"), "encryptionKeySecretEncoding": "raw"}))
+}
+
+// newTestKeyFile writes a key file with a random key for each version.
+func newTestKeyFile(t *testing.T, versions ...string) string {
+	var lines []string
+	for _, version := range versions {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		lines = append(lines, version+"="+base64.StdEncoding.EncodeToString(key))
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# snapshot keys\n"+strings.Join(lines, "\n")+"\n"), 0600))
+	return path
+}
+
+func TestGetVolumeInfoMissingVolume(t *testing.T) {
+	p := newTestSnapshotter(t, map[string]string{"stateDir": t.TempDir()})
+	_, _, err := p.GetVolumeInfo(filepath.Join(t.TempDir(), "missing"), "")
+	assert.Error(t, err)
+}
+
+func TestEscapeNameLimitsLength(t *testing.T) {
+	long := "/" + string(make([]byte, 300)) + ".snap.1"
+	other := "/" + string(make([]byte, 301)) + ".snap.1"
+	assert.LessOrEqual(t, len(escapeName(long)), maxNameLength)
+	assert.NotEqual(t, escapeName(long), escapeName(other))
+	assert.Equal(t, "%2Fdata%2Fvol.snap.1", escapeName("/data/vol.snap.1"))
+}
+
+func newTestPV(t *testing.T, source v1.PersistentVolumeSource) runtime.Unstructured {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+		Spec:       v1.PersistentVolumeSpec{PersistentVolumeSource: source},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+// testVolumeDir returns the directory of a volume created by the snapshotter.
+func testVolumeDir(t *testing.T, p *NoOpVolumeSnapshotter, volumeID string) string {
+	ref, err := parseVolumeID(volumeID)
+	require.NoError(t, err)
+	dir, err := p.volumeDir(ref)
+	require.NoError(t, err)
+	return dir
+}
+
+func copyConfig(config map[string]string) map[string]string {
+	copied := make(map[string]string, len(config))
+	for key, value := range config {
+		copied[key] = value
+	}
+	return copied
+}
+
+func newTestSnapshotter(t *testing.T, config map[string]string) *NoOpVolumeSnapshotter {
+	p := NewNoOpVolumeSnapshotter(newTestLogger())
+	require.NoError(t, p.Init(config))
+	t.Cleanup(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.stopRetention != nil {
+			p.stopRetention()
+		}
+	})
+	return p
+}
+
+// newTestVolume creates a hostPath volume with a bit of everything the snapshotter
+// preserves.
+func newTestVolume(t *testing.T) string {
+	volume := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(volume, "data", "nested"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data", "nested", "big"), make([]byte, 5000), 0640))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "empty"), nil, 0600))
+	require.NoError(t, os.Symlink("data/nested/big", filepath.Join(volume, "link")))
+	return volume
+}
+
+// readTestTree describes a directory tree by the mode and content of its entries.
+func readTestTree(t *testing.T, root string) map[string]string {
+	tree := make(map[string]string)
+	require.NoError(t, filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel := mustRel(root, path)
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			tree[rel] = "-> " + target
+			return err
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			tree[rel] = info.Mode().String() + " " + string(data)
+			return err
+		default:
+			tree[rel] = info.Mode().String()
+			return nil
+		}
+	}))
+	return tree
+}
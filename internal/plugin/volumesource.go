@@ -0,0 +1,153 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The PersistentVolume sources the snapshotter supports, as named in volume IDs.
+const (
+	sourceHostPath = "hostPath"
+	sourceLocal    = "local"
+	sourceNFS      = "nfs"
+	sourceCSI      = "csi"
+)
+
+// volumeRef identifies a volume by its source in the PersistentVolume spec. As a
+// volume ID, it's written "<source>:<location>":
+//
+//	hostPath:<path>
+//	local:<path>
+//	nfs:<server>:<export path>
+//	csi:<driver>:<volume handle>
+type volumeRef struct {
+	Source string
+	// Path is the path of hostPath and local volumes, and the export of NFS volumes.
+	Path   string
+	Server string
+	Driver string
+	Handle string
+}
+
+func (r volumeRef) String() string {
+	switch r.Source {
+	case sourceNFS:
+		return sourceNFS + ":" + r.Server + ":" + r.Path
+	case sourceCSI:
+		return sourceCSI + ":" + r.Driver + ":" + r.Handle
+	default:
+		return r.Source + ":" + r.Path
+	}
+}
+
+// parseVolumeID parses a volume ID written by volumeRef.String. IDs that are only
+// a path are hostPath volumes, snapshotted before other sources were supported.
+func parseVolumeID(volumeID string) (volumeRef, error) {
+	if strings.HasPrefix(volumeID, "/") {
+		return volumeRef{Source: sourceHostPath, Path: volumeID}, nil
+	}
+
+	source, location, _ := strings.Cut(volumeID, ":")
+	switch source {
+	case sourceHostPath, sourceLocal:
+		if location != "" {
+			return volumeRef{Source: source, Path: location}, nil
+		}
+	case sourceNFS:
+		// Export paths may contain colons, server names can't.
+		if server, exportPath, ok := strings.Cut(location, ":"); ok && server != "" && exportPath != "" {
+			return volumeRef{Source: source, Server: server, Path: exportPath}, nil
+		}
+	case sourceCSI:
+		// Volume handles are opaque and may contain colons, driver names can't.
+		if driver, handle, ok := strings.Cut(location, ":"); ok && driver != "" && handle != "" {
+			return volumeRef{Source: source, Driver: driver, Handle: handle}, nil
+		}
+	default:
+		return volumeRef{}, errors.Errorf("volume ID %q has an unsupported source %q", volumeID, source)
+	}
+	return volumeRef{}, errors.Errorf("invalid %s volume ID %q", source, volumeID)
+}
+
+// volumeRefFromPV returns the volume a PersistentVolume refers to, or an error
+// explaining why the PersistentVolume isn't supported.
+func volumeRefFromPV(pv *v1.PersistentVolume) (volumeRef, error) {
+	switch spec := pv.Spec; {
+	case spec.HostPath != nil:
+		if spec.HostPath.Path == "" {
+			return volumeRef{}, errors.New("spec.hostPath.path not found")
+		}
+		return volumeRef{Source: sourceHostPath, Path: spec.HostPath.Path}, nil
+	case spec.Local != nil:
+		if spec.Local.Path == "" {
+			return volumeRef{}, errors.New("spec.local.path not found")
+		}
+		return volumeRef{Source: sourceLocal, Path: spec.Local.Path}, nil
+	case spec.NFS != nil:
+		if spec.NFS.Server == "" || spec.NFS.Path == "" {
+			return volumeRef{}, errors.New("spec.nfs.server and spec.nfs.path are required")
+		}
+		return volumeRef{Source: sourceNFS, Server: spec.NFS.Server, Path: spec.NFS.Path}, nil
+	case spec.CSI != nil:
+		if spec.CSI.Driver == "" || spec.CSI.VolumeHandle == "" {
+			return volumeRef{}, errors.New("spec.csi.driver and spec.csi.volumeHandle are required")
+		}
+		return volumeRef{Source: sourceCSI, Driver: spec.CSI.Driver, Handle: spec.CSI.VolumeHandle}, nil
+	}
+	return volumeRef{}, errors.Errorf("PersistentVolume %s has no hostPath, local, nfs or csi volume source, which are the only ones supported", pv.Name)
+}
+
+// applyTo points a PersistentVolume with the same source at the volume.
+func (r volumeRef) applyTo(pv *v1.PersistentVolume) error {
+	switch spec := pv.Spec; {
+	case r.Source == sourceHostPath && spec.HostPath != nil:
+		spec.HostPath.Path = r.Path
+	case r.Source == sourceLocal && spec.Local != nil:
+		spec.Local.Path = r.Path
+	case r.Source == sourceNFS && spec.NFS != nil:
+		spec.NFS.Server = r.Server
+		spec.NFS.Path = r.Path
+	case r.Source == sourceCSI && spec.CSI != nil:
+		if spec.CSI.Driver != r.Driver {
+			return errors.Errorf("volume %s belongs to CSI driver %s, but PersistentVolume %s uses %s", r, r.Driver, pv.Name, spec.CSI.Driver)
+		}
+		spec.CSI.VolumeHandle = r.Handle
+	default:
+		return errors.Errorf("PersistentVolume %s has no %s volume source to set volume %s in", pv.Name, r.Source, r)
+	}
+	return nil
+}
+
+// sibling returns a volume of the same source named name: a directory next to
+// the export for NFS, and a new handle of the same driver for CSI. hostPath and
+// local volumes get a directory in volumesDir.
+func (r volumeRef) sibling(name, volumesDir string) volumeRef {
+	switch r.Source {
+	case sourceNFS:
+		r.Path = path.Join(path.Dir(r.Path), name)
+	case sourceCSI:
+		r.Handle = name
+	default:
+		r.Path = path.Join(volumesDir, name)
+	}
+	return r
+}
@@ -17,19 +17,60 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
 	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero-plugin-example/internal/cli"
 	"github.com/vmware-tanzu/velero-plugin-example/internal/plugin"
 	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	objectStorePluginName = "example.io/object-store-plugin"
+	restorePluginName     = "example.io/restore-plugin"
+	restorePluginV2Name   = "example.io/restore-pluginv2"
+	backupPluginName      = "example.io/backup-plugin"
+	backupPluginV2Name    = "example.io/backup-pluginv2"
 )
 
 func main() {
+	// The volume snapshotter can keep snapshot data in any of our object stores.
+	plugin.RegisterSnapshotObjectStore(objectStorePluginName, newObjectStorePlugin)
+
+	// Velero only ever starts the binary with flags, so anything else is one of
+	// the subcommands meant to be run by hand.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := cli.NewCommand(filepath.Base(os.Args[0]), cli.Plugins{
+			RestoreItemActions: []cli.Plugin{
+				{Name: restorePluginName, New: newRestorePlugin},
+				{Name: restorePluginV2Name, New: newRestorePluginV2},
+			},
+			BackupItemActions: []cli.Plugin{
+				{Name: backupPluginName, New: newBackupPlugin},
+				{Name: backupPluginV2Name, New: newBackupPluginV2, NewWithClient: newBackupPluginV2WithClient},
+			},
+		}).ExecuteContext(ctx)
+		stop()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	framework.NewServer().
-		RegisterObjectStore("example.io/object-store-plugin", newObjectStorePlugin).
+		RegisterObjectStore(objectStorePluginName, newObjectStorePlugin).
 		RegisterVolumeSnapshotter("example.io/volume-snapshotter-plugin", newNoOpVolumeSnapshotterPlugin).
-		RegisterRestoreItemAction("example.io/restore-plugin", newRestorePlugin).
-		RegisterRestoreItemActionV2("example.io/restore-pluginv2", newRestorePluginV2).
-		RegisterBackupItemAction("example.io/backup-plugin", newBackupPlugin).
-		RegisterBackupItemActionV2("example.io/backup-pluginv2", newBackupPluginV2).
+		RegisterRestoreItemAction(restorePluginName, newRestorePlugin).
+		RegisterRestoreItemActionV2(restorePluginV2Name, newRestorePluginV2).
+		RegisterBackupItemAction(backupPluginName, newBackupPlugin).
+		RegisterBackupItemActionV2(backupPluginV2Name, newBackupPluginV2).
 		Serve()
 }
 
@@ -41,6 +82,10 @@ func newBackupPluginV2(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewBackupPluginV2(logger), nil
 }
 
+func newBackupPluginV2WithClient(logger logrus.FieldLogger, client kubernetes.Interface) (interface{}, error) {
+	return plugin.NewBackupPluginV2WithClient(logger, client), nil
+}
+
 func newObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewFileObjectStore(logger), nil
 }